@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultHMACHeader is the header with the body signature when not set in the config.
+const DefaultHMACHeader = "X-Signature"
+
+// maxBodySize limits the body read for the signature check.
+const maxBodySize = 10 << 20
+
+// DefaultOpen are the endpoints without authentication when not set in the config
+// so that the prometheus scraping keeps working when the authentication is enabled.
+var DefaultOpen = []string{"/metrics"}
+
+// New creates the authentication for the http endpoints.
+// All requests are accepted when no method is set in the config.
+func New(cfg config.Auth) (*Auth, error) {
+	return newAuth(cfg, newMetrics())
+}
+
+func newAuth(cfg config.Auth, m *metrics) (*Auth, error) {
+	a := &Auth{
+		hmacHeader: cfg.HMACHeader,
+		trustProxy: cfg.TrustProxy,
+		open:       make(map[string]struct{}),
+		metrics:    m,
+	}
+	if a.hmacHeader == "" {
+		a.hmacHeader = DefaultHMACHeader
+	}
+	for i, t := range cfg.Tokens {
+		if t == "" {
+			return nil, errors.Errorf("auth token:%v is empty", i)
+		}
+		a.tokens = append(a.tokens, []byte(t))
+	}
+	for i, s := range cfg.HMACSecrets {
+		if s == "" {
+			return nil, errors.Errorf("auth hmac secret:%v is empty", i)
+		}
+		a.hmacSecrets = append(a.hmacSecrets, []byte(s))
+	}
+	for _, ip := range cfg.AllowIPs {
+		if !strings.Contains(ip, "/") {
+			if strings.Contains(ip, ":") {
+				ip += "/128"
+			} else {
+				ip += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing the auth allowed ip:%v", ip)
+		}
+		a.allowIPs = append(a.allowIPs, n)
+	}
+	open := cfg.Open
+	if open == nil {
+		open = DefaultOpen
+	}
+	for _, path := range open {
+		a.open[path] = struct{}{}
+	}
+	return a, nil
+}
+
+// Auth checks the requests by a bearer token,
+// an HMAC signature of the body or the client address.
+type Auth struct {
+	tokens      [][]byte
+	hmacSecrets [][]byte
+	hmacHeader  string
+	allowIPs    []*net.IPNet
+	trustProxy  bool
+	open        map[string]struct{}
+	metrics     *metrics
+}
+
+// Enabled reports if any authentication method is set.
+func (a *Auth) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.hmacSecrets) > 0 || len(a.allowIPs) > 0
+}
+
+// Handler wraps an endpoint and replies with status 401
+// to the requests which don't pass any of the methods.
+func (a *Auth) Handler(path string, h http.Handler) http.Handler {
+	if _, ok := a.open[path]; ok || !a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason, err := a.check(r)
+		if err != nil {
+			log.Printf("[error] reading the request path:%v err:%v", path, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if reason != "" {
+			a.metrics.rejected.With(prometheus.Labels{"path": path, "reason": reason}).Inc()
+			log.Printf("[error] unauthorized request path:%v client:%v reason:%v", path, r.RemoteAddr, reason)
+			if len(a.tokens) > 0 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// check returns an empty reason when the request is accepted,
+// "missing" when no credentials are sent and "invalid" when these don't match.
+func (a *Auth) check(r *http.Request) (string, error) {
+	if len(a.allowIPs) > 0 {
+		if ip := a.clientIP(r); ip != nil {
+			for _, n := range a.allowIPs {
+				if n.Contains(ip) {
+					if os.Getenv("DEBUG") == "1" {
+						log.Printf("accepted request by the client address:%v", ip)
+					}
+					return "", nil
+				}
+			}
+		}
+	}
+
+	reason := "missing"
+	if len(a.tokens) > 0 {
+		if h := r.Header.Get("Authorization"); h != "" {
+			reason = "invalid"
+			if token := strings.TrimPrefix(h, "Bearer "); token != h {
+				for _, t := range a.tokens {
+					if subtle.ConstantTimeCompare([]byte(token), t) == 1 {
+						return "", nil
+					}
+				}
+			}
+		}
+	}
+
+	if len(a.hmacSecrets) > 0 {
+		if h := r.Header.Get(a.hmacHeader); h != "" {
+			reason = "invalid"
+			sig, err := hex.DecodeString(strings.TrimPrefix(h, "sha256="))
+			if err != nil {
+				return reason, nil
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+			if err != nil {
+				return "", errors.Wrap(err, "reading the request body")
+			}
+			// Restore the body for the endpoint.
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			for _, s := range a.hmacSecrets {
+				mac := hmac.New(sha256.New, s)
+				mac.Write(body)
+				if hmac.Equal(sig, mac.Sum(nil)) {
+					return "", nil
+				}
+			}
+		}
+	}
+	return reason, nil
+}
+
+func (a *Auth) clientIP(r *http.Request) net.IP {
+	addr := r.RemoteAddr
+	if a.trustProxy {
+		// The last address is added by the proxy and
+		// the ones before it can be set by the client.
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			ips := strings.Split(fwd[len(fwd)-1], ",")
+			return net.ParseIP(strings.TrimSpace(ips[len(ips)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rejected: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "auth_rejected_total",
+				Help: "The total number of unauthorized requests for each endpoint by reason.",
+			},
+			[]string{"path", "reason"},
+		),
+	}
+}
+
+type metrics struct {
+	rejected *prometheus.CounterVec
+}
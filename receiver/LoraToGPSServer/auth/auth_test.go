@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testMetrics are shared by the tests because the metrics can be registered only once.
+var testMetrics = newMetrics()
+
+const testBody = `{"deviceInfo": {"deviceName": "collar1"}}`
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// echo replies with the request body to check that the body is kept for the endpoint.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	w.Write(b)
+})
+
+func TestHandler(t *testing.T) {
+	tokens := config.Auth{Tokens: []string{"token1", "token2"}}
+	secrets := config.Auth{HMACSecrets: []string{"secret1", "secret2"}}
+	ips := config.Auth{AllowIPs: []string{"192.168.1.10", "172.16.0.0/12", "fd00::/8"}}
+	proxy := config.Auth{AllowIPs: []string{"172.16.0.0/12"}, TrustProxy: true}
+
+	tests := []struct {
+		name       string
+		cfg        config.Auth
+		path       string
+		remoteAddr string
+		headers    map[string][]string
+		status     int
+		reason     string
+	}{
+		{name: "no methods", status: http.StatusOK},
+
+		{name: "token", cfg: tokens, headers: map[string][]string{"Authorization": {"Bearer token2"}}, status: http.StatusOK},
+		{name: "wrong token", cfg: tokens, headers: map[string][]string{"Authorization": {"Bearer token3"}}, status: http.StatusUnauthorized, reason: "invalid"},
+		{name: "token without the bearer scheme", cfg: tokens, headers: map[string][]string{"Authorization": {"token1"}}, status: http.StatusUnauthorized, reason: "invalid"},
+		{name: "missing token", cfg: tokens, status: http.StatusUnauthorized, reason: "missing"},
+
+		{name: "hmac", cfg: secrets, headers: map[string][]string{"X-Signature": {sign("secret2", testBody)}}, status: http.StatusOK},
+		{name: "hmac with the sha256 prefix", cfg: secrets, headers: map[string][]string{"X-Signature": {"sha256=" + sign("secret1", testBody)}}, status: http.StatusOK},
+		{
+			name:    "hmac in the header from the config",
+			cfg:     config.Auth{HMACSecrets: []string{"secret1"}, HMACHeader: "X-Hub-Signature-256"},
+			headers: map[string][]string{"X-Hub-Signature-256": {"sha256=" + sign("secret1", testBody)}},
+			status:  http.StatusOK,
+		},
+		{name: "hmac of another body", cfg: secrets, headers: map[string][]string{"X-Signature": {sign("secret1", "{}")}}, status: http.StatusUnauthorized, reason: "invalid"},
+		{name: "hmac with another secret", cfg: secrets, headers: map[string][]string{"X-Signature": {sign("secret3", testBody)}}, status: http.StatusUnauthorized, reason: "invalid"},
+		{name: "hmac not in hex", cfg: secrets, headers: map[string][]string{"X-Signature": {"signature"}}, status: http.StatusUnauthorized, reason: "invalid"},
+		{name: "missing hmac", cfg: secrets, status: http.StatusUnauthorized, reason: "missing"},
+
+		{name: "allowed ip", cfg: ips, remoteAddr: "192.168.1.10:40000", status: http.StatusOK},
+		{name: "allowed ip range", cfg: ips, remoteAddr: "172.20.0.5:40000", status: http.StatusOK},
+		{name: "allowed ipv6 range", cfg: ips, remoteAddr: "[fd00::1]:40000", status: http.StatusOK},
+		{name: "ip outside the range", cfg: ips, remoteAddr: "192.168.1.11:40000", status: http.StatusUnauthorized, reason: "missing"},
+
+		{name: "proxy client ip", cfg: proxy, remoteAddr: "10.0.0.1:40000", headers: map[string][]string{"X-Forwarded-For": {"203.0.113.5, 172.16.0.5"}}, status: http.StatusOK},
+		{name: "proxy client ip spoofed before the proxy address", cfg: proxy, remoteAddr: "10.0.0.1:40000", headers: map[string][]string{"X-Forwarded-For": {"172.16.0.5, 203.0.113.5"}}, status: http.StatusUnauthorized, reason: "missing"},
+		{name: "proxy client ip in the last header", cfg: proxy, remoteAddr: "10.0.0.1:40000", headers: map[string][]string{"X-Forwarded-For": {"172.16.0.5", "203.0.113.5"}}, status: http.StatusUnauthorized, reason: "missing"},
+		{name: "proxy without a forwarded header", cfg: proxy, remoteAddr: "172.16.0.1:40000", status: http.StatusOK},
+		{
+			name:       "forwarded header without trusting the proxy",
+			cfg:        config.Auth{AllowIPs: []string{"172.16.0.0/12"}},
+			remoteAddr: "10.0.0.1:40000",
+			headers:    map[string][]string{"X-Forwarded-For": {"172.16.0.5"}},
+			status:     http.StatusUnauthorized,
+			reason:     "missing",
+		},
+
+		{
+			name:       "token from a client outside the allowed ips",
+			cfg:        config.Auth{Tokens: []string{"token1"}, AllowIPs: []string{"172.16.0.0/12"}},
+			remoteAddr: "10.0.0.1:40000",
+			headers:    map[string][]string{"Authorization": {"Bearer token1"}},
+			status:     http.StatusOK,
+		},
+		{
+			name:    "wrong token with a valid hmac",
+			cfg:     config.Auth{Tokens: []string{"token1"}, HMACSecrets: []string{"secret1"}},
+			headers: map[string][]string{"Authorization": {"Bearer token2"}, "X-Signature": {sign("secret1", testBody)}},
+			status:  http.StatusOK,
+		},
+
+		{name: "metrics open by default", cfg: tokens, path: "/metrics", status: http.StatusOK},
+		{
+			name:   "metrics without the default open endpoints",
+			cfg:    config.Auth{Tokens: []string{"token1"}, Open: []string{}},
+			path:   "/metrics",
+			status: http.StatusUnauthorized,
+			reason: "missing",
+		},
+		{name: "open endpoint from the config", cfg: config.Auth{Tokens: []string{"token1"}, Open: []string{"/homeRange"}}, path: "/homeRange", status: http.StatusOK},
+		{
+			name:   "metrics not in the open endpoints from the config",
+			cfg:    config.Auth{Tokens: []string{"token1"}, Open: []string{"/homeRange"}},
+			path:   "/metrics",
+			status: http.StatusUnauthorized,
+			reason: "missing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAuth(tt.cfg, testMetrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := tt.path
+			if path == "" {
+				path = "/uplink"
+			}
+			var counter prometheus.Counter
+			var before float64
+			if tt.reason != "" {
+				counter = testMetrics.rejected.With(prometheus.Labels{"path": path, "reason": tt.reason})
+				before = testutil.ToFloat64(counter)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(testBody)))
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			for name, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(name, v)
+				}
+			}
+			w := httptest.NewRecorder()
+			a.Handler(path, echo).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status got:%v expected:%v", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				if body := w.Body.String(); body != testBody {
+					t.Errorf("endpoint body got:%q expected:%q", body, testBody)
+				}
+				return
+			}
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("rejected metric reason:%v got:%v expected:1", tt.reason, got)
+			}
+			if auth := w.Header().Get("WWW-Authenticate"); (auth == "Bearer") != (len(tt.cfg.Tokens) > 0) {
+				t.Errorf("WWW-Authenticate header got:%q", auth)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Auth
+		err  string
+	}{
+		{name: "empty token", cfg: config.Auth{Tokens: []string{"token1", ""}}, err: "auth token:1 is empty"},
+		{name: "empty hmac secret", cfg: config.Auth{HMACSecrets: []string{""}}, err: "auth hmac secret:0 is empty"},
+		{name: "invalid ip", cfg: config.Auth{AllowIPs: []string{"192.168.1"}}, err: "parsing the auth allowed ip:192.168.1/32"},
+		{name: "invalid ip range", cfg: config.Auth{AllowIPs: []string{"172.16.0.0/40"}}, err: "parsing the auth allowed ip:172.16.0.0/40"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAuth(tt.cfg, testMetrics)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
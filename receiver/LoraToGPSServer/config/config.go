@@ -0,0 +1,281 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the receiver config file.
+type Config struct {
+	SmartConnect SmartConnect `json:"smartConnect"`
+	Traccar      Traccar      `json:"traccar"`
+	Auth         Auth         `json:"auth"`
+	Filters      Filters      `json:"filters"`
+	// Stationary sets the mortality detection per "species" device tag
+	// and the "default" entry is used for the other devices.
+	Stationary map[string]Stationary `json:"stationary,omitempty"`
+	// Encounters are the rules for the devices which come close to each other.
+	Encounters []Encounter `json:"encounters,omitempty"`
+}
+
+// Encounter raises the encounter alarms when a device of the group
+// comes within the Distance in meters of a device of the others.
+// When Others is not set the encounters are between the devices of the group.
+type Encounter struct {
+	Name     string       `json:"name"`
+	Group    DeviceGroup  `json:"group"`
+	Others   *DeviceGroup `json:"others,omitempty"`
+	Distance float64      `json:"distance"`
+	// MaxGap is the max time between the fixes of the two devices. 30m when 0.
+	MaxGap Duration `json:"maxGap,omitempty"`
+}
+
+// DeviceGroup matches the devices by any of the names or DevEUIs,
+// the "species" device tags or the device types.
+type DeviceGroup struct {
+	Devices []string `json:"devices,omitempty"`
+	Species []string `json:"species,omitempty"`
+	Types   []string `json:"types,omitempty"`
+}
+
+// Stationary raises a mortality alarm when all fixes of a device are
+// within the Radius in meters for longer than the Duration without a motion flag.
+type Stationary struct {
+	Radius   float64  `json:"radius"`
+	Duration Duration `json:"duration"`
+}
+
+// Filters sets the quality checks of the gps points before sending these to the sinks.
+// The rejected points are marked as invalid.
+type Filters struct {
+	// Types sets the checks per device type
+	// and the "default" entry is used for the other types.
+	Types map[string]TypeFilter `json:"types,omitempty"`
+	// Species sets the checks per "species" device tag
+	// and the "default" entry is used for the other devices.
+	Species map[string]SpeciesFilter `json:"species,omitempty"`
+	// MaxFixAge rejects the points with an older gps fix time. Disabled when 0.
+	MaxFixAge Duration `json:"maxFixAge,omitempty"`
+	// Outlier rejects the points far from the recent track of the device.
+	Outlier *Outlier `json:"outlier,omitempty"`
+}
+
+// TypeFilter sets the gps accuracy checks for a device type.
+// The checks which are 0 are disabled.
+type TypeFilter struct {
+	MaxHdop float64 `json:"maxHdop,omitempty"`
+	// MaxEhpe is the max estimated horizontal position error in meters.
+	MaxEhpe       float64 `json:"maxEhpe,omitempty"`
+	MinSatellites int     `json:"minSatellites,omitempty"`
+}
+
+// SpeciesFilter sets the movement checks for a species.
+type SpeciesFilter struct {
+	// MaxSpeed in km/h from the last accepted point. Disabled when 0.
+	MaxSpeed float64 `json:"maxSpeed,omitempty"`
+}
+
+// Outlier rejects a point which is further than MaxDistance meters
+// from the median position of the last Points accepted points within the Window.
+type Outlier struct {
+	Points      int      `json:"points,omitempty"`
+	Window      Duration `json:"window,omitempty"`
+	MaxDistance float64  `json:"maxDistance"`
+}
+
+// Auth sets the authentication of the http endpoints.
+// When any method is set a request is accepted
+// when it passes at least one of the set methods.
+type Auth struct {
+	// Tokens are the accepted bearer tokens in the Authorization header.
+	Tokens []string `json:"tokens,omitempty"`
+	// HMACSecrets are the accepted secrets for the HMAC-SHA256 signature of the request body.
+	HMACSecrets []string `json:"hmacSecrets,omitempty"`
+	// HMACHeader is the header with the hex signature and
+	// it can have a sha256= prefix. X-Signature when empty.
+	HMACHeader string `json:"hmacHeader,omitempty"`
+	// AllowIPs are the accepted client addresses or CIDR ranges.
+	AllowIPs []string `json:"allowIPs,omitempty"`
+	// TrustProxy uses the last address of the X-Forwarded-For header
+	// as the client address for the receivers behind a reverse proxy.
+	TrustProxy bool `json:"trustProxy,omitempty"`
+	// Open are the endpoints without authentication, /metrics when not set
+	// and an empty list requires the authentication for all endpoints.
+	Open []string `json:"open,omitempty"`
+}
+
+// Traccar sets the traccar sink.
+type Traccar struct {
+	Client Client `json:"client"`
+}
+
+// Client sets the TLS trust and the timeouts of the http client of a sink.
+// The server certificate is verified by the system CAs,
+// the CA file or the pinned fingerprint.
+type Client struct {
+	// CA is a PEM file with the CAs for the server certificate
+	// and it replaces the system CAs.
+	CA string `json:"ca,omitempty"`
+	// Cert and Key are PEM files with the client certificate for mutual TLS.
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	// Fingerprint pins the server certificate by its SHA-256 fingerprint in hex
+	// and it replaces the CA verification so that it works with self signed certificates.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Insecure disables the server certificate verification.
+	Insecure bool `json:"insecure,omitempty"`
+
+	ConnectTimeout Duration `json:"connectTimeout,omitempty"`
+	RequestTimeout Duration `json:"requestTimeout,omitempty"`
+	IdleTimeout    Duration `json:"idleTimeout,omitempty"`
+}
+
+// SmartConnect sets the SMART connect servers and
+// which devices send to each conservation area.
+type SmartConnect struct {
+	Client  Client        `json:"client"`
+	Servers []SmartServer `json:"servers"`
+	Routes  []SmartRoute  `json:"routes"`
+	Styles  []SmartStyle  `json:"styles,omitempty"`
+	Patrol  *Patrol       `json:"patrol,omitempty"`
+}
+
+// SmartServer is a SMART connect server with its conservation areas.
+type SmartServer struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	User string `json:"user"`
+	Pass string `json:"pass"`
+	// ConservationAreas maps a name used in the routes to the conservation area uuid.
+	ConservationAreas map[string]string `json:"conservationAreas"`
+}
+
+// SmartRoute maps devices or applications to a conservation area of a server.
+// The devices are matched by name or DevEUI and the applications by name or ID.
+// A route without devices and applications matches all uplinks.
+type SmartRoute struct {
+	Devices          []string `json:"devices,omitempty"`
+	Applications     []string `json:"applications,omitempty"`
+	Server           string   `json:"server"`
+	ConservationArea string   `json:"conservationArea"`
+}
+
+// SmartStyle sets how the alerts of the matching devices are displayed in SMART connect.
+// The devices are matched by all the tags, the "species" tag and the application name or ID.
+// When several of these are set all must match and
+// a style without any of these matches all devices.
+// The first matching style is used and the unset fields use the defaults.
+type SmartStyle struct {
+	Tags         map[string]string `json:"tags,omitempty"`
+	Species      []string          `json:"species,omitempty"`
+	Applications []string          `json:"applications,omitempty"`
+	// Label is the alert type label.
+	// {id} is replaced with the device ID and {name} with the device name.
+	Label       string `json:"label,omitempty"`
+	Color       string `json:"color,omitempty"`
+	Opacity     string `json:"opacity,omitempty"`
+	MarkerIcon  string `json:"markerIcon,omitempty"`
+	MarkerColor string `json:"markerColor,omitempty"`
+	Spin        bool   `json:"spin,omitempty"`
+	// Level is the alert level from 1 to 5.
+	Level int `json:"level,omitempty"`
+}
+
+// Patrol enables the SMART desktop patrol uploads generated from the device tracks.
+type Patrol struct {
+	// Interval uploads the buffered track points on a schedule.
+	// Disabled when 0 and then a patrol is uploaded only when its track closes.
+	Interval Duration `json:"interval,omitempty"`
+	// TrackGap closes a track when no points are received for this long.
+	TrackGap Duration `json:"trackGap,omitempty"`
+	// Template is a text/template file for the patrol xml.
+	// The built-in template is used when empty.
+	Template string `json:"template,omitempty"`
+	// TimeZone is the IANA time zone for the patrol dates and times, UTC when empty.
+	TimeZone string `json:"timeZone,omitempty"`
+	// Metadata are the patrol details for the template
+	// like team, station, mandate, patrolType, transportType and employeeId.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Duration is a time.Duration in the config file
+// set as a string like "1h30m".
+type Duration time.Duration
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrap(err, "duration should be a string like 1h30m")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Load reads a json config file.
+// Environment variables like ${SMART_PASS} in the secrets, the server urls and the certificate files
+// are expanded so that the secrets can be kept outside of the file.
+func Load(path string) (*Config, error) {
+	c, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the config file")
+	}
+
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(c))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, errors.Wrapf(err, "parsing the config file:%v", path)
+	}
+	cfg.expandEnv()
+	return cfg, nil
+}
+
+func (cfg *Config) expandEnv() {
+	for i := range cfg.Auth.Tokens {
+		expandEnv(&cfg.Auth.Tokens[i])
+	}
+	for i := range cfg.Auth.HMACSecrets {
+		expandEnv(&cfg.Auth.HMACSecrets[i])
+	}
+	cfg.Traccar.Client.expandEnv()
+	cfg.SmartConnect.Client.expandEnv()
+	for i := range cfg.SmartConnect.Servers {
+		s := &cfg.SmartConnect.Servers[i]
+		expandEnv(&s.URL)
+		expandEnv(&s.User)
+		expandEnv(&s.Pass)
+	}
+}
+
+func (c *Client) expandEnv() {
+	expandEnv(&c.CA)
+	expandEnv(&c.Cert)
+	expandEnv(&c.Key)
+	expandEnv(&c.Fingerprint)
+}
+
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces only the ${NAME} references
+// so that a literal $ in a password or url is kept.
+func expandEnv(s *string) {
+	*s = envVar.ReplaceAllStringFunc(*s, func(v string) string {
+		return os.Getenv(v[2 : len(v)-1])
+	})
+}
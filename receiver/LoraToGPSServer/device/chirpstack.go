@@ -0,0 +1,227 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/pkg/errors"
+)
+
+// Decode detects the format of a chirpstack uplink event
+// and maps it to a DataUpPayload.
+// Supported formats are the v3 "Protobuf", "JSON" and "JSON legacy" marshalers and the v4 event json.
+// The content type selects between protobuf and json and
+// when empty it is detected from the content itself.
+func Decode(contentType string, c []byte) (*DataUpPayload, error) {
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing content type:%v", contentType)
+		}
+		switch mediaType {
+		case "application/octet-stream", "application/protobuf", "application/x-protobuf":
+			return decodeProtobuf(c)
+		case "application/json", "text/plain":
+		default:
+			return nil, errors.Errorf("unsupported content type:%v", contentType)
+		}
+	} else if !bytes.HasPrefix(bytes.TrimSpace(c), []byte("{")) {
+		return decodeProtobuf(c)
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(c, &fields); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling request body")
+	}
+
+	// Only v4 nests the device details under deviceInfo.
+	if _, ok := fields["deviceInfo"]; ok {
+		return decodeV4(c)
+	}
+
+	// The legacy marshaler encodes the EUIs as hex and
+	// the v3 json marshaler as base64.
+	var devEUI string
+	if raw, ok := fields["devEUI"]; ok {
+		if err := json.Unmarshal(raw, &devEUI); err != nil {
+			return nil, errors.Wrap(err, "unmarshaling devEUI")
+		}
+	}
+	if _, ok := fields["objectJSON"]; ok || (devEUI != "" && len(devEUI) != len(lorawan.EUI64{})*2) {
+		return decodeV3(c)
+	}
+
+	data := &DataUpPayload{}
+	if err := json.Unmarshal(c, data); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling v3 legacy json")
+	}
+	return data, nil
+}
+
+func decodeV3(c []byte) (*DataUpPayload, error) {
+	event := &uplinkEventV3{}
+	if err := json.Unmarshal(c, event); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling v3 json")
+	}
+
+	data := &DataUpPayload{
+		ApplicationID:     event.ApplicationID,
+		ApplicationName:   event.ApplicationName,
+		DeviceName:        event.DeviceName,
+		DeviceProfileName: event.DeviceProfileName,
+		TXInfo: TXInfo{
+			Frequency: event.TXInfo.Frequency,
+			DR:        event.DR,
+		},
+		ADR:   event.ADR,
+		FCnt:  event.FCnt,
+		FPort: event.FPort,
+		Data:  event.Data,
+		Tags:  event.Tags,
+	}
+
+	if err := copyEUI(&data.DevEUI, event.DevEUI); err != nil {
+		return nil, errors.Wrap(err, "devEUI")
+	}
+
+	if err := decodeObjectJSON(data, event.ObjectJSON); err != nil {
+		return nil, err
+	}
+
+	for _, rx := range event.RXInfo {
+		rxInfo := RXInfo{
+			Time:     rx.Time,
+			RSSI:     rx.RSSI,
+			LoRaSNR:  rx.LoRaSNR,
+			Location: rx.Location,
+		}
+		if err := copyEUI(&rxInfo.GatewayID, rx.GatewayID); err != nil {
+			return nil, errors.Wrap(err, "gatewayID")
+		}
+		data.RXInfo = append(data.RXInfo, rxInfo)
+	}
+
+	return data, nil
+}
+
+func decodeV4(c []byte) (*DataUpPayload, error) {
+	event := &uplinkEventV4{}
+	if err := json.Unmarshal(c, event); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling v4 json")
+	}
+
+	data := &DataUpPayload{
+		ApplicationID:     event.DeviceInfo.ApplicationID,
+		ApplicationName:   event.DeviceInfo.ApplicationName,
+		DeviceName:        event.DeviceInfo.DeviceName,
+		DeviceProfileName: event.DeviceInfo.DeviceProfileName,
+		DevEUI:            event.DeviceInfo.DevEUI,
+		TXInfo: TXInfo{
+			Frequency: event.TXInfo.Frequency,
+			DR:        event.DR,
+		},
+		ADR:    event.ADR,
+		FCnt:   event.FCnt,
+		FPort:  event.FPort,
+		Data:   event.Data,
+		Object: event.Object,
+		Tags:   event.DeviceInfo.Tags,
+	}
+
+	for _, rx := range event.RXInfo {
+		data.RXInfo = append(data.RXInfo, RXInfo{
+			GatewayID: rx.GatewayID,
+			Time:      rx.Time,
+			RSSI:      rx.RSSI,
+			LoRaSNR:   rx.SNR,
+			Location:  rx.Location,
+		})
+	}
+
+	return data, nil
+}
+
+// copyEUI copies a binary EUI as used by the v3 "JSON" and "Protobuf" marshalers.
+func copyEUI(eui *lorawan.EUI64, b []byte) error {
+	if len(b) != len(eui) {
+		return errors.Errorf("invalid EUI length:%v", len(b))
+	}
+	copy(eui[:], b)
+	return nil
+}
+
+// decodeObjectJSON decodes the codec object which
+// the v3 "JSON" and "Protobuf" marshalers send as a json string.
+func decodeObjectJSON(data *DataUpPayload, objectJSON string) error {
+	if objectJSON == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(objectJSON), &data.Object); err != nil {
+		return errors.Wrap(err, "unmarshaling objectJSON")
+	}
+	return nil
+}
+
+// uplinkEventV3 is the chirpstack v3 uplink event as encoded by the "JSON" marshaler.
+type uplinkEventV3 struct {
+	ApplicationID   string `json:"applicationID"`
+	ApplicationName string `json:"applicationName"`
+	DeviceName      string `json:"deviceName"`
+	DevEUI          []byte `json:"devEUI"`
+	RXInfo          []struct {
+		GatewayID []byte     `json:"gatewayID"`
+		Time      *time.Time `json:"time,omitempty"`
+		RSSI      int        `json:"rssi"`
+		LoRaSNR   float64    `json:"loRaSNR"`
+		Location  *Location  `json:"location"`
+	} `json:"rxInfo,omitempty"`
+	TXInfo struct {
+		Frequency int `json:"frequency"`
+	} `json:"txInfo"`
+	ADR               bool              `json:"adr"`
+	DR                int               `json:"dr"`
+	FCnt              uint32            `json:"fCnt"`
+	FPort             uint8             `json:"fPort"`
+	Data              []byte            `json:"data"`
+	ObjectJSON        string            `json:"objectJSON"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	DeviceProfileName string            `json:"deviceProfileName"`
+}
+
+// uplinkEventV4 is the chirpstack v4 uplink event.
+type uplinkEventV4 struct {
+	DeduplicationID string     `json:"deduplicationId"`
+	Time            *time.Time `json:"time,omitempty"`
+	DeviceInfo      struct {
+		TenantID          string            `json:"tenantId"`
+		TenantName        string            `json:"tenantName"`
+		ApplicationID     string            `json:"applicationId"`
+		ApplicationName   string            `json:"applicationName"`
+		DeviceProfileID   string            `json:"deviceProfileId"`
+		DeviceProfileName string            `json:"deviceProfileName"`
+		DeviceName        string            `json:"deviceName"`
+		DevEUI            lorawan.EUI64     `json:"devEui"`
+		Tags              map[string]string `json:"tags,omitempty"`
+	} `json:"deviceInfo"`
+	DevAddr string                 `json:"devAddr"`
+	ADR     bool                   `json:"adr"`
+	DR      int                    `json:"dr"`
+	FCnt    uint32                 `json:"fCnt"`
+	FPort   uint8                  `json:"fPort"`
+	Data    []byte                 `json:"data"`
+	Object  map[string]interface{} `json:"object,omitempty"`
+	RXInfo  []struct {
+		GatewayID lorawan.EUI64     `json:"gatewayId"`
+		Time      *time.Time        `json:"time,omitempty"`
+		RSSI      int               `json:"rssi"`
+		SNR       float64           `json:"snr"`
+		Location  *Location         `json:"location"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+	} `json:"rxInfo,omitempty"`
+	TXInfo struct {
+		Frequency int `json:"frequency"`
+	} `json:"txInfo"`
+}
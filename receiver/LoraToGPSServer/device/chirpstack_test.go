@@ -0,0 +1,263 @@
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+// The uplink samples of the chirpstack integrations for the same uplink of an irnas1 device
+// received by 2 gateways.
+
+const v3LegacyJSON = `{
+	"applicationID": "1",
+	"applicationName": "gpsTracker",
+	"deviceName": "irnas1",
+	"devEUI": "7076050000000001",
+	"rxInfo": [
+		{
+			"gatewayID": "0000000000000001",
+			"uplinkID": "0b5d7c8e-1b5a-4a2b-9f4c-5d2b1e0f3a6c",
+			"name": "ridge",
+			"time": "2021-10-02T10:00:00.5Z",
+			"rssi": -80,
+			"loRaSNR": 5.5,
+			"location": { "latitude": -1.2, "longitude": 36.8, "altitude": 1650 }
+		},
+		{
+			"gatewayID": "0000000000000002",
+			"uplinkID": "7d1e4c2a-9b3f-4e8d-a1c5-2f6b0d9e8a7b",
+			"name": "valley",
+			"rssi": -110,
+			"loRaSNR": -7.25,
+			"location": { "latitude": -1.3, "longitude": 36.9, "altitude": 1500 }
+		}
+	],
+	"txInfo": { "frequency": 868100000, "dr": 5 },
+	"adr": true,
+	"fCnt": 10,
+	"fPort": 1,
+	"data": "AQ==",
+	"object": { "lat": -1.25, "lon": 36.85, "hdop": 1.2, "time": 1633168800 },
+	"tags": { "type": "irnas", "species": "rhino" }
+}`
+
+const v3JSON = `{
+	"applicationID": "1",
+	"applicationName": "gpsTracker",
+	"deviceName": "irnas1",
+	"deviceProfileName": "irnas-profile",
+	"devEUI": "cHYFAAAAAAE=",
+	"rxInfo": [
+		{
+			"gatewayID": "AAAAAAAAAAE=",
+			"time": "2021-10-02T10:00:00.5Z",
+			"timeSinceGPSEpoch": null,
+			"rssi": -80,
+			"loRaSNR": 5.5,
+			"channel": 2,
+			"rfChain": 1,
+			"board": 0,
+			"antenna": 0,
+			"location": { "latitude": -1.2, "longitude": 36.8, "altitude": 1650, "source": "UNKNOWN", "accuracy": 0 },
+			"fineTimestampType": "NONE",
+			"context": "AAAAAA==",
+			"uplinkID": "C118jhtaSiufTF0rHg86bA==",
+			"crcStatus": "CRC_OK"
+		},
+		{
+			"gatewayID": "AAAAAAAAAAI=",
+			"time": null,
+			"rssi": -110,
+			"loRaSNR": -7.25,
+			"location": null,
+			"uplinkID": "fR5MKps/To2hxS9rDZ6Kew=="
+		}
+	],
+	"txInfo": {
+		"frequency": 868100000,
+		"modulation": "LORA",
+		"loRaModulationInfo": { "bandwidth": 125, "spreadingFactor": 7, "codeRate": "4/5", "polarizationInversion": false }
+	},
+	"adr": true,
+	"dr": 5,
+	"fCnt": 10,
+	"fPort": 1,
+	"data": "AQ==",
+	"objectJSON": "{\"lat\":-1.25,\"lon\":36.85,\"hdop\":1.2,\"time\":1633168800}",
+	"tags": { "type": "irnas", "species": "rhino" },
+	"confirmedUplink": true,
+	"devAddr": "AQIDBA==",
+	"publishedAt": "2021-10-02T10:00:00.612Z"
+}`
+
+// v3Protobuf is the same uplink as v3JSON encoded by the "Protobuf" marshaler
+// with the unused fields like rx_info.channel, confirmed_uplink and dev_addr
+// to check that these are skipped.
+const v3Protobuf = "0801120a677073547261636b65721a0669726e617331220870760500000000012a5e0a080000000000000001120c08a0dbe0" +
+	"8a061080cab5ee0128b0ffffffffffffffff0131000000000000164038025a1b09333333333333f3bf116666666666664240" +
+	"190000000000c89940820110010101010101010101010101010101012a1e0a0800000000000000022892ffffffffffffffff" +
+	"01310000000000001dc0320a08a0cff89d031202087d38014005480a50015a010162367b226c6174223a2d312e32352c226c" +
+	"6f6e223a33362e38352c2268646f70223a312e322c2274696d65223a313633333136383830307d6a0d0a0474797065120569" +
+	"726e61736a100a077370656369657312057268696e6f70017a040102030492010d69726e61732d70726f66696c65"
+
+const v4JSON = `{
+	"deduplicationId": "3a3b1b5e-8f0e-4a4c-9a7d-1c2b3d4e5f60",
+	"time": "2021-10-02T10:00:00.612Z",
+	"deviceInfo": {
+		"tenantId": "52f14cd4-c6f1-4fbd-8f87-4025e1d49242",
+		"tenantName": "ChirpStack",
+		"applicationId": "1",
+		"applicationName": "gpsTracker",
+		"deviceProfileId": "a4d3f0b2-1c2d-4e5f-8a9b-0c1d2e3f4a5b",
+		"deviceProfileName": "irnas-profile",
+		"deviceName": "irnas1",
+		"devEui": "7076050000000001",
+		"tags": { "type": "irnas", "species": "rhino" }
+	},
+	"devAddr": "01020304",
+	"adr": true,
+	"dr": 5,
+	"fCnt": 10,
+	"fPort": 1,
+	"confirmed": true,
+	"data": "AQ==",
+	"object": { "lat": -1.25, "lon": 36.85, "hdop": 1.2, "time": 1633168800 },
+	"rxInfo": [
+		{
+			"gatewayId": "0000000000000001",
+			"uplinkId": 17051,
+			"time": "2021-10-02T10:00:00.5Z",
+			"rssi": -80,
+			"snr": 5.5,
+			"channel": 2,
+			"location": { "latitude": -1.2, "longitude": 36.8, "altitude": 1650 },
+			"context": "AAAAAA==",
+			"metadata": { "region_config_id": "eu868", "region_common_name": "EU868" }
+		},
+		{
+			"gatewayId": "0000000000000002",
+			"uplinkId": 4660,
+			"rssi": -110,
+			"snr": -7.25,
+			"location": {}
+		}
+	],
+	"txInfo": {
+		"frequency": 868100000,
+		"modulation": { "lora": { "bandwidth": 125000, "spreadingFactor": 7, "codeRate": "CR_4_5" } }
+	}
+}`
+
+func TestDecode(t *testing.T) {
+	protobuf, err := hex.DecodeString(v3Protobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rxTime := time.Date(2021, 10, 2, 10, 0, 0, 500000000, time.UTC)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		gwNames     bool
+		gw2Location *Location
+		profile     string
+	}{
+		{name: "v3 JSON legacy", contentType: "application/json", body: []byte(v3LegacyJSON), gwNames: true, gw2Location: &Location{Latitude: -1.3, Longitude: 36.9, Altitude: 1500}},
+		{name: "v3 JSON", contentType: "application/json", body: []byte(v3JSON), profile: "irnas-profile"},
+		{name: "v3 JSON without a content type", body: []byte(v3JSON), profile: "irnas-profile"},
+		{name: "v3 JSON as text", contentType: "text/plain; charset=utf-8", body: []byte(v3JSON), profile: "irnas-profile"},
+		{name: "v3 Protobuf", contentType: "application/octet-stream", body: protobuf, profile: "irnas-profile"},
+		{name: "v3 Protobuf without a content type", body: protobuf, profile: "irnas-profile"},
+		{name: "v4 JSON", contentType: "application/json", body: []byte(v4JSON), gw2Location: &Location{}, profile: "irnas-profile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Decode(tt.contentType, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if expected := (lorawan.EUI64{0x70, 0x76, 0x05, 0, 0, 0, 0, 0x01}); data.DevEUI != expected {
+				t.Errorf("DevEUI got:%v expected:%v", data.DevEUI, expected)
+			}
+			if data.ApplicationID != "1" || data.ApplicationName != "gpsTracker" || data.DeviceName != "irnas1" {
+				t.Errorf("application and device got:%v %v %v", data.ApplicationID, data.ApplicationName, data.DeviceName)
+			}
+			if data.DeviceProfileName != tt.profile {
+				t.Errorf("DeviceProfileName got:%v expected:%v", data.DeviceProfileName, tt.profile)
+			}
+			if data.FCnt != 10 || data.FPort != 1 {
+				t.Errorf("FCnt got:%v FPort got:%v expected 10 and 1", data.FCnt, data.FPort)
+			}
+			if !data.ADR || data.TXInfo.Frequency != 868100000 || data.TXInfo.DR != 5 {
+				t.Errorf("ADR:%v TXInfo:%+v", data.ADR, data.TXInfo)
+			}
+			if len(data.Data) != 1 || data.Data[0] != 1 {
+				t.Errorf("Data got:%v", data.Data)
+			}
+			if data.Tags["type"] != "irnas" || data.Tags["species"] != "rhino" {
+				t.Errorf("Tags got:%v", data.Tags)
+			}
+			for name, expected := range map[string]float64{"lat": -1.25, "lon": 36.85, "hdop": 1.2, "time": 1633168800} {
+				if v, ok := data.Object[name].(float64); !ok || v != expected {
+					t.Errorf("Object %v got:%v expected:%v", name, data.Object[name], expected)
+				}
+			}
+
+			if len(data.RXInfo) != 2 {
+				t.Fatalf("RXInfo got:%v expected 2 gateways", len(data.RXInfo))
+			}
+			gw1, gw2 := data.RXInfo[0], data.RXInfo[1]
+			if gw1.GatewayID != (lorawan.EUI64{0, 0, 0, 0, 0, 0, 0, 1}) || gw2.GatewayID != (lorawan.EUI64{0, 0, 0, 0, 0, 0, 0, 2}) {
+				t.Errorf("gateway IDs got:%v %v", gw1.GatewayID, gw2.GatewayID)
+			}
+			if gw1.RSSI != -80 || gw1.LoRaSNR != 5.5 || gw2.RSSI != -110 || gw2.LoRaSNR != -7.25 {
+				t.Errorf("signal got gw1:%v %v gw2:%v %v", gw1.RSSI, gw1.LoRaSNR, gw2.RSSI, gw2.LoRaSNR)
+			}
+			if gw1.Time == nil || !gw1.Time.Equal(rxTime) {
+				t.Errorf("gw1 time got:%v expected:%v", gw1.Time, rxTime)
+			}
+			if gw2.Time != nil {
+				t.Errorf("gw2 time got:%v expected none", gw2.Time)
+			}
+			if gw1.Location == nil || *gw1.Location != (Location{Latitude: -1.2, Longitude: 36.8, Altitude: 1650}) {
+				t.Errorf("gw1 location got:%+v", gw1.Location)
+			}
+			if (gw2.Location == nil) != (tt.gw2Location == nil) || (gw2.Location != nil && *gw2.Location != *tt.gw2Location) {
+				t.Errorf("gw2 location got:%+v expected:%+v", gw2.Location, tt.gw2Location)
+			}
+			if tt.gwNames && (gw1.Name != "ridge" || gw2.Name != "valley") {
+				t.Errorf("gateway names got:%v %v", gw1.Name, gw2.Name)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		err         string
+	}{
+		{name: "unsupported content type", contentType: "application/x-www-form-urlencoded", body: v3JSON, err: "unsupported content type"},
+		{name: "invalid content type", contentType: "application/json; charset", body: v3JSON, err: "parsing content type"},
+		{name: "invalid json", contentType: "application/json", body: `{"devEUI":`, err: "unmarshaling request body"},
+		{name: "invalid protobuf", contentType: "application/protobuf", body: "\x0a\xff", err: "unmarshaling protobuf"},
+		{name: "invalid v3 EUI", contentType: "application/json", body: `{"devEUI":"cHYF","objectJSON":""}`, err: "invalid EUI length"},
+		{name: "invalid objectJSON", contentType: "application/json", body: `{"devEUI":"cHYFAAAAAAE=","objectJSON":"{"}`, err: "unmarshaling objectJSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.contentType, []byte(tt.body))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
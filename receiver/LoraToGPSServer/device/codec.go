@@ -0,0 +1,142 @@
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// LoadCodecs registers a decoder for each javascript codec file in a directory.
+// The decoder is registered under the file name without the .js extension
+// so it is selected by a device "type" tag or a device profile with the same name.
+// Each script must define a chirpstack style `function Decode(fPort, bytes, variables)`
+// which returns an object with the same fields as the Irnas codec - lat, lon, hdop, time etc.
+func (self *Manager) LoadCodecs(dir string, timeout time.Duration) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.js"))
+	if err != nil {
+		return errors.Wrapf(err, "listing codec dir:%v", dir)
+	}
+
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "reading codec file:%v", file)
+		}
+		program, err := goja.Compile(file, string(src), true)
+		if err != nil {
+			return errors.Wrapf(err, "compiling codec file:%v", file)
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), ".js")
+		self.decoders.Register(name, &Codec{
+			name:    name,
+			program: program,
+			timeout: timeout,
+			metrics: self.metrics,
+		})
+		log.Println("loaded codec:", name)
+	}
+	return nil
+}
+
+// Codec decodes the uplink data with a javascript codec.
+type Codec struct {
+	name    string
+	program *goja.Program
+	timeout time.Duration
+	metrics *Metrics
+}
+
+// Decode runs the codec script and maps the returned object to gps points.
+// The object is also set as the payload object as if decoded by chirpstack.
+func (c *Codec) Decode(data *DataUpPayload) ([]*Data, error) {
+	object, err := c.run(data)
+	if err != nil {
+		c.metrics.codecErrors.With(prometheus.Labels{"codec": c.name, "reason": errorReason(err)}).Inc()
+		return nil, errors.Wrapf(err, "running codec:%v", c.name)
+	}
+	data.Object = object
+
+	if object["lat"] != nil || object["latitude"] != nil || object["locations"] != nil {
+		points, err := parseObject(object)
+		if err != nil {
+			c.metrics.codecErrors.With(prometheus.Labels{"codec": c.name, "reason": "object"}).Inc()
+			return nil, errors.Wrapf(err, "parsing the object of codec:%v", c.name)
+		}
+		return points, nil
+	}
+
+	if os.Getenv("DEBUG") == "1" {
+		log.Printf("codec object without location, codec:%v fport:%v", c.name, data.FPort)
+	}
+	d := &Data{
+		Attr: map[string]string{},
+	}
+	if val, ok := object["battery"]; ok {
+		d.Attr["battery"] = fmt.Sprintf("%v", val)
+	}
+	return []*Data{d}, nil
+}
+
+func (c *Codec) run(data *DataUpPayload) (map[string]interface{}, error) {
+	// A runtime is not safe for concurrent use so
+	// create a new one for each uplink.
+	vm := goja.New()
+	timer := time.AfterFunc(c.timeout, func() {
+		vm.Interrupt("execution timeout")
+	})
+	defer timer.Stop()
+
+	if _, err := vm.RunProgram(c.program); err != nil {
+		return nil, err
+	}
+
+	decode, ok := goja.AssertFunction(vm.Get("Decode"))
+	if !ok {
+		return nil, errOutput("the script doesn't define a Decode function")
+	}
+
+	bytes := make([]interface{}, len(data.Data))
+	for i, b := range data.Data {
+		bytes[i] = int64(b)
+	}
+	variables := data.Variables
+	if variables == nil {
+		variables = map[string]string{}
+	}
+
+	res, err := decode(goja.Undefined(), vm.ToValue(data.FPort), vm.ToValue(bytes), vm.ToValue(variables))
+	if err != nil {
+		return nil, err
+	}
+
+	object, ok := res.Export().(map[string]interface{})
+	if !ok {
+		return nil, errOutput(fmt.Sprintf("the Decode function returned:%T instead of an object", res.Export()))
+	}
+	return object, nil
+}
+
+type errOutput string
+
+func (e errOutput) Error() string {
+	return string(e)
+}
+
+func errorReason(err error) string {
+	switch err.(type) {
+	case *goja.InterruptedError:
+		return "timeout"
+	case errOutput:
+		return "output"
+	}
+	return "exception"
+}
@@ -0,0 +1,132 @@
+package device
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var testCodecs = map[string]string{
+	"collar": `function Decode(fPort, bytes, variables) {
+		return {lat: -1.25, lon: 36.85, hdop: bytes[0] / 10, time: 1633168800, battery: variables.battery};
+	}`,
+	"collarLog": `function Decode(fPort, bytes, variables) {
+		return {locations: [{lat: -1.25, lon: 36.85, time: 1633168800}, {lat: -1.2501, lon: 36.8501, time: 1633169700}]};
+	}`,
+	"collarStatus": `function Decode(fPort, bytes, variables) {
+		return {battery: 3700};
+	}`,
+	"loop":      `function Decode(fPort, bytes, variables) { for (;;) {} }`,
+	"throw":     `function Decode(fPort, bytes, variables) { throw new Error("unknown port " + fPort); }`,
+	"number":    `function Decode(fPort, bytes, variables) { return 1; }`,
+	"noDecode":  `function decode(fPort, bytes, variables) { return {}; }`,
+	"badObject": `function Decode(fPort, bytes, variables) { return {lat: "north", lon: 36.85}; }`,
+}
+
+func loadTestCodecs(t *testing.T, m *Manager) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range testCodecs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".js"), []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not a codec file.
+	if err := ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("codecs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadCodecs(dir, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	m := newTestManager()
+	loadTestCodecs(t, m)
+
+	tests := []struct {
+		codec  string
+		points []Data
+	}{
+		{codec: "collar", points: []Data{{Lat: -1.25, Lon: 36.85, Hdop: 1.2, Time: 1633168800, Valid: true}}},
+		{codec: "collarLog", points: []Data{
+			{Lat: -1.25, Lon: 36.85, Time: 1633168800, Valid: true},
+			{Lat: -1.2501, Lon: 36.8501, Time: 1633169700, Valid: true},
+		}},
+		{codec: "collarStatus", points: []Data{{Attr: map[string]string{"battery": "3700"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			data := &DataUpPayload{FPort: 1, Data: []byte{12}, Variables: map[string]string{"battery": "3600"}}
+			points, err := m.decoders.decoders[tt.codec].Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != len(tt.points) {
+				t.Fatalf("points got:%v expected:%v", len(points), len(tt.points))
+			}
+			for i, e := range tt.points {
+				p := points[i]
+				if p.Lat != e.Lat || p.Lon != e.Lon || p.Hdop != e.Hdop || p.Time != e.Time || p.Valid != e.Valid {
+					t.Errorf("point:%v got:%+v expected:%+v", i, p, e)
+				}
+				checkAttrs(t, p, e.Attr)
+			}
+			// The object is set as if decoded by chirpstack.
+			if len(data.Object) == 0 {
+				t.Error("the payload object isn't set")
+			}
+		})
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	m := newTestManager()
+	loadTestCodecs(t, m)
+
+	tests := []struct {
+		codec  string
+		reason string
+		err    string
+	}{
+		{codec: "loop", reason: "timeout", err: "execution timeout"},
+		{codec: "throw", reason: "exception", err: "unknown port 1"},
+		{codec: "number", reason: "output", err: "returned:int64 instead of an object"},
+		{codec: "noDecode", reason: "output", err: "doesn't define a Decode function"},
+		{codec: "badObject", reason: "object", err: "parsing the object of codec:badObject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			counter := testMetrics.codecErrors.With(prometheus.Labels{"codec": tt.codec, "reason": tt.reason})
+			before := testutil.ToFloat64(counter)
+
+			start := time.Now()
+			_, err := m.decoders.decoders[tt.codec].Decode(&DataUpPayload{FPort: 1})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("the codec ran for:%v", d)
+			}
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("codec errors metric reason:%v got:%v expected:1", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestLoadCodecsCompileError(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.js"), []byte("function Decode(fPort, bytes {"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := newTestManager().LoadCodecs(dir, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "compiling codec file") {
+		t.Fatalf("error got:%v", err)
+	}
+}
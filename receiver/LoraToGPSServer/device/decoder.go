@@ -0,0 +1,123 @@
+package device
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Decoder parses the device data of an uplink into gps points.
+type Decoder interface {
+	Decode(data *DataUpPayload) ([]*Data, error)
+}
+
+// DecoderFunc is an adapter to allow the use of ordinary functions as decoders.
+type DecoderFunc func(data *DataUpPayload) ([]*Data, error)
+
+// Decode calls f(data).
+func (f DecoderFunc) Decode(data *DataUpPayload) ([]*Data, error) {
+	return f(data)
+}
+
+// NewRegistry creates a decoder registry with the built-in device types.
+func NewRegistry() *Registry {
+	r := &Registry{
+		decoders: make(map[string]Decoder),
+		fPorts:   make(map[uint8]string),
+	}
+	r.Register("rpi", DecoderFunc(func(data *DataUpPayload) ([]*Data, error) {
+		return Rpi(string(data.Data))
+	}))
+	r.Register("irnas", DecoderFunc(Irnas))
+	return r
+}
+
+// Registry selects the decoder for each uplink.
+// The selection order is: the "type" device tag,
+// a decoder with the same name as the device profile,
+// the longest matching DevEUI prefix and the FPort.
+type Registry struct {
+	mtx      sync.RWMutex
+	decoders map[string]Decoder
+	// prefixes is sorted by length so that the longest prefix matches first.
+	prefixes []devEUIPrefix
+	fPorts   map[uint8]string
+}
+
+type devEUIPrefix struct {
+	prefix  string
+	devType string
+}
+
+// Register adds or replaces the decoder for a device type.
+func (r *Registry) Register(devType string, d Decoder) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.decoders[devType] = d
+}
+
+// RegisterDevEUIPrefix selects the decoder of a device type
+// for the devices without a "type" tag and with a DevEUI starting with the hex prefix.
+func (r *Registry) RegisterDevEUIPrefix(prefix, devType string) error {
+	prefix = strings.ToLower(prefix)
+	for _, c := range prefix {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return fmt.Errorf("invalid hex DevEUI prefix:%v", prefix)
+		}
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.decoders[devType]; !ok {
+		return fmt.Errorf("unsuported device type:%v", devType)
+	}
+	r.prefixes = append(r.prefixes, devEUIPrefix{prefix: prefix, devType: devType})
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+	})
+	return nil
+}
+
+// RegisterFPort selects the decoder of a device type
+// for the uplinks without a "type" tag or a matching DevEUI prefix.
+func (r *Registry) RegisterFPort(fPort uint8, devType string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.decoders[devType]; !ok {
+		return fmt.Errorf("unsuported device type:%v", devType)
+	}
+	r.fPorts[fPort] = devType
+	return nil
+}
+
+// Select returns the device type and its decoder for an uplink.
+func (r *Registry) Select(data *DataUpPayload) (string, Decoder, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	if devType, ok := data.Tags["type"]; ok {
+		d, ok := r.decoders[devType]
+		if !ok {
+			return "", nil, fmt.Errorf("unsuported device type:%v", devType)
+		}
+		return devType, d, nil
+	}
+
+	if d, ok := r.decoders[data.DeviceProfileName]; ok {
+		return data.DeviceProfileName, d, nil
+	}
+
+	devEUI := data.DevEUI.String()
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(devEUI, p.prefix) {
+			return p.devType, r.decoders[p.devType], nil
+		}
+	}
+
+	if devType, ok := r.fPorts[data.FPort]; ok {
+		return devType, r.decoders[devType], nil
+	}
+
+	return "", nil, fmt.Errorf("request payload doesn't include device type tags:%+v and no decoder matches devEUI:%v fPort:%v", data.Tags, devEUI, data.FPort)
+}
@@ -0,0 +1,103 @@
+package device
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+func testRegistry(t *testing.T) *Registry {
+	t.Helper()
+	r := NewRegistry()
+	none := DecoderFunc(func(data *DataUpPayload) ([]*Data, error) { return nil, nil })
+	r.Register("collar", none)
+	r.Register("collarV2", none)
+	r.Register("collar-profile", none)
+
+	for prefix, devType := range map[string]string{"7076": "irnas", "707605": "collarV2", "70B3": "collar"} {
+		if err := r.RegisterDevEUIPrefix(prefix, devType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.RegisterFPort(11, "irnas"); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func eui(t *testing.T, s string) lorawan.EUI64 {
+	t.Helper()
+	var e lorawan.EUI64
+	if err := e.UnmarshalText([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRegistrySelect(t *testing.T) {
+	r := testRegistry(t)
+
+	tests := []struct {
+		name    string
+		tags    map[string]string
+		profile string
+		devEUI  string
+		fPort   uint8
+		devType string
+		err     string
+	}{
+		{name: "type tag first", tags: map[string]string{"type": "rpi"}, profile: "collar-profile", devEUI: "7076050000000001", fPort: 11, devType: "rpi"},
+		{name: "unknown type tag doesn't fall back", tags: map[string]string{"type": "gps"}, profile: "collar-profile", devEUI: "7076050000000001", fPort: 11, err: "unsuported device type:gps"},
+		{name: "device profile before the prefix", tags: map[string]string{"species": "rhino"}, profile: "collar-profile", devEUI: "7076050000000001", fPort: 11, devType: "collar-profile"},
+		{name: "device profile without a decoder", profile: "rhino-profile", devEUI: "7076990000000001", fPort: 11, devType: "irnas"},
+		{name: "longest prefix", devEUI: "7076050000000001", fPort: 11, devType: "collarV2"},
+		{name: "shorter prefix", devEUI: "7076990000000001", fPort: 11, devType: "irnas"},
+		{name: "upper case prefix", devEUI: "70b3d57ed0041234", devType: "collar"},
+		{name: "fPort without a prefix", devEUI: "0004a30b001c0530", fPort: 11, devType: "irnas"},
+		{name: "nothing matches", devEUI: "0004a30b001c0530", fPort: 1, err: "no decoder matches devEUI:0004a30b001c0530 fPort:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devType, d, err := r.Select(&DataUpPayload{
+				Tags:              tt.tags,
+				DeviceProfileName: tt.profile,
+				DevEUI:            eui(t, tt.devEUI),
+				FPort:             tt.fPort,
+			})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error got:%v expected:%v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if devType != tt.devType || d == nil {
+				t.Errorf("type got:%v expected:%v decoder:%v", devType, tt.devType, d)
+			}
+		})
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	r := NewRegistry()
+	tests := []struct {
+		name     string
+		register func() error
+		err      string
+	}{
+		{name: "invalid prefix", register: func() error { return r.RegisterDevEUIPrefix("70x6", "irnas") }, err: "invalid hex DevEUI prefix:70x6"},
+		{name: "prefix of an unknown type", register: func() error { return r.RegisterDevEUIPrefix("7076", "collar") }, err: "unsuported device type:collar"},
+		{name: "fPort of an unknown type", register: func() error { return r.RegisterFPort(11, "collar") }, err: "unsuported device type:collar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.register()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
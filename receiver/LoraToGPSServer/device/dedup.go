@@ -0,0 +1,124 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// Dedup records the uplinks so that duplicates
+// received through several gateways or integrations are detected.
+type Dedup interface {
+	// Seen records the uplink and reports if it was already recorded within the ttl.
+	Seen(data *DataUpPayload) (bool, error)
+	// Forget removes the uplink so that a retry isn't a duplicate.
+	Forget(data *DataUpPayload) error
+}
+
+// dedupKey identifies an uplink by the DevEUI so that the same uplink
+// received through integrations with different device names is a duplicate.
+// Some sources like TTN webhooks can leave the DevEUI empty
+// and only then the uplink is identified by the device ID.
+func dedupKey(data *DataUpPayload) string {
+	if data.DevEUI == (lorawan.EUI64{}) {
+		return fmt.Sprintf("%v:%v:%v", GenID(data), data.FCnt, data.FPort)
+	}
+	return fmt.Sprintf("%v:%v:%v", data.DevEUI, data.FCnt, data.FPort)
+}
+
+// NewMemoryDedup creates an in memory uplink de-duplication cache.
+func NewMemoryDedup(ttl time.Duration) *MemoryDedup {
+	return &MemoryDedup{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// MemoryDedup is an in memory uplink de-duplication cache.
+type MemoryDedup struct {
+	ttl       time.Duration
+	mtx       sync.Mutex
+	entries   map[string]time.Time
+	lastSweep time.Time
+}
+
+// Seen implements the Dedup interface.
+func (d *MemoryDedup) Seen(data *DataUpPayload) (bool, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	now := time.Now()
+
+	// Remove the expired entries at most once per ttl
+	// to keep the cache small without scanning it on every uplink.
+	if now.Sub(d.lastSweep) > d.ttl {
+		for k, expire := range d.entries {
+			if now.After(expire) {
+				delete(d.entries, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	key := dedupKey(data)
+	if expire, ok := d.entries[key]; ok && now.Before(expire) {
+		return true, nil
+	}
+	d.entries[key] = now.Add(d.ttl)
+	return false, nil
+}
+
+// Forget implements the Dedup interface.
+func (d *MemoryDedup) Forget(data *DataUpPayload) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.entries, dedupKey(data))
+	return nil
+}
+
+// NewRedisDedup creates an uplink de-duplication cache stored in redis
+// so that it is shared between restarts and multiple receivers.
+func NewRedisDedup(url string, ttl time.Duration) (*RedisDedup, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing the redis url:%v", url)
+	}
+	return &RedisDedup{
+		client: redis.NewClient(opts),
+		ttl:    ttl,
+	}, nil
+}
+
+// RedisDedup is an uplink de-duplication cache stored in redis.
+type RedisDedup struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// Seen implements the Dedup interface.
+func (d *RedisDedup) Seen(data *DataUpPayload) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	set, err := d.client.SetNX(ctx, "lora-gps-server:dedup:"+dedupKey(data), 1, d.ttl).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "setting the redis dedup key")
+	}
+	return !set, nil
+}
+
+// Forget implements the Dedup interface.
+func (d *RedisDedup) Forget(data *DataUpPayload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := d.client.Del(ctx, "lora-gps-server:dedup:"+dedupKey(data)).Err(); err != nil {
+		return errors.Wrap(err, "deleting the redis dedup key")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package device
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestMemoryDedup(t *testing.T) {
+	ttl := 100 * time.Millisecond
+	testDedup(t, NewMemoryDedup(ttl), ttl, "")
+}
+
+// TestRedisDedup runs against the redis server set in DEDUP_REDIS,
+// for example DEDUP_REDIS=redis://localhost:6379 go test ./device
+func TestRedisDedup(t *testing.T) {
+	url := os.Getenv("DEDUP_REDIS")
+	if url == "" {
+		t.Skip("DEDUP_REDIS isn't set")
+	}
+	ttl := 200 * time.Millisecond
+	d, err := NewRedisDedup(url, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The keys are unique for every run because the redis server keeps them between runs.
+	testDedup(t, d, ttl, strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+func testDedup(t *testing.T, d Dedup, ttl time.Duration, prefix string) {
+	uplink := func(name string, eui lorawan.EUI64, fCnt uint32, fPort uint8) *DataUpPayload {
+		return &DataUpPayload{DeviceName: prefix + name, DevEUI: eui, FCnt: fCnt, FPort: fPort}
+	}
+	seen := func(data *DataUpPayload, expected bool) {
+		t.Helper()
+		duplicate, err := d.Seen(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if duplicate != expected {
+			t.Errorf("uplink:%v duplicate got:%v expected:%v", dedupKey(data), duplicate, expected)
+		}
+	}
+
+	collar1 := devEUI(prefix + "collar1")
+	collar2 := devEUI(prefix + "collar2")
+
+	t.Run("duplicate", func(t *testing.T) {
+		seen(uplink("collar1", collar1, 1, 1), false)
+		seen(uplink("collar1", collar1, 1, 1), true)
+	})
+	t.Run("next frame", func(t *testing.T) {
+		seen(uplink("collar1", collar1, 2, 1), false)
+	})
+	t.Run("other port", func(t *testing.T) {
+		seen(uplink("collar1", collar1, 1, 2), false)
+	})
+	t.Run("devices sharing a frame counter", func(t *testing.T) {
+		seen(uplink("collar2", collar2, 1, 1), false)
+	})
+	t.Run("device with another name in another integration", func(t *testing.T) {
+		seen(uplink("ttn-collar1", collar1, 1, 1), true)
+	})
+	t.Run("without a DevEUI", func(t *testing.T) {
+		seen(uplink("tracker1", lorawan.EUI64{}, 1, 1), false)
+		seen(uplink("tracker1", lorawan.EUI64{}, 1, 1), true)
+		seen(uplink("tracker2", lorawan.EUI64{}, 1, 1), false)
+	})
+	t.Run("forget", func(t *testing.T) {
+		if err := d.Forget(uplink("collar1", collar1, 1, 1)); err != nil {
+			t.Fatal(err)
+		}
+		seen(uplink("collar1", collar1, 1, 1), false)
+		seen(uplink("collar1", collar1, 1, 1), true)
+		// The other uplinks are still recorded.
+		seen(uplink("collar2", collar2, 1, 1), true)
+	})
+	t.Run("forget an unknown uplink", func(t *testing.T) {
+		if err := d.Forget(uplink("collar3", devEUI(prefix+"collar3"), 1, 1)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("ttl expiry", func(t *testing.T) {
+		seen(uplink("collar1", collar1, 3, 1), false)
+		time.Sleep(ttl + 50*time.Millisecond)
+		seen(uplink("collar1", collar1, 3, 1), false)
+		seen(uplink("collar1", collar1, 3, 1), true)
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
 	"github.com/brocaar/lorawan"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -33,25 +34,85 @@ type Data struct {
 	Time    int64 // The gps fix time in epoch timestamp.
 	Motion  bool
 	Hdop    float64
+	// Duplicate is set when the same uplink was already parsed.
+	Duplicate bool
+	// Rejected is the reason when the point was marked invalid by the filters.
+	Rejected string
+	// Bearing in degrees and Distance in meters from the previous fix in the device history.
+	// Speed is also from the previous fix unless reported by the device.
+	Bearing  float64
+	Distance float64
+	// SpeedReported is set by the decoders when the device reports the speed
+	// so that a reported speed of 0 isn't replaced by the speed from the previous fix.
+	SpeedReported bool
 }
 
-func NewManager() *Manager {
-	mn := &Manager{
-		metrics:   NewMetrics(),
-		allDevIDs: make(map[string]*Data),
+// setAttr sets an attribute and creates the attributes when missing.
+func (d *Data) setAttr(name, value string) {
+	if d.Attr == nil {
+		d.Attr = make(map[string]string)
+	}
+	d.Attr[name] = value
+}
+
+// addAlarm appends an alarm to the comma separated alarms of the point.
+func (d *Data) addAlarm(alarm string) {
+	if v := d.Attr[AttrAlarm]; v != "" {
+		alarm = v + "," + alarm
 	}
+	d.setAttr(AttrAlarm, alarm)
+}
+
+func NewManager() *Manager {
+	mn := newManager(NewMetrics())
 	mn.incLastUpdateTime()
+	mn.sweepEncounters()
 	return mn
 }
 
+// newManager creates a manager without the background updates
+// and with the given metrics as these can be registered only once.
+func newManager(metrics *Metrics) *Manager {
+	return &Manager{
+		metrics:   metrics,
+		decoders:  NewRegistry(),
+		dedup:     NewMemoryDedup(time.Minute),
+		allDevIDs: make(map[string]*Data),
+
+		historySize: DefaultHistorySize,
+		tracks:      make(map[string]*track),
+
+		fenceStates:      make(map[string]*fenceState),
+		stationaryStates: make(map[string]*stationaryState),
+		encounterStates:  make(map[string]*encounterState),
+	}
+}
+
 type Manager struct {
-	lastFCnt uint32
 	metrics  *Metrics
+	decoders *Registry
+	dedup    Dedup
+	// recorder is nil when the fixes aren't stored.
+	recorder Recorder
 
 	mtx sync.Mutex
 
 	// allDevIDs holds the last data update for all devices.
 	allDevIDs map[string]*Data
+
+	historySize int
+	tracks      map[string]*track
+
+	geofences   []*Geofence
+	fenceStates map[string]*fenceState
+
+	stationary       map[string]config.Stationary
+	stationaryStates map[string]*stationaryState
+
+	encounters      []*encounterRule
+	encounterStates map[string]*encounterState
+	// filters is nil when the points aren't filtered.
+	filters *filters
 }
 
 func (self *Manager) Parse(r *http.Request) ([]*Data, error) {
@@ -64,48 +125,67 @@ func (self *Manager) Parse(r *http.Request) ([]*Data, error) {
 		log.Printf("incoming request body:%v RemoteAddr:%v headers:%+v \n", string(c), r.RemoteAddr, r.Header)
 	}
 
-	data := &DataUpPayload{}
-	err = json.Unmarshal(c, data)
-	if err != nil {
-		return nil, errors.Wrap(err, "unmarshaling request body")
-	}
+	return self.ParseUplink(r.Header.Get("Content-Type"), c)
+}
 
-	devType, ok := data.Tags["type"]
-	if !ok {
-		return nil, fmt.Errorf("request payload doesn't include device type tags:%+v", data.Tags)
+// ParseUplink parses the body of a chirpstack uplink event
+// as received from the HTTP or the MQTT integration.
+func (self *Manager) ParseUplink(contentType string, c []byte) ([]*Data, error) {
+	data, err := Decode(contentType, c)
+	if err != nil {
+		return nil, err
 	}
 
-	var points []*Data
+	return self.ParsePayload(data)
+}
 
-	switch devType {
-	case "rpi":
-		points, err = Rpi(string(data.Data))
-	case "irnas":
-		points, err = Irnas(data)
-	default:
-		return nil, fmt.Errorf("unsuported device type:%v", devType)
+// ParsePayload parses the device data of an already decoded uplink
+// and updates the device metrics.
+func (self *Manager) ParsePayload(data *DataUpPayload) ([]*Data, error) {
+	devType, decoder, err := self.decoders.Select(data)
+	if err != nil {
+		return nil, err
 	}
+
+	points, err := decoder.Decode(data)
 	if err != nil {
 		return nil, errors.Wrapf(err, "parsing device data type:%v", devType)
 	}
 
+	// A duplicate request happens because the lora server is set to send
+	// the same request for each backend server - traccar, smart connect etc.
+	// or when the same uplink is received through several gateways or integrations.
+	duplicate, err := self.dedup.Seen(data)
+	if err != nil {
+		log.Printf("[error] checking for a duplicate uplink err:%v", err)
+	}
+	if duplicate {
+		self.metrics.duplicates.With(prometheus.Labels{"dev_id": GenID(data)}).Inc()
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("duplicate uplink devEUI:%v fCnt:%v fPort:%v", data.DevEUI, data.FCnt, data.FPort)
+		}
+	}
+
 	for i, point := range points {
 		point.Payload = data
 		point.Type = devType
 		point.ID = GenID(data)
-
-		// Update the metrics only for non duplicate requests.
-		// A duplicate request happens because the lora server is set to send
-		// the same request for each backend server - traccar, smart connect etc.
-		if self.lastFCnt != data.FCnt {
+		point.Duplicate = duplicate
+
+		// Filter, update the metrics and the history only for non duplicate requests.
+		// The duplicates get the filter verdict and the values of the original point from the history.
+		if !duplicate {
+			if reason := self.filter(point); reason != "" {
+				point.Valid = false
+				point.Rejected = reason
+			}
 			if err := self.update(point); err != nil {
 				return nil, err
 			}
-		}
-		self.lastFCnt = data.FCnt
-
-		if point.Motion {
-			point.Speed = self.Speed(point.ID)
+		} else {
+			self.mtx.Lock()
+			self.fromHistory(point)
+			self.mtx.Unlock()
 		}
 
 		if len(data.RXInfo) == 0 {
@@ -128,8 +208,66 @@ func (self *Manager) Parse(r *http.Request) ([]*Data, error) {
 		points[i] = point
 	}
 
-	return points, err
+	// The fixes are recorded here so that these are stored
+	// whichever endpoint or integration received the uplink.
+	if !duplicate && self.recorder != nil {
+		if err := self.recorder.Record(points); err != nil {
+			log.Printf("[error] recording the fixes devID:%v err:%v", GenID(data), err)
+		}
+	}
+
+	return points, nil
+
+}
+
+func (self *Manager) filter(data *Data) string {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if self.filters == nil {
+		return ""
+	}
+	t := self.track(data.ID)
+	// The uplink is retried after a failed delivery so the point is already checked.
+	if reason, ok := t.verdict(data); ok {
+		return reason
+	}
+	reason := self.filters.check(data, t, time.Now())
+	if reason != "" {
+		t.reject(data, reason, self.historySize)
+	}
+	return reason
+}
+
+// SetDedup replaces the default in memory uplink de-duplication cache.
+func (self *Manager) SetDedup(d Dedup) {
+	self.dedup = d
+}
+
+// Recorder stores the fixes of the parsed uplinks.
+type Recorder interface {
+	// Record stores the valid points and skips the others.
+	Record(points []*Data) error
+}
+
+// SetRecorder sets where the fixes of all non duplicate uplinks are stored.
+func (self *Manager) SetRecorder(r Recorder) {
+	self.recorder = r
+}
+
+// Forget removes the uplink of the points from the de-duplication cache
+// when these were rejected so that the retried uplink isn't dropped as a duplicate.
+func (self *Manager) Forget(points []*Data) {
+	if len(points) == 0 || points[0].Duplicate {
+		return
+	}
+	if err := self.dedup.Forget(points[0].Payload); err != nil {
+		log.Printf("[error] removing the uplink from the de-duplication cache err:%v", err)
+	}
+}
 
+// Decoders returns the registry used to select the decoder for each uplink.
+func (self *Manager) Decoders() *Registry {
+	return self.decoders
 }
 
 func (self *Manager) update(data *Data) error {
@@ -143,7 +281,7 @@ func (self *Manager) update(data *Data) error {
 	} else {
 		// Distance from each gateway that received this data.
 		for _, gwMeta := range data.Payload.RXInfo {
-			if data.Valid {
+			if data.Valid && gwMeta.Location != nil {
 				dist, err := Distance(data.Lat, data.Lon, gwMeta.Location.Latitude, gwMeta.Location.Longitude, "K")
 				if err != nil {
 					return err
@@ -156,24 +294,16 @@ func (self *Manager) update(data *Data) error {
 		}
 	}
 
-	if lastUpdate, ok := self.allDevIDs[data.ID]; ok && lastUpdate.Valid && data.Valid {
-		speed, err := Speed(lastUpdate, data)
-		if err != nil {
-			return err
-		}
-		data.Speed = speed
-	}
+	self.checkGeofences(data)
+	self.checkStationary(data)
+	self.checkEncounters(data)
+
+	self.addHistory(data)
 	self.allDevIDs[data.ID] = data
 
 	return nil
 }
 
-func (s *Manager) Speed(devID string) float64 {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
-	return s.allDevIDs[devID].Speed
-}
-
 // incLastUpdateTime increases the update time to detect when a device has lost a signal.
 func (s *Manager) incLastUpdateTime() {
 	go func() {
@@ -188,7 +318,12 @@ func (s *Manager) incLastUpdateTime() {
 	}()
 }
 
+// Rpi parses the data of the Rpi GPSSender in the binary or the legacy "lat,lon[,s]" format.
 func Rpi(data string) ([]*Data, error) {
+	if len(data) > 0 && data[0] == RpiVersion1 {
+		return rpiBinary([]byte(data))
+	}
+
 	coordinates := strings.Split(string(data), ",")
 	if len(coordinates) < 2 {
 		return nil, fmt.Errorf("parsing the cordinates string:%v", data)
@@ -230,7 +365,27 @@ func Rpi(data string) ([]*Data, error) {
 
 type dataInterface map[string]interface{}
 
+// Irnas parses the Irnas/SmartParks tracker uplinks.
+// The binary FRMPayload is decoded natively and
+// the chirpstack codec object is used only as a fallback.
 func Irnas(data *DataUpPayload) ([]*Data, error) {
+	switch data.FPort {
+	case irnasPortGPS, irnasPortStatus, irnasPortLocations, irnasPortStatusGPS:
+		if len(data.Data) == 0 {
+			break
+		}
+		points, err := irnasDecode(data.FPort, data.Data)
+		if err == nil {
+			return points, nil
+		}
+		if len(data.Object) == 0 {
+			return nil, errors.Wrap(err, "decoding the binary payload")
+		}
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("decoding the binary payload err:%v so using the codec object", err)
+		}
+	}
+
 	dataParsed := &Data{
 		Valid: true,
 		Attr:  map[string]string{},
@@ -245,17 +400,37 @@ func Irnas(data *DataUpPayload) ([]*Data, error) {
 		return []*Data{dataParsed}, nil
 	}
 
-	logRaw, ok := data.Object["locations"]
-	if !ok {
-		d, err := irnasParseSingle(data.Object)
+	return parseObject(data.Object)
+}
+
+// parseObject maps a codec object to gps points.
+// The object contains a single location or a "locations" log
+// as a list or as a json string.
+func parseObject(object dataInterface) ([]*Data, error) {
+	logRaw, ok := object["locations"]
+	if !ok || logRaw == nil {
+		d, err := irnasParseSingle(object)
 		return []*Data{d}, err
 	}
 
-	logs := make([]dataInterface, 5)
+	var logs []dataInterface
 
-	err := json.Unmarshal([]byte(logRaw.(string)), &logs)
-	if err != nil {
-		return nil, errors.Wrap(err, "parsing locations json")
+	switch val := logRaw.(type) {
+	case string:
+		err := json.Unmarshal([]byte(val), &logs)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing locations json")
+		}
+	case []interface{}:
+		for _, l := range val {
+			m, ok := l.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unexpected location type:%T", l)
+			}
+			logs = append(logs, m)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected locations type:%T", logRaw)
 	}
 
 	var logsParsed []*Data
@@ -292,51 +467,92 @@ func irnasParseSingle(data dataInterface) (*Data, error) {
 		}
 	}
 
+	var err error
+
 	// Port 12 status messages contain only lat/lon.
 	hdop, ok := data["hdop"]
 	if !ok {
 		log.Printf("data object doesn't contain hdop so setting to 0")
 		hdop = 0.0
 	}
-	dataParsed.Hdop = hdop.(float64)
+	if dataParsed.Hdop, err = toFloat(hdop); err != nil {
+		return nil, errors.Wrap(err, "hdop")
+	}
 
-	dataParsed.Lat = lat.(float64)
-	dataParsed.Lon = lon.(float64)
+	if dataParsed.Lat, err = toFloat(lat); err != nil {
+		return nil, errors.Wrap(err, "lat")
+	}
+	if dataParsed.Lon, err = toFloat(lon); err != nil {
+		return nil, errors.Wrap(err, "lon")
+	}
 	if dataParsed.Lat == 0.0 || dataParsed.Lon == 0.0 {
 		dataParsed.Valid = false
 	}
-	if val, ok := data["gps_time"]; ok { // From system updates.
-		dataParsed.Time = int64(val.(float64))
-	}
-	if val, ok := data["time"]; ok { // From periodic or motion triggered updates.
-		dataParsed.Time = int64(val.(float64))
+	for _, name := range []string{
+		"gps_time", // From system updates.
+		"time",     // From periodic or motion triggered updates.
+	} {
+		if val, ok := data[name]; ok {
+			t, err := toFloat(val)
+			if err != nil {
+				return nil, errors.Wrap(err, name)
+			}
+			dataParsed.Time = int64(t)
+		}
 	}
 
 	if val, ok := data["battery"]; ok {
-		dataParsed.Attr["battery"] = fmt.Sprintf("%v", val.(float64))
+		dataParsed.Attr["battery"] = fmt.Sprintf("%v", val)
 	}
-	if val, ok := data["motion"]; ok && int64(val.(float64)) > 0 {
-		dataParsed.Motion = true
+	if val, ok := data["motion"]; ok {
+		motion, err := toFloat(val)
+		if err != nil {
+			return nil, errors.Wrap(err, "motion")
+		}
+		dataParsed.Motion = motion > 0
 	}
 
 	return dataParsed, nil
 }
 
+// toFloat converts the numbers of a codec object
+// which are float64 when decoded from json and
+// can also be integers when returned by a codec script.
+func toFloat(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	}
+	return 0, fmt.Errorf("unexpected number type:%T", val)
+}
+
 // DataUpPayload represents a data-up payload.
+// All supported uplink formats are mapped to this
+// which matches the chirpstack v3 "JSON legacy" marshaler.
 type DataUpPayload struct {
-	ApplicationID   int64                  `json:"applicationID,string"`
-	ApplicationName string                 `json:"applicationName"`
-	DeviceName      string                 `json:"deviceName"`
-	DevEUI          lorawan.EUI64          `json:"devEUI"`
-	RXInfo          []RXInfo               `json:"rxInfo,omitempty"`
-	TXInfo          TXInfo                 `json:"txInfo"`
-	ADR             bool                   `json:"adr"`
-	FCnt            uint32                 `json:"fCnt"`
-	FPort           uint8                  `json:"fPort"`
-	Data            []byte                 `json:"data"`
-	Object          map[string]interface{} `json:"object,omitempty"`
-	Tags            map[string]string      `json:"tags,omitempty"`
-	Variables       map[string]string      `json:"-"`
+	ApplicationID   string `json:"applicationID"`
+	ApplicationName string `json:"applicationName"`
+	DeviceName      string `json:"deviceName"`
+	// DeviceProfileName is missing in the v3 "JSON legacy" marshaler.
+	DeviceProfileName string                 `json:"deviceProfileName,omitempty"`
+	DevEUI            lorawan.EUI64          `json:"devEUI"`
+	RXInfo            []RXInfo               `json:"rxInfo,omitempty"`
+	TXInfo            TXInfo                 `json:"txInfo"`
+	ADR               bool                   `json:"adr"`
+	FCnt              uint32                 `json:"fCnt"`
+	FPort             uint8                  `json:"fPort"`
+	Data              []byte                 `json:"data"`
+	Object            map[string]interface{} `json:"object,omitempty"`
+	Tags              map[string]string      `json:"tags,omitempty"`
+	Variables         map[string]string      `json:"-"`
 }
 
 // RXInfo contains the RX information.
@@ -392,15 +608,96 @@ func NewMetrics() *Metrics {
 			},
 			[]string{"gateway_id", "dev_id"},
 		),
+		duplicates: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "duplicate_uplinks_total",
+				Help: "The total number of duplicate uplinks dropped from the device metrics and tracking.",
+			},
+			[]string{"dev_id"},
+		),
+		codecErrors: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "codec_errors_total",
+				Help: "The total number of javascript codec errors by reason - timeout, exception, output or object.",
+			},
+			[]string{"codec", "reason"},
+		),
+		filtered: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "filtered_points_total",
+				Help: "The total number of points rejected by the filters by reason.",
+			},
+			[]string{"dev_id", "reason"},
+		),
+		stationary: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "stationary",
+				Help: "1 while the mortality alarm of the device is active and 0 after it moves.",
+			},
+			[]string{"dev_id"},
+		),
+		mortalityAlarms: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "mortality_alarms_total",
+				Help: "The total number of mortality alarms raised when a device stays in one place.",
+			},
+			[]string{"dev_id"},
+		),
+		encounterActive: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "encounter_active",
+				Help: "1 while the two devices are within the encounter rule distance and 0 after the encounter ends.",
+			},
+			[]string{"rule", "dev_a", "dev_b"},
+		),
+		encounters: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "encounters_total",
+				Help: "The total number of started encounters for each rule.",
+			},
+			[]string{"rule"},
+		),
+		encounterDuration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "encounter_duration_seconds",
+				Help:    "The duration of the ended encounters for each rule.",
+				Buckets: []float64{0, 600, 1800, 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600},
+			},
+			[]string{"rule"},
+		),
+		geofenceInside: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "geofence_inside",
+				Help: "1 when the last point of the device is inside the geofence and 0 when outside.",
+			},
+			[]string{"dev_id", "geofence"},
+		),
+		geofenceEvents: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "geofence_events_total",
+				Help: "The total number of geofence enter and exit events.",
+			},
+			[]string{"dev_id", "geofence", "event"},
+		),
 	}
 	return m
 }
 
 type Metrics struct {
-	distanceMeters *prometheus.GaugeVec
-	lastUpdate     *prometheus.GaugeVec
-	rssi           *prometheus.GaugeVec
-	snr            *prometheus.GaugeVec
+	distanceMeters    *prometheus.GaugeVec
+	lastUpdate        *prometheus.GaugeVec
+	rssi              *prometheus.GaugeVec
+	snr               *prometheus.GaugeVec
+	codecErrors       *prometheus.CounterVec
+	duplicates        *prometheus.CounterVec
+	filtered          *prometheus.CounterVec
+	stationary        *prometheus.GaugeVec
+	mortalityAlarms   *prometheus.CounterVec
+	encounterActive   *prometheus.GaugeVec
+	encounters        *prometheus.CounterVec
+	encounterDuration *prometheus.HistogramVec
+	geofenceInside    *prometheus.GaugeVec
+	geofenceEvents    *prometheus.CounterVec
 }
 
 func Distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64, unit ...string) (float64, error) {
@@ -433,28 +730,6 @@ func Distance(lat1 float64, lon1 float64, lat2 float64, lon2 float64, unit ...st
 	return 0, fmt.Errorf("invalid metric unit:%v", unit)
 }
 
-// Speed calculates speed in knots from the distance between 2 gps points.
-func Speed(point1 *Data, point2 *Data) (float64, error) {
-	km, err := Distance(point1.Lat, point1.Lon, point2.Lat, point2.Lon, "K")
-	if err != nil {
-		return 0, err
-	}
-	if km == 0.0 {
-		return 0.0, nil
-	}
-
-	// Use Abs in case of an out of order updates.
-	// For the distance calculation it doesn't matter,
-	// but for the time diff we don't want negative numbers.
-	timeDiff := math.Abs(float64(point2.Time - point1.Time))
-
-	hr := timeDiff / 3600.0
-	kmh := km / hr
-	knots := kmh / 1.8520001412492
-
-	return knots, nil
-}
-
 func GenID(data *DataUpPayload) string {
 	return data.DeviceName + "-" + data.DevEUI.String()
 }
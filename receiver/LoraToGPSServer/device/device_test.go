@@ -0,0 +1,108 @@
+package device
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+// testMetrics are shared by the test managers because the metrics can be registered only once.
+// The tests use different device names so that the metrics don't mix.
+var testMetrics = NewMetrics()
+
+func newTestManager() *Manager {
+	return newManager(testMetrics)
+}
+
+// t0 is the fix time of the tests which don't check the fix age.
+const t0 = 1633168800
+
+func point(lat, lon float64, t int64) *Data {
+	return &Data{Lat: lat, Lon: lon, Time: t, Valid: true, Attr: map[string]string{}}
+}
+
+// at returns a point at the given meters east and north of -1.25,36.85.
+func at(east, north float64, t int64) *Data {
+	const lat0, lon0 = -1.25, 36.85
+	return point(
+		lat0+north/6371008.8*180/math.Pi,
+		lon0+east/(6371008.8*math.Cos(lat0*math.Pi/180))*180/math.Pi,
+		t,
+	)
+}
+
+// devEUI derives the DevEUI from the device name.
+func devEUI(name string) lorawan.EUI64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	var eui lorawan.EUI64
+	copy(eui[:], h.Sum(nil))
+	return eui
+}
+
+func devID(name string) string {
+	return name + "-" + devEUI(name).String()
+}
+
+var fCnt uint32
+
+// parse sends the points through the manager as the points of a single uplink of a test device.
+func parse(t *testing.T, m *Manager, name, species string, points ...*Data) []*Data {
+	t.Helper()
+	fCnt++
+	return parseUplink(t, m, name, species, fCnt, points...)
+}
+
+// parseUplink is the same as parse with the uplink counter to send duplicates.
+func parseUplink(t *testing.T, m *Manager, name, species string, fCnt uint32, points ...*Data) []*Data {
+	t.Helper()
+	m.decoders.Register("test", DecoderFunc(func(data *DataUpPayload) ([]*Data, error) {
+		return points, nil
+	}))
+	data := &DataUpPayload{
+		ApplicationName: "gpsTracker",
+		DeviceName:      name,
+		DevEUI:          devEUI(name),
+		FCnt:            fCnt,
+		FPort:           1,
+		Tags:            map[string]string{"type": "test", "species": species},
+	}
+	parsed, err := m.ParsePayload(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func checkAttrs(t *testing.T, point *Data, expected map[string]string) {
+	t.Helper()
+	for name, v := range expected {
+		if point.Attr[name] != v {
+			t.Errorf("attr:%v got:%q expected:%q all:%v", name, point.Attr[name], v, point.Attr)
+		}
+	}
+}
+
+func checkNoAttrs(t *testing.T, point *Data, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if v, ok := point.Attr[name]; ok {
+			t.Errorf("unexpected attr:%v value:%q", name, v)
+		}
+	}
+}
+
+func approx(t *testing.T, name string, got, expected, tolerance float64) {
+	t.Helper()
+	if math.Abs(got-expected) > tolerance {
+		t.Errorf("%v got:%v expected:%v", name, got, expected)
+	}
+}
+
+func ExampleGenID() {
+	fmt.Println(GenID(&DataUpPayload{DeviceName: "rhino1", DevEUI: lorawan.EUI64{0x70, 0x76, 0x05, 0, 0, 0, 0, 0x01}}))
+	// Output: rhino1-7076050000000001
+}
@@ -0,0 +1,268 @@
+package device
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultEncounterMaxGap is the max time between the fixes of two devices when not set.
+const DefaultEncounterMaxGap = 30 * time.Minute
+
+// The encounter alarms.
+const (
+	AlarmEncounterStart = "encounterStart"
+	AlarmEncounterEnd   = "encounterEnd"
+)
+
+// The attributes set on the points which start or end an encounter
+// with a comma separated value for each encounter alarm.
+const (
+	// AttrEncounter is the ID of the other device.
+	AttrEncounter = "encounter"
+	// AttrEncounterDuration is the encounter duration in seconds.
+	AttrEncounterDuration = "encounterDuration"
+	// AttrEncounterDistance is the min distance in meters between the devices during the encounter.
+	AttrEncounterDistance = "encounterDistance"
+)
+
+// IsEventAttr reports if an attribute is only for the point which triggered an alarm
+// so that the sinks shouldn't carry it over to the next points.
+func IsEventAttr(name string) bool {
+	switch name {
+	case AttrAlarm, AttrGeofence, AttrEncounter, AttrEncounterDuration, AttrEncounterDistance:
+		return true
+	}
+	return false
+}
+
+// SetEncounters sets the encounter rules.
+func (self *Manager) SetEncounters(rules []config.Encounter) error {
+	names := make(map[string]struct{})
+	var encounters []*encounterRule
+	for i, r := range rules {
+		if r.Name == "" {
+			return errors.Errorf("encounter rule:%v without a name", i)
+		}
+		if _, ok := names[r.Name]; ok {
+			return errors.Errorf("duplicate encounter rule name:%v", r.Name)
+		}
+		names[r.Name] = struct{}{}
+		if r.Distance <= 0 {
+			return errors.Errorf("encounter rule:%v requires a distance", r.Name)
+		}
+		if r.MaxGap == 0 {
+			r.MaxGap = config.Duration(DefaultEncounterMaxGap)
+		}
+		e := &encounterRule{cfg: r, group: newDeviceGroup(r.Group)}
+		if r.Others != nil {
+			e.others = newDeviceGroup(*r.Others)
+		}
+		encounters = append(encounters, e)
+	}
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.encounters = encounters
+	return nil
+}
+
+type deviceGroup struct {
+	devices map[string]struct{}
+	species map[string]struct{}
+	types   map[string]struct{}
+}
+
+func newDeviceGroup(cfg config.DeviceGroup) *deviceGroup {
+	g := &deviceGroup{
+		devices: make(map[string]struct{}),
+		species: make(map[string]struct{}),
+		types:   make(map[string]struct{}),
+	}
+	for _, d := range cfg.Devices {
+		g.devices[strings.ToLower(d)] = struct{}{}
+	}
+	for _, s := range cfg.Species {
+		g.species[s] = struct{}{}
+	}
+	for _, t := range cfg.Types {
+		g.types[t] = struct{}{}
+	}
+	return g
+}
+
+func (g *deviceGroup) match(data *Data) bool {
+	if _, ok := g.types[data.Type]; ok {
+		return true
+	}
+	if data.Payload == nil {
+		return false
+	}
+	if _, ok := g.species[data.Payload.Tags["species"]]; ok {
+		return true
+	}
+	if _, ok := g.devices[strings.ToLower(data.Payload.DeviceName)]; ok {
+		return true
+	}
+	_, ok := g.devices[data.Payload.DevEUI.String()]
+	return ok
+}
+
+type encounterRule struct {
+	cfg    config.Encounter
+	group  *deviceGroup
+	others *deviceGroup
+}
+
+// pair checks if the rule applies to the two devices.
+func (e *encounterRule) pair(a, b *Data) bool {
+	if e.others == nil {
+		return e.group.match(a) && e.group.match(b)
+	}
+	return (e.group.match(a) && e.others.match(b)) || (e.group.match(b) && e.others.match(a))
+}
+
+// encounterSweepInterval is how often the encounters of the devices which stopped reporting are ended.
+const encounterSweepInterval = time.Minute
+
+// encounterState is an active encounter between two devices.
+type encounterState struct {
+	rule *encounterRule
+	// a and b are the device IDs in the order of the metric labels.
+	a, b        string
+	start       int64
+	last        int64
+	minDistance float64
+	// updated is the receive time of the last point which kept the encounter
+	// to end it when both devices stop reporting.
+	updated time.Time
+}
+
+// checkEncounters compares the point with the last fix of the other devices
+// and sets the encounter alarms when two devices come within or leave the rule distance.
+// An encounter also ends when the other device has no fix within the max gap.
+// Points older than the last fix of the device are skipped.
+// Expects the manager lock to be held.
+func (self *Manager) checkEncounters(data *Data) {
+	if len(self.encounters) == 0 || !data.Valid {
+		return
+	}
+	if t, ok := self.tracks[data.ID]; ok && len(t.fixes) > 0 && data.Time < t.fixes[len(t.fixes)-1].Time {
+		return
+	}
+
+	var others []string
+	for id := range self.allDevIDs {
+		if id != data.ID {
+			others = append(others, id)
+		}
+	}
+	sort.Strings(others)
+
+	for _, rule := range self.encounters {
+		for _, id := range others {
+			other := self.allDevIDs[id]
+			if !rule.pair(data, other) {
+				continue
+			}
+			a, b := orderedPair(data.ID, id)
+			key := rule.cfg.Name + "/" + a + "/" + b
+			state, active := self.encounterStates[key]
+
+			distance := -1.0
+			if t, ok := self.tracks[id]; ok && len(t.fixes) > 0 {
+				last := t.fixes[len(t.fixes)-1]
+				if abs(data.Time-last.Time) <= int64(time.Duration(rule.cfg.MaxGap).Seconds()) {
+					km, err := Distance(data.Lat, data.Lon, last.Lat, last.Lon, "K")
+					if err == nil {
+						distance = km * 1000
+					}
+				}
+			}
+
+			switch {
+			case distance >= 0 && distance <= rule.cfg.Distance:
+				if !active {
+					state = &encounterState{rule: rule, a: a, b: b, start: data.Time, last: data.Time, minDistance: distance}
+					self.encounterStates[key] = state
+					self.encounterEvent(data, rule, id, AlarmEncounterStart, state)
+				}
+				state.last = data.Time
+				state.updated = time.Now()
+				if distance < state.minDistance {
+					state.minDistance = distance
+				}
+			case active:
+				delete(self.encounterStates, key)
+				self.encounterEvent(data, rule, id, AlarmEncounterEnd, state)
+			}
+		}
+	}
+}
+
+// encounterEvent sets the alarm attributes and updates the metrics.
+func (self *Manager) encounterEvent(data *Data, rule *encounterRule, otherID, alarm string, state *encounterState) {
+	data.addAlarm(alarm)
+	appendAttr(data, AttrEncounter, otherID)
+	appendAttr(data, AttrEncounterDuration, strconv.FormatInt(state.last-state.start, 10))
+	appendAttr(data, AttrEncounterDistance, strconv.FormatFloat(state.minDistance, 'f', 0, 64))
+	if alarm == AlarmEncounterStart {
+		self.metrics.encounterActive.With(prometheus.Labels{"rule": rule.cfg.Name, "dev_a": state.a, "dev_b": state.b}).Set(1)
+		self.metrics.encounters.With(prometheus.Labels{"rule": rule.cfg.Name}).Inc()
+	} else {
+		self.endEncounterMetrics(state)
+	}
+	log.Printf("encounter event:%v rule:%v devID:%v other:%v duration:%vs min distance:%.0fm", alarm, rule.cfg.Name, data.ID, otherID, state.last-state.start, state.minDistance)
+}
+
+func (self *Manager) endEncounterMetrics(state *encounterState) {
+	self.metrics.encounterActive.With(prometheus.Labels{"rule": state.rule.cfg.Name, "dev_a": state.a, "dev_b": state.b}).Set(0)
+	self.metrics.encounterDuration.With(prometheus.Labels{"rule": state.rule.cfg.Name}).Observe(float64(state.last - state.start))
+}
+
+// sweepEncounters ends the encounters without any point from both devices for longer than the max gap.
+// These have no point for the alarm attributes so only the metrics are updated.
+func (self *Manager) sweepEncounters() {
+	go func() {
+		t := time.NewTicker(encounterSweepInterval).C
+		for range t {
+			self.mtx.Lock()
+			self.endQuietEncounters(time.Now())
+			self.mtx.Unlock()
+		}
+	}()
+}
+
+// endQuietEncounters expects the manager lock to be held.
+func (self *Manager) endQuietEncounters(now time.Time) {
+	for key, state := range self.encounterStates {
+		if now.Sub(state.updated) <= time.Duration(state.rule.cfg.MaxGap) {
+			continue
+		}
+		delete(self.encounterStates, key)
+		self.endEncounterMetrics(state)
+		log.Printf("encounter ended without points for the max gap rule:%v devices:%v,%v duration:%vs min distance:%.0fm", state.rule.cfg.Name, state.a, state.b, state.last-state.start, state.minDistance)
+	}
+}
+
+// appendAttr appends a value to the comma separated values of an attribute.
+func appendAttr(data *Data, name, value string) {
+	if v, ok := data.Attr[name]; ok {
+		value = v + "," + value
+	}
+	data.setAttr(name, value)
+}
+
+// orderedPair orders the IDs of two devices so that a pair has the same key and labels.
+func orderedPair(a, b string) (string, string) {
+	if b < a {
+		return b, a
+	}
+	return a, b
+}
@@ -0,0 +1,147 @@
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func encounterActive(rule, a, b string) float64 {
+	a, b = orderedPair(devID(a), devID(b))
+	return testutil.ToFloat64(testMetrics.encounterActive.With(prometheus.Labels{"rule": rule, "dev_a": a, "dev_b": b}))
+}
+
+func TestCheckEncounters(t *testing.T) {
+	m := newTestManager()
+	err := m.SetEncounters([]config.Encounter{{
+		Name:     "lionRhino",
+		Group:    config.DeviceGroup{Species: []string{"lion"}},
+		Others:   &config.DeviceGroup{Species: []string{"rhino"}},
+		Distance: 500,
+		MaxGap:   config.Duration(time.Hour),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lion := devID("lionE1")
+	started := testutil.ToFloat64(testMetrics.encounters.With(prometheus.Labels{"rule": "lionRhino"}))
+
+	// The steps are sent in order and the alarm attributes are empty when not set.
+	steps := []struct {
+		name     string
+		device   string
+		species  string
+		point    *Data
+		alarm    string
+		other    string
+		duration string
+		distance string
+	}{
+		{name: "first device", device: "lionE1", species: "lion", point: at(0, 0, t0)},
+		{name: "far", device: "rhinoE1", species: "rhino", point: at(2000, 0, t0+60)},
+		{name: "within the distance", device: "rhinoE1", species: "rhino", point: at(400, 0, t0+120),
+			alarm: AlarmEncounterStart, other: lion, duration: "0", distance: "400"},
+		{name: "closer", device: "lionE1", species: "lion", point: at(100, 0, t0+600)},
+		{name: "older point is skipped", device: "lionE1", species: "lion", point: at(5000, 0, t0+300)},
+		{name: "closest", device: "rhinoE1", species: "rhino", point: at(300, 0, t0+1200)},
+		{name: "still within the distance", device: "lionE1", species: "lion", point: at(0, 0, t0+1800)},
+		{name: "the same species doesn't match the rule", device: "rhinoE2", species: "rhino", point: at(700, 0, t0+1900)},
+		{name: "beyond the distance", device: "rhinoE1", species: "rhino", point: at(1000, 0, t0+2400),
+			alarm: AlarmEncounterEnd, other: lion, duration: "1680", distance: "200"},
+		{name: "far after the end", device: "lionE1", species: "lion", point: at(0, 0, t0+3000)},
+		{name: "again within the distance", device: "rhinoE1", species: "rhino", point: at(100, 0, t0+3600),
+			alarm: AlarmEncounterStart, other: lion, duration: "0", distance: "100"},
+		{name: "the other device without a fix within the max gap", device: "lionE1", species: "lion", point: at(0, 0, t0+3600+7200),
+			alarm: AlarmEncounterEnd, other: devID("rhinoE1"), duration: "0", distance: "100"},
+		{name: "another device within the distance", device: "rhinoE2", species: "rhino", point: at(50, 0, t0+3600+7260),
+			alarm: AlarmEncounterStart, other: lion, duration: "0", distance: "50"},
+	}
+	for _, step := range steps {
+		p := parse(t, m, step.device, step.species, step.point)[0]
+		checkAttrs(t, p, map[string]string{
+			AttrAlarm:             step.alarm,
+			AttrEncounter:         step.other,
+			AttrEncounterDuration: step.duration,
+			AttrEncounterDistance: step.distance,
+		})
+		if t.Failed() {
+			t.Fatalf("step:%v", step.name)
+		}
+	}
+
+	if got := encounterActive("lionRhino", "lionE1", "rhinoE1"); got != 0 {
+		t.Errorf("ended encounter metric got:%v expected:0", got)
+	}
+	if got := encounterActive("lionRhino", "lionE1", "rhinoE2"); got != 1 {
+		t.Errorf("active encounter metric got:%v expected:1", got)
+	}
+	if got := testutil.ToFloat64(testMetrics.encounters.With(prometheus.Labels{"rule": "lionRhino"})) - started; got != 3 {
+		t.Errorf("started encounters got:%v expected:3", got)
+	}
+	if len(m.encounterStates) != 1 {
+		t.Errorf("active encounters got:%v expected:1", len(m.encounterStates))
+	}
+}
+
+// TestEndQuietEncounters checks that the sweep ends the encounters
+// when both devices stop reporting for longer than the max gap.
+func TestEndQuietEncounters(t *testing.T) {
+	m := newTestManager()
+	err := m.SetEncounters([]config.Encounter{{
+		Name:     "lions",
+		Group:    config.DeviceGroup{Devices: []string{"LIONQ1", devEUI("lionQ2").String()}},
+		Distance: 100,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parse(t, m, "lionQ1", "lion", at(0, 0, t0))
+	p := parse(t, m, "lionQ2", "lion", at(50, 0, t0+60))[0]
+	checkAttrs(t, p, map[string]string{AttrAlarm: AlarmEncounterStart, AttrEncounter: devID("lionQ1")})
+	// A device outside the group doesn't start an encounter.
+	p = parse(t, m, "lionQ3", "lion", at(10, 0, t0+120))[0]
+	checkNoAttrs(t, p, AttrAlarm, AttrEncounter)
+
+	m.mtx.Lock()
+	m.endQuietEncounters(time.Now().Add(DefaultEncounterMaxGap - time.Minute))
+	m.mtx.Unlock()
+	if len(m.encounterStates) != 1 || encounterActive("lions", "lionQ1", "lionQ2") != 1 {
+		t.Fatalf("the encounter ended within the max gap active:%v", len(m.encounterStates))
+	}
+
+	m.mtx.Lock()
+	m.endQuietEncounters(time.Now().Add(DefaultEncounterMaxGap + time.Minute))
+	m.mtx.Unlock()
+	if len(m.encounterStates) != 0 || encounterActive("lions", "lionQ1", "lionQ2") != 0 {
+		t.Fatalf("the encounter didn't end after the max gap active:%v", len(m.encounterStates))
+	}
+
+	// The next point within the distance starts a new encounter.
+	p = parse(t, m, "lionQ1", "lion", at(0, 0, t0+180))[0]
+	checkAttrs(t, p, map[string]string{AttrAlarm: AlarmEncounterStart, AttrEncounter: devID("lionQ2")})
+}
+
+func TestSetEncountersErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []config.Encounter
+		err   string
+	}{
+		{name: "without a name", rules: []config.Encounter{{Distance: 100}}, err: "without a name"},
+		{name: "duplicate name", rules: []config.Encounter{{Name: "a", Distance: 100}, {Name: "a", Distance: 100}}, err: "duplicate encounter rule name:a"},
+		{name: "without a distance", rules: []config.Encounter{{Name: "a"}}, err: "requires a distance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newTestManager().SetEncounters(tt.rules)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
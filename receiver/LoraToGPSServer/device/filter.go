@@ -0,0 +1,241 @@
+package device
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The defaults for the outlier check fields which are not set in the config.
+const (
+	DefaultOutlierPoints = 5
+	DefaultOutlierWindow = time.Hour
+)
+
+// maxClockSkew is how far in the future a fix time is accepted.
+const maxClockSkew = 10 * time.Minute
+
+// The reasons for rejecting a point used in the filtered_points_total metric.
+const (
+	RejectHdop       = "hdop"
+	RejectEhpe       = "ehpe"
+	RejectSatellites = "satellites"
+	RejectFixAge     = "fix_age"
+	RejectSpeed      = "speed"
+	RejectOutlier    = "outlier"
+)
+
+// filterDefault is the config entry for the device types or species without their own entry.
+const filterDefault = "default"
+
+// SetFilters sets the quality checks of the points.
+// A rejected point is marked as invalid so that the sinks skip it and
+// it isn't used for the speed, the geofences and the next checks.
+func (self *Manager) SetFilters(cfg config.Filters) error {
+	if cfg.Outlier != nil {
+		if cfg.Outlier.MaxDistance <= 0 {
+			return errors.New("the outlier filter requires a maxDistance")
+		}
+		if cfg.Outlier.Points == 0 {
+			cfg.Outlier.Points = DefaultOutlierPoints
+		}
+		if cfg.Outlier.Points < 3 {
+			return errors.Errorf("the outlier filter requires at least 3 points got:%v", cfg.Outlier.Points)
+		}
+		if cfg.Outlier.Window == 0 {
+			cfg.Outlier.Window = config.Duration(DefaultOutlierWindow)
+		}
+	}
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.filters = &filters{
+		cfg:     cfg,
+		metrics: self.metrics,
+	}
+	return nil
+}
+
+type filters struct {
+	cfg     config.Filters
+	metrics *Metrics
+}
+
+// check runs the checks in order and returns the reason
+// for rejecting the point or an empty string when it passes.
+// The speed and outlier checks use the history of the accepted points.
+// Expects the manager lock to be held.
+func (f *filters) check(data *Data, track *track, now time.Time) string {
+	if !data.Valid {
+		return ""
+	}
+
+	reason := f.checkAccuracy(data)
+	if reason == "" {
+		reason = f.checkFixAge(data, now)
+	}
+	if reason == "" {
+		reason = f.checkSpeed(data, track)
+	}
+	if reason == "" {
+		reason = f.checkOutlier(data, track)
+	}
+
+	if reason != "" {
+		f.metrics.filtered.With(prometheus.Labels{"dev_id": data.ID, "reason": reason}).Inc()
+		log.Printf("rejected point reason:%v devID:%v lat:%v lon:%v hdop:%v time:%v", reason, data.ID, data.Lat, data.Lon, data.Hdop, data.Time)
+	}
+	return reason
+}
+
+func (f *filters) checkAccuracy(data *Data) string {
+	tf, ok := f.cfg.Types[data.Type]
+	if !ok {
+		tf = f.cfg.Types[filterDefault]
+	}
+	if tf.MaxHdop > 0 && data.Hdop > tf.MaxHdop {
+		return RejectHdop
+	}
+	if tf.MaxEhpe > 0 {
+		if ehpe, err := strconv.ParseFloat(data.Attr["ehpe"], 64); err == nil && ehpe > tf.MaxEhpe {
+			return RejectEhpe
+		}
+	}
+	if tf.MinSatellites > 0 {
+		if sat, err := strconv.Atoi(data.Attr["sat"]); err == nil && sat < tf.MinSatellites {
+			return RejectSatellites
+		}
+	}
+	return ""
+}
+
+func (f *filters) checkFixAge(data *Data, now time.Time) string {
+	if f.cfg.MaxFixAge == 0 {
+		return ""
+	}
+	age := now.Sub(time.Unix(data.Time, 0))
+	if age > time.Duration(f.cfg.MaxFixAge) || age < -maxClockSkew {
+		return RejectFixAge
+	}
+	return ""
+}
+
+// checkSpeed compares the point with the accepted point nearest in time
+// so that the locations logs sent out of order are also checked.
+func (f *filters) checkSpeed(data *Data, track *track) string {
+	var species string
+	if data.Payload != nil {
+		species = data.Payload.Tags["species"]
+	}
+	sf, ok := f.cfg.Species[species]
+	if !ok {
+		sf = f.cfg.Species[filterDefault]
+	}
+	if sf.MaxSpeed == 0 {
+		return ""
+	}
+
+	if len(track.fixes) == 0 {
+		return ""
+	}
+	nearest := track.fixes[0]
+	for _, p := range track.fixes {
+		if abs(p.Time-data.Time) < abs(nearest.Time-data.Time) {
+			nearest = p
+		}
+	}
+	km, err := Distance(nearest.Lat, nearest.Lon, data.Lat, data.Lon, "K")
+	if err != nil {
+		return ""
+	}
+	// Points with the same fix time are compared as a second apart.
+	seconds := abs(data.Time - nearest.Time)
+	if seconds == 0 {
+		seconds = 1
+	}
+	if km/(float64(seconds)/3600) > sf.MaxSpeed {
+		return RejectSpeed
+	}
+	return ""
+}
+
+// checkOutlier compares the point with the median position of the last points of the track
+// nearest in fix time within the window so that the older fixes from a locations log are also checked.
+// It is skipped when the track has less than half of the points within the window and
+// the median restarts from the point after as many consecutive outliers as the points
+// so that a device isn't rejected forever after it really moved.
+func (f *filters) checkOutlier(data *Data, track *track) string {
+	o := f.cfg.Outlier
+	if o == nil {
+		return ""
+	}
+
+	window := int64(time.Duration(o.Window).Seconds())
+	var near []fix
+	for _, p := range track.fixes {
+		if p.Time >= track.outlierFrom && abs(p.Time-data.Time) <= window {
+			near = append(near, p)
+		}
+	}
+	sort.SliceStable(near, func(i, j int) bool {
+		return abs(near[i].Time-data.Time) < abs(near[j].Time-data.Time)
+	})
+	if len(near) > o.Points {
+		near = near[:o.Points]
+	}
+	if len(near) < (o.Points+1)/2 {
+		return ""
+	}
+
+	var lats, lons []float64
+	for _, p := range near {
+		lats = append(lats, p.Lat)
+		lons = append(lons, p.Lon)
+	}
+	km, err := Distance(median(lats), median(lons), data.Lat, data.Lon, "K")
+	if err != nil || km*1000 <= o.MaxDistance {
+		track.outliers = 0
+		return ""
+	}
+
+	track.outliers++
+	if track.outliers >= o.Points {
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("restarting the outlier median after consecutive outliers:%v devID:%v", track.outliers, data.ID)
+		}
+		track.outlierFrom = data.Time
+		track.outliers = 0
+		return ""
+	}
+	return RejectOutlier
+}
+
+// size is how many accepted points the checks need.
+func (f *filters) size() int {
+	if f.cfg.Outlier != nil {
+		return f.cfg.Outlier.Points
+	}
+	return 1
+}
+
+func median(v []float64) float64 {
+	s := append([]float64{}, v...)
+	sort.Float64s(s)
+	if len(s)%2 == 0 {
+		return (s[len(s)/2-1] + s[len(s)/2]) / 2
+	}
+	return s[len(s)/2]
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
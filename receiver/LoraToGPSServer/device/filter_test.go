@@ -0,0 +1,222 @@
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testFilters() config.Filters {
+	return config.Filters{
+		Types:     map[string]config.TypeFilter{filterDefault: {MaxHdop: 5, MaxEhpe: 50, MinSatellites: 4}},
+		Species:   map[string]config.SpeciesFilter{"rhino": {MaxSpeed: 40}},
+		MaxFixAge: config.Duration(24 * time.Hour),
+		Outlier:   &config.Outlier{Points: 3, Window: config.Duration(time.Hour), MaxDistance: 1000},
+	}
+}
+
+func TestFilterReasons(t *testing.T) {
+	// The fix age is checked against the current time.
+	now := time.Now().Unix()
+	base := now - 3600
+	with := func(p *Data, f func(p *Data)) *Data {
+		f(p)
+		return p
+	}
+	cluster := []*Data{at(0, 0, base-180), at(10, 0, base-120), at(0, 10, base-60)}
+	oldCluster := []*Data{at(0, 0, base-7380), at(10, 0, base-7320), at(0, 10, base-7260)}
+
+	tests := []struct {
+		name    string
+		species string
+		history []*Data
+		point   *Data
+		reason  string
+	}{
+		{name: "accepted", point: at(0, 0, base)},
+		{name: "hdop", point: with(at(0, 0, base), func(p *Data) { p.Hdop = 6 }), reason: RejectHdop},
+		{name: "hdop at the limit", point: with(at(0, 0, base), func(p *Data) { p.Hdop = 5 })},
+		{name: "ehpe", point: with(at(0, 0, base), func(p *Data) { p.Attr["ehpe"] = "60" }), reason: RejectEhpe},
+		{name: "satellites", point: with(at(0, 0, base), func(p *Data) { p.Attr["sat"] = "3" }), reason: RejectSatellites},
+		{name: "satellites not reported", point: with(at(0, 0, base), func(p *Data) { p.Attr["sat"] = "" })},
+		{name: "old fix", point: at(0, 0, now-int64(48*time.Hour/time.Second)), reason: RejectFixAge},
+		{name: "fix in the future", point: at(0, 0, now+3600), reason: RejectFixAge},
+		{name: "fix within the clock skew", point: at(0, 0, now+60)},
+		{name: "speed", species: "rhino", history: []*Data{at(0, 0, base-60)}, point: at(2000, 0, base), reason: RejectSpeed},
+		{name: "speed below the max", species: "rhino", history: []*Data{at(0, 0, base-60)}, point: at(500, 0, base)},
+		{name: "speed of a species without a max", species: "lion", history: []*Data{at(0, 0, base-60)}, point: at(2000, 0, base)},
+		{name: "outlier", species: "lion", history: cluster, point: at(5000, 0, base), reason: RejectOutlier},
+		{name: "within the outlier distance", species: "lion", history: cluster, point: at(900, 0, base)},
+		{name: "outlier check with few points", species: "lion", history: cluster[2:], point: at(5000, 0, base)},
+		{name: "outlier check outside the window", species: "lion", history: oldCluster, point: at(5000, 0, base)},
+		{name: "invalid points aren't checked", point: with(at(0, 0, base), func(p *Data) { p.Valid = false; p.Hdop = 10 })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager()
+			if err := m.SetFilters(testFilters()); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.history) > 0 {
+				for _, p := range parse(t, m, "filter1", tt.species, tt.history...) {
+					if p.Rejected != "" {
+						t.Fatalf("history point rejected reason:%v", p.Rejected)
+					}
+				}
+			}
+			valid := tt.point.Valid
+			p := parse(t, m, "filter1", tt.species, tt.point)[0]
+			if p.Rejected != tt.reason {
+				t.Fatalf("reason got:%q expected:%q", p.Rejected, tt.reason)
+			}
+			if p.Valid != (valid && tt.reason == "") {
+				t.Errorf("valid got:%v", p.Valid)
+			}
+			if fixes := len(m.tracks[devID("filter1")].fixes); tt.reason != "" && fixes != len(tt.history) {
+				t.Errorf("the rejected point was added to the history fixes:%v", fixes)
+			}
+		})
+	}
+}
+
+// TestFilterOutlierReset checks that after as many consecutive outliers as the outlier points
+// the median restarts from the last outlier and the history before it is kept.
+func TestFilterOutlierReset(t *testing.T) {
+	m := newTestManager()
+	if err := m.SetFilters(testFilters()); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Unix() - 3600
+
+	steps := []struct {
+		name   string
+		point  *Data
+		reason string
+	}{
+		{name: "history", point: at(0, 0, base)},
+		{name: "history", point: at(10, 0, base+60)},
+		{name: "history", point: at(0, 10, base+120)},
+		{name: "first outlier", point: at(5000, 0, base+180), reason: RejectOutlier},
+		{name: "second outlier", point: at(5010, 0, base+240), reason: RejectOutlier},
+		{name: "third outlier restarts the median", point: at(5020, 0, base+300)},
+		{name: "too few points since the restart", point: at(5030, 0, base+360)},
+		{name: "back at the old place is an outlier from the restarted median", point: at(0, 0, base+420), reason: RejectOutlier},
+		{name: "near the restarted median", point: at(5040, 0, base+480)},
+	}
+	var last *Data
+	for _, step := range steps {
+		p := parse(t, m, "outlier1", "lion", step.point)[0]
+		if p.Rejected != step.reason {
+			t.Fatalf("step:%v reason got:%q expected:%q", step.name, p.Rejected, step.reason)
+		}
+		if step.name == "third outlier restarts the median" {
+			last = p
+		}
+	}
+
+	// The distance of the restart point is from the last fix before the outliers.
+	approx(t, "restart point distance", last.Distance, 5020, 10)
+
+	track := m.tracks[devID("outlier1")]
+	if len(track.fixes) != 6 {
+		t.Fatalf("history fixes got:%v expected:6", len(track.fixes))
+	}
+	if track.fixes[0].Time != base || track.outlierFrom != base+300 || track.outliers != 0 {
+		t.Errorf("first fix time got:%v outlierFrom got:%v outliers:%v", track.fixes[0].Time, track.outlierFrom, track.outliers)
+	}
+}
+
+// TestFilterOutlierLastPoints checks that the median uses only the last outlier points
+// and not all points within the window so that a gradual movement isn't rejected.
+func TestFilterOutlierLastPoints(t *testing.T) {
+	m := newTestManager()
+	if err := m.SetFilters(testFilters()); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Unix() - 3600
+
+	for i, east := range []float64{0, 0, 0, 450, 900, 1350, 1800} {
+		p := parse(t, m, "outlier2", "lion", at(east, 0, base+int64(i*60)))[0]
+		if p.Rejected != "" {
+			t.Fatalf("point:%v east:%v rejected reason:%v", i, east, p.Rejected)
+		}
+	}
+}
+
+// TestFilterDuplicates checks that the duplicates and the retried uplinks get
+// the verdict of the original point without counting it again.
+func TestFilterDuplicates(t *testing.T) {
+	m := newTestManager()
+	if err := m.SetFilters(testFilters()); err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Unix() - 3600
+	parseUplink(t, m, "filter2", "lion", 1, at(0, 0, base), at(10, 0, base+60), at(0, 10, base+120))
+
+	filtered := testMetrics.filtered.With(prometheus.Labels{"dev_id": devID("filter2"), "reason": RejectOutlier})
+	before := testutil.ToFloat64(filtered)
+	outlier := parseUplink(t, m, "filter2", "lion", 2, at(5000, 0, base+180))
+
+	steps := []struct {
+		name   string
+		fCnt   uint32
+		point  *Data
+		forget bool
+		reason string
+	}{
+		{name: "duplicate of an outlier", fCnt: 2, point: at(5000, 0, base+180), reason: RejectOutlier},
+		{name: "duplicate of an accepted point", fCnt: 1, point: at(10, 0, base+60)},
+		{name: "retried outlier", fCnt: 2, point: at(5000, 0, base+180), forget: true, reason: RejectOutlier},
+	}
+	for _, step := range steps {
+		if step.forget {
+			m.Forget(outlier)
+		}
+		p := parseUplink(t, m, "filter2", "lion", step.fCnt, step.point)[0]
+		if p.Duplicate == step.forget {
+			t.Errorf("step:%v duplicate got:%v", step.name, p.Duplicate)
+		}
+		if p.Rejected != step.reason || p.Valid != (step.reason == "") {
+			t.Errorf("step:%v reason got:%q valid:%v expected:%q", step.name, p.Rejected, p.Valid, step.reason)
+		}
+	}
+
+	if got := testutil.ToFloat64(filtered) - before; got != 1 {
+		t.Errorf("filtered metric got:%v expected:1", got)
+	}
+	// Only the original outlier counts for the restart of the median.
+	if track := m.tracks[devID("filter2")]; track.outliers != 1 || len(track.fixes) != 3 {
+		t.Errorf("outliers got:%v fixes:%v expected 1 outlier and 3 fixes", track.outliers, len(track.fixes))
+	}
+}
+
+func TestSetFiltersErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		outlier *config.Outlier
+		err     string
+	}{
+		{name: "without max distance", outlier: &config.Outlier{Points: 3}, err: "requires a maxDistance"},
+		{name: "too few points", outlier: &config.Outlier{Points: 2, MaxDistance: 100}, err: "requires at least 3 points"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newTestManager().SetFilters(config.Filters{Outlier: tt.outlier})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+
+	m := newTestManager()
+	if err := m.SetFilters(config.Filters{Outlier: &config.Outlier{MaxDistance: 100}}); err != nil {
+		t.Fatal(err)
+	}
+	if o := m.filters.cfg.Outlier; o.Points != DefaultOutlierPoints || time.Duration(o.Window) != DefaultOutlierWindow {
+		t.Errorf("defaults got points:%v window:%v", o.Points, time.Duration(o.Window))
+	}
+}
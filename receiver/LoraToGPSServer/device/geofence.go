@@ -0,0 +1,175 @@
+package device
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	geom "github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/geojson"
+	"github.com/twpayne/go-geom/xy"
+)
+
+// The attributes set on the points which enter or exit a geofence.
+// These are events so the sinks shouldn't carry them over to the next points.
+const (
+	// AttrAlarm is a comma separated list of alarms like geofenceEnter or geofenceExit
+	// as the traccar alarms.
+	AttrAlarm = "alarm"
+	// AttrGeofence is the geofence name for each geofence alarm.
+	AttrGeofence = "geofence"
+)
+
+// The geofence alarms.
+const (
+	AlarmGeofenceEnter = "geofenceEnter"
+	AlarmGeofenceExit  = "geofenceExit"
+)
+
+// Geofence is a named area of one or more polygons like a park or a village.
+type Geofence struct {
+	Name     string
+	polygons []*geom.Polygon
+	bounds   *geom.Bounds
+}
+
+// Contains checks if a point is inside any of the polygons and outside its holes.
+func (g *Geofence) Contains(lat, lon float64) bool {
+	p := geom.Coord{lon, lat}
+	if !g.bounds.OverlapsPoint(geom.XY, p) {
+		return false
+	}
+	for _, poly := range g.polygons {
+		if !xy.IsPointInRing(poly.Layout(), p, poly.LinearRing(0).FlatCoords()) {
+			continue
+		}
+		inHole := false
+		for i := 1; i < poly.NumLinearRings(); i++ {
+			if xy.IsPointInRing(poly.Layout(), p, poly.LinearRing(i).FlatCoords()) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadGeofences reads a GeoJSON feature collection with a geofence for each
+// Polygon or MultiPolygon feature named by its "name" property or the feature id.
+// Each valid point is checked against all geofences and
+// the points which enter or exit a geofence get the alarm attributes.
+func (self *Manager) LoadGeofences(path string) error {
+	c, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "reading the geofences file")
+	}
+	fc := &geojson.FeatureCollection{}
+	if err := fc.UnmarshalJSON(c); err != nil {
+		return errors.Wrapf(err, "parsing the geofences file:%v", path)
+	}
+
+	names := make(map[string]struct{})
+	var fences []*Geofence
+	for i, f := range fc.Features {
+		name, _ := f.Properties["name"].(string)
+		if name == "" {
+			name = f.ID
+		}
+		if name == "" {
+			return errors.Errorf("geofence feature:%v without a name property or an id", i)
+		}
+		if _, ok := names[name]; ok {
+			return errors.Errorf("duplicate geofence name:%v", name)
+		}
+		names[name] = struct{}{}
+
+		g := &Geofence{Name: name, bounds: geom.NewBounds(geom.XY)}
+		switch t := f.Geometry.(type) {
+		case *geom.Polygon:
+			g.polygons = append(g.polygons, t)
+		case *geom.MultiPolygon:
+			for j := 0; j < t.NumPolygons(); j++ {
+				g.polygons = append(g.polygons, t.Polygon(j))
+			}
+		default:
+			return errors.Errorf("geofence:%v unsupported geometry type:%T, expected a Polygon or a MultiPolygon", name, f.Geometry)
+		}
+		for _, poly := range g.polygons {
+			if poly.NumLinearRings() == 0 {
+				return errors.Errorf("geofence:%v polygon without coordinates", name)
+			}
+			g.bounds.Extend(poly)
+		}
+		fences = append(fences, g)
+		log.Println("loaded geofence:", name)
+	}
+
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.geofences = fences
+	return nil
+}
+
+// fenceState is the last known position of a device relative to the geofences.
+type fenceState struct {
+	time   int64
+	inside map[string]bool
+}
+
+// checkGeofences updates the inside state of the device and
+// sets the alarm attributes when the point enters or exits a geofence.
+// The first point of a device sets only the state without alarms and
+// points older than the last checked point are skipped.
+// Expects the manager lock to be held.
+func (self *Manager) checkGeofences(data *Data) {
+	if len(self.geofences) == 0 || !data.Valid {
+		return
+	}
+	state, known := self.fenceStates[data.ID]
+	if known && data.Time < state.time {
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("skipping the geofence check for an older point devID:%v time:%v last:%v", data.ID, data.Time, state.time)
+		}
+		return
+	}
+	if !known {
+		state = &fenceState{inside: make(map[string]bool)}
+		self.fenceStates[data.ID] = state
+	}
+	state.time = data.Time
+
+	var fences []string
+	for _, g := range self.geofences {
+		inside := g.Contains(data.Lat, data.Lon)
+		labels := prometheus.Labels{"dev_id": data.ID, "geofence": g.Name}
+		if inside {
+			self.metrics.geofenceInside.With(labels).Set(1)
+		} else {
+			self.metrics.geofenceInside.With(labels).Set(0)
+		}
+
+		was, ok := state.inside[g.Name]
+		state.inside[g.Name] = inside
+		if !ok || was == inside {
+			continue
+		}
+		alarm := AlarmGeofenceExit
+		if inside {
+			alarm = AlarmGeofenceEnter
+		}
+		data.addAlarm(alarm)
+		fences = append(fences, g.Name)
+		self.metrics.geofenceEvents.With(prometheus.Labels{"dev_id": data.ID, "geofence": g.Name, "event": alarm}).Inc()
+		log.Printf("geofence event:%v geofence:%v devID:%v lat:%v lon:%v", alarm, g.Name, data.ID, data.Lat, data.Lon)
+	}
+
+	if len(fences) > 0 {
+		data.setAttr(AttrGeofence, strings.Join(fences, ","))
+	}
+}
@@ -0,0 +1,155 @@
+package device
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGeofences is a park with a swamp hole around -1.25,36.85
+// and a village of two separate areas east and west of the park.
+const testGeofences = `{
+	"type": "FeatureCollection",
+	"features": [
+		{
+			"type": "Feature",
+			"properties": {"name": "park"},
+			"geometry": {"type": "Polygon", "coordinates": [
+				[[36.84, -1.26], [36.86, -1.26], [36.86, -1.24], [36.84, -1.24], [36.84, -1.26]],
+				[[36.848, -1.252], [36.848, -1.248], [36.852, -1.248], [36.852, -1.252], [36.848, -1.252]]
+			]}
+		},
+		{
+			"type": "Feature",
+			"id": "village",
+			"properties": {},
+			"geometry": {"type": "MultiPolygon", "coordinates": [
+				[[[36.87, -1.25], [36.88, -1.25], [36.88, -1.24], [36.87, -1.24], [36.87, -1.25]]],
+				[[[36.82, -1.26], [36.83, -1.26], [36.83, -1.25], [36.82, -1.25], [36.82, -1.26]]]
+			]}
+		}
+	]
+}`
+
+func loadTestGeofences(t *testing.T, m *Manager, geojson string) error {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "geofences.geojson")
+	if err := ioutil.WriteFile(path, []byte(geojson), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return m.LoadGeofences(path)
+}
+
+func TestGeofenceContains(t *testing.T) {
+	m := newTestManager()
+	if err := loadTestGeofences(t, m, testGeofences); err != nil {
+		t.Fatal(err)
+	}
+	park, village := m.geofences[0], m.geofences[1]
+
+	tests := []struct {
+		name     string
+		lat, lon float64
+		park     bool
+		village  bool
+	}{
+		{name: "park", lat: -1.245, lon: 36.845, park: true},
+		{name: "park next to the hole", lat: -1.25, lon: 36.846, park: true},
+		{name: "hole", lat: -1.25, lon: 36.85},
+		{name: "village east", lat: -1.245, lon: 36.875, village: true},
+		{name: "village west", lat: -1.255, lon: 36.825, village: true},
+		{name: "between the park and the village", lat: -1.245, lon: 36.865},
+		{name: "outside all bounds", lat: 1.25, lon: 36.85},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := park.Contains(tt.lat, tt.lon); got != tt.park {
+				t.Errorf("park got:%v expected:%v", got, tt.park)
+			}
+			if got := village.Contains(tt.lat, tt.lon); got != tt.village {
+				t.Errorf("village got:%v expected:%v", got, tt.village)
+			}
+		})
+	}
+}
+
+func TestCheckGeofences(t *testing.T) {
+	m := newTestManager()
+	if err := loadTestGeofences(t, m, testGeofences); err != nil {
+		t.Fatal(err)
+	}
+
+	// The steps are sent in order for the same device.
+	steps := []struct {
+		name     string
+		point    *Data
+		alarm    string
+		geofence string
+	}{
+		{name: "first point sets only the state", point: point(-1.245, 36.845, t0)},
+		{name: "inside the park", point: point(-1.255, 36.855, t0+60)},
+		{name: "into the hole", point: point(-1.25, 36.85, t0+120), alarm: "geofenceExit", geofence: "park"},
+		{name: "still in the hole", point: point(-1.2501, 36.8501, t0+180)},
+		{name: "out of the hole", point: point(-1.25, 36.846, t0+240), alarm: "geofenceEnter", geofence: "park"},
+		{name: "older point in the hole is skipped", point: point(-1.25, 36.85, t0+200)},
+		{name: "invalid point in the hole is skipped", point: &Data{Lat: -1.25, Lon: 36.85, Time: t0 + 300}},
+		{name: "from the park to the village", point: point(-1.255, 36.825, t0+360), alarm: "geofenceExit,geofenceEnter", geofence: "park,village"},
+		{name: "to the other village area", point: point(-1.245, 36.875, t0+420)},
+		{name: "out of all", point: point(-1.245, 36.865, t0+480), alarm: "geofenceExit", geofence: "village"},
+	}
+	for _, step := range steps {
+		p := parse(t, m, "fence1", "lion", step.point)[0]
+		if p.Attr[AttrAlarm] != step.alarm || p.Attr[AttrGeofence] != step.geofence {
+			t.Errorf("step:%v alarm got:%q expected:%q geofence got:%q expected:%q",
+				step.name, p.Attr[AttrAlarm], step.alarm, p.Attr[AttrGeofence], step.geofence)
+		}
+	}
+
+	state := m.fenceStates[devID("fence1")]
+	if state.time != t0+480 || state.inside["park"] || state.inside["village"] {
+		t.Errorf("state got time:%v inside:%v", state.time, state.inside)
+	}
+}
+
+func TestLoadGeofencesErrors(t *testing.T) {
+	feature := `{"type": "FeatureCollection", "features": [%v]}`
+	polygon := `{"type": "Polygon", "coordinates": [[[36.84, -1.26], [36.86, -1.26], [36.86, -1.24], [36.84, -1.26]]]}`
+
+	tests := []struct {
+		name    string
+		geojson string
+		err     string
+	}{
+		{
+			name:    "invalid json",
+			geojson: `{"type": "FeatureCollection", "features": [`,
+			err:     "parsing the geofences file",
+		},
+		{
+			name:    "without a name",
+			geojson: strings.Replace(feature, "%v", `{"type": "Feature", "properties": {}, "geometry": `+polygon+`}`, 1),
+			err:     "without a name property or an id",
+		},
+		{
+			name: "duplicate name",
+			geojson: strings.Replace(feature, "%v",
+				`{"type": "Feature", "properties": {"name": "park"}, "geometry": `+polygon+`},`+
+					`{"type": "Feature", "properties": {"name": "park"}, "geometry": `+polygon+`}`, 1),
+			err: "duplicate geofence name:park",
+		},
+		{
+			name:    "point geometry",
+			geojson: strings.Replace(feature, "%v", `{"type": "Feature", "properties": {"name": "gate"}, "geometry": {"type": "Point", "coordinates": [36.85, -1.25]}}`, 1),
+			err:     "unsupported geometry type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := loadTestGeofences(t, newTestManager(), tt.geojson)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
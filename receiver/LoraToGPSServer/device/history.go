@@ -0,0 +1,208 @@
+package device
+
+import (
+	"log"
+	"math"
+	"os"
+	"sort"
+)
+
+// DefaultHistorySize is the number of fixes kept for each device when not set.
+const DefaultHistorySize = 100
+
+// knotsPerKmh converts the speed in km/h to knots.
+const knotsPerKmh = 1 / 1.852
+
+// fix is a copy of an accepted gps point kept in the device history
+// so that the points already sent to the sinks aren't changed.
+type fix struct {
+	Lat  float64
+	Lon  float64
+	Time int64
+	// Speed in knots, Bearing in degrees and Distance in meters from the previous fix.
+	Speed    float64
+	Bearing  float64
+	Distance float64
+	// reported is set when the speed is reported by the device.
+	reported bool
+	// events are the alarm attributes of the point for its duplicates.
+	events map[string]string
+}
+
+// track is the history of a device with the fixes sorted by the fix time.
+type track struct {
+	fixes []fix
+	// outliers is the number of consecutive points rejected as outliers.
+	outliers int
+	// outlierFrom is the fix time from which the fixes are used for the outlier median.
+	// It is set after a run of outliers instead of clearing the history.
+	outlierFrom int64
+	// rejected are the last points rejected by the filters for the verdict of their duplicates.
+	rejected []rejection
+}
+
+// rejection is a point rejected by the filters.
+type rejection struct {
+	Lat    float64
+	Lon    float64
+	Time   int64
+	reason string
+}
+
+// reject records a point rejected by the filters and keeps only the last size points.
+func (t *track) reject(data *Data, reason string, size int) {
+	t.rejected = append(t.rejected, rejection{Lat: data.Lat, Lon: data.Lon, Time: data.Time, reason: reason})
+	if len(t.rejected) > size {
+		t.rejected = t.rejected[len(t.rejected)-size:]
+	}
+}
+
+// verdict returns the filter result of a point which was already checked
+// and reports if the point was found in the history or the rejected points.
+func (t *track) verdict(data *Data) (string, bool) {
+	if !data.Valid {
+		return "", false
+	}
+	for _, r := range t.rejected {
+		if r.Time == data.Time && r.Lat == data.Lat && r.Lon == data.Lon {
+			return r.reason, true
+		}
+	}
+	i := sort.Search(len(t.fixes), func(i int) bool { return t.fixes[i].Time >= data.Time })
+	for ; i < len(t.fixes) && t.fixes[i].Time == data.Time; i++ {
+		if t.fixes[i].Lat == data.Lat && t.fixes[i].Lon == data.Lon {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// SetHistorySize sets how many fixes are kept for each device.
+func (self *Manager) SetHistorySize(size int) {
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	if size < 1 {
+		size = 1
+	}
+	self.historySize = size
+}
+
+// track returns the history of a device.
+// Expects the manager lock to be held.
+func (self *Manager) track(devID string) *track {
+	t, ok := self.tracks[devID]
+	if !ok {
+		t = &track{}
+		self.tracks[devID] = t
+	}
+	return t
+}
+
+// addHistory inserts a valid point in the device history in fix time order
+// and sets its speed, bearing and distance from the previous fix.
+// A historical point inserted between two fixes also updates the next fix.
+// Expects the manager lock to be held.
+func (self *Manager) addHistory(data *Data) {
+	if !data.Valid {
+		return
+	}
+	t := self.track(data.ID)
+	size := self.historySize
+	if self.filters != nil && self.filters.size() > size {
+		size = self.filters.size()
+	}
+
+	// The uplink is retried after a failed delivery so the fix is already in the history.
+	if self.fromHistory(data) {
+		return
+	}
+
+	i := sort.Search(len(t.fixes), func(i int) bool { return t.fixes[i].Time > data.Time })
+	if i == 0 && len(t.fixes) >= size {
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("skipping the history for a point older than the history devID:%v time:%v", data.ID, data.Time)
+		}
+		return
+	}
+
+	f := fix{Lat: data.Lat, Lon: data.Lon, Time: data.Time, Speed: data.Speed, reported: data.SpeedReported}
+	for name, v := range data.Attr {
+		if IsEventAttr(name) || name == AttrStationary {
+			if f.events == nil {
+				f.events = make(map[string]string)
+			}
+			f.events[name] = v
+		}
+	}
+	t.fixes = append(t.fixes, fix{})
+	copy(t.fixes[i+1:], t.fixes[i:])
+	t.fixes[i] = f
+
+	if i > 0 {
+		t.fixes[i].segment(t.fixes[i-1])
+	}
+	if i+1 < len(t.fixes) {
+		t.fixes[i+1].segment(t.fixes[i])
+	}
+	if len(t.fixes) > size {
+		t.fixes = t.fixes[len(t.fixes)-size:]
+		i -= 1
+	}
+
+	data.Speed = t.fixes[i].Speed
+	data.Bearing = t.fixes[i].Bearing
+	data.Distance = t.fixes[i].Distance
+}
+
+// fromHistory sets the speed, bearing, distance and alarms of a duplicate point
+// from the same fix in the history and reports if the fix was found.
+// A duplicate of a point rejected by the filters is marked invalid with the same reason.
+// Expects the manager lock to be held.
+func (self *Manager) fromHistory(data *Data) bool {
+	t, ok := self.tracks[data.ID]
+	if !ok || !data.Valid {
+		return false
+	}
+	if reason, ok := t.verdict(data); ok && reason != "" {
+		data.Valid = false
+		data.Rejected = reason
+		return true
+	}
+	i := sort.Search(len(t.fixes), func(i int) bool { return t.fixes[i].Time >= data.Time })
+	for ; i < len(t.fixes) && t.fixes[i].Time == data.Time; i++ {
+		if t.fixes[i].Lat == data.Lat && t.fixes[i].Lon == data.Lon {
+			data.Speed = t.fixes[i].Speed
+			data.Bearing = t.fixes[i].Bearing
+			data.Distance = t.fixes[i].Distance
+			for name, v := range t.fixes[i].events {
+				data.setAttr(name, v)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// segment sets the distance, bearing and speed from the previous fix.
+func (f *fix) segment(prev fix) {
+	km, _ := Distance(prev.Lat, prev.Lon, f.Lat, f.Lon, "K")
+	f.Distance = km * 1000
+	f.Bearing = Bearing(prev.Lat, prev.Lon, f.Lat, f.Lon)
+	if f.reported {
+		return
+	}
+	f.Speed = 0
+	if seconds := f.Time - prev.Time; seconds > 0 {
+		f.Speed = km / (float64(seconds) / 3600) * knotsPerKmh
+	}
+}
+
+// Bearing is the initial bearing in degrees from north between 2 gps points.
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	radlat1 := lat1 * math.Pi / 180
+	radlat2 := lat2 * math.Pi / 180
+	radtheta := (lon2 - lon1) * math.Pi / 180
+	y := math.Sin(radtheta) * math.Cos(radlat2)
+	x := math.Cos(radlat1)*math.Sin(radlat2) - math.Sin(radlat1)*math.Cos(radlat2)*math.Cos(radtheta)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
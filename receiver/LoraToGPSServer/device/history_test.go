@@ -0,0 +1,230 @@
+package device
+
+import (
+	"testing"
+)
+
+func TestAddHistory(t *testing.T) {
+	// B is 1km east of A and C is 2km north of A so each leg is 12km/h.
+	a := func() *Data { return at(0, 0, t0) }
+	b := func() *Data { return at(1000, 0, t0+300) }
+	c := func() *Data { return at(0, 2000, t0+600) }
+	reported := func(speed float64) *Data {
+		p := c()
+		p.Speed = speed
+		p.SpeedReported = true
+		return p
+	}
+
+	type expected struct {
+		time     int64
+		distance float64
+		bearing  float64
+		speed    float64
+	}
+	tests := []struct {
+		name    string
+		size    int
+		points  []*Data
+		fixes   []expected
+		skipped int64
+	}{
+		{
+			name:   "in order",
+			points: []*Data{a(), c()},
+			fixes:  []expected{{time: t0}, {time: t0 + 600, distance: 2000, bearing: 0, speed: 12 * knotsPerKmh}},
+		},
+		{
+			name:   "inserted in the middle recomputes the next fix",
+			points: []*Data{a(), c(), b()},
+			fixes: []expected{
+				{time: t0},
+				{time: t0 + 300, distance: 1000, bearing: 90, speed: 12 * knotsPerKmh},
+				{time: t0 + 600, distance: 2236.07, bearing: 333.43, speed: 26.83 * knotsPerKmh},
+			},
+		},
+		{
+			name:   "inserted first recomputes the next fix",
+			points: []*Data{c(), a()},
+			fixes:  []expected{{time: t0}, {time: t0 + 600, distance: 2000, bearing: 0, speed: 12 * knotsPerKmh}},
+		},
+		{
+			name:   "the reported speed isn't recomputed",
+			points: []*Data{a(), reported(3), b()},
+			fixes: []expected{
+				{time: t0},
+				{time: t0 + 300, distance: 1000, bearing: 90, speed: 12 * knotsPerKmh},
+				{time: t0 + 600, distance: 2236.07, bearing: 333.43, speed: 3},
+			},
+		},
+		{
+			name:   "a reported speed of 0 isn't recomputed",
+			points: []*Data{a(), reported(0), b()},
+			fixes: []expected{
+				{time: t0},
+				{time: t0 + 300, distance: 1000, bearing: 90, speed: 12 * knotsPerKmh},
+				{time: t0 + 600, distance: 2236.07, bearing: 333.43, speed: 0},
+			},
+		},
+		{
+			name:   "limited to the history size",
+			size:   2,
+			points: []*Data{a(), b(), c()},
+			fixes: []expected{
+				{time: t0 + 300, distance: 1000, bearing: 90, speed: 12 * knotsPerKmh},
+				{time: t0 + 600, distance: 2236.07, bearing: 333.43, speed: 26.83 * knotsPerKmh},
+			},
+		},
+		{
+			name:    "older than the full history is skipped",
+			size:    2,
+			points:  []*Data{b(), c(), a()},
+			fixes:   []expected{{time: t0 + 300}, {time: t0 + 600, distance: 2236.07, bearing: 333.43, speed: 26.83 * knotsPerKmh}},
+			skipped: t0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager()
+			if tt.size > 0 {
+				m.SetHistorySize(tt.size)
+			}
+			var parsed []*Data
+			for _, p := range tt.points {
+				parsed = append(parsed, parse(t, m, "history1", "lion", p)...)
+			}
+
+			fixes := m.tracks[devID("history1")].fixes
+			if len(fixes) != len(tt.fixes) {
+				t.Fatalf("fixes got:%v expected:%v", len(fixes), len(tt.fixes))
+			}
+			for i, e := range tt.fixes {
+				f := fixes[i]
+				if f.Time != e.time {
+					t.Fatalf("fix:%v time got:%v expected:%v", i, f.Time, e.time)
+				}
+				approx(t, "distance", f.Distance, e.distance, 5)
+				approx(t, "bearing", f.Bearing, e.bearing, 0.1)
+				approx(t, "speed", f.Speed, e.speed, 0.05)
+			}
+
+			// The parsed point gets the values of its fix at the time it was added.
+			last := parsed[len(parsed)-1]
+			if last.Time == tt.skipped {
+				if last.Distance != 0 || last.Speed != 0 {
+					t.Errorf("skipped point got distance:%v speed:%v", last.Distance, last.Speed)
+				}
+				return
+			}
+			for _, f := range fixes {
+				if f.Time == last.Time && (f.Distance != last.Distance || f.Bearing != last.Bearing || f.Speed != last.Speed) {
+					t.Errorf("last point got distance:%v bearing:%v speed:%v expected:%+v", last.Distance, last.Bearing, last.Speed, f)
+				}
+			}
+		})
+	}
+}
+
+func TestFromHistory(t *testing.T) {
+	m := newTestManager()
+	parseUplink(t, m, "history2", "lion", 1, at(0, 0, t0))
+	parseUplink(t, m, "history2", "lion", 2, at(0, 2000, t0+600))
+	parseUplink(t, m, "history2", "lion", 3, at(1000, 0, t0+300))
+
+	// The duplicate gets the values recomputed after the insert
+	// and the events of the original point.
+	m.mtx.Lock()
+	fixes := m.tracks[devID("history2")].fixes
+	fixes[2].events = map[string]string{AttrAlarm: AlarmGeofenceEnter, AttrGeofence: "park"}
+	m.mtx.Unlock()
+
+	tests := []struct {
+		name  string
+		fCnt  uint32
+		point *Data
+		attrs map[string]string
+	}{
+		{name: "duplicate", fCnt: 2, point: at(0, 2000, t0+600), attrs: map[string]string{AttrAlarm: AlarmGeofenceEnter, AttrGeofence: "park"}},
+		{name: "duplicate with a different position", fCnt: 2, point: at(0, 2100, t0+600)},
+		{name: "duplicate invalid point", fCnt: 2, point: &Data{Lat: at(0, 2000, 0).Lat, Lon: at(0, 2000, 0).Lon, Time: t0 + 600}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := parseUplink(t, m, "history2", "lion", tt.fCnt, tt.point)[0]
+			if !p.Duplicate {
+				t.Fatal("the point isn't a duplicate")
+			}
+			if tt.attrs == nil {
+				if p.Distance != 0 || p.Speed != 0 || p.Bearing != 0 || len(p.Attr) != 0 {
+					t.Errorf("got distance:%v bearing:%v speed:%v attrs:%v", p.Distance, p.Bearing, p.Speed, p.Attr)
+				}
+				return
+			}
+			approx(t, "distance", p.Distance, 2236.07, 5)
+			approx(t, "bearing", p.Bearing, 333.43, 0.1)
+			approx(t, "speed", p.Speed, 26.83*knotsPerKmh, 0.05)
+			checkAttrs(t, p, tt.attrs)
+		})
+	}
+	if n := len(m.tracks[devID("history2")].fixes); n != 3 {
+		t.Errorf("the duplicates changed the history fixes:%v", n)
+	}
+}
+
+// TestRetriedUplink checks that an uplink retried after a failed delivery
+// isn't inserted again and gets the same values as the first delivery.
+func TestRetriedUplink(t *testing.T) {
+	m := newTestManager()
+	parseUplink(t, m, "history3", "lion", 1, at(0, 0, t0))
+	first := parseUplink(t, m, "history3", "lion", 2, at(0, 2000, t0+600))
+	m.Forget(first)
+
+	p := parseUplink(t, m, "history3", "lion", 2, at(0, 2000, t0+600))[0]
+	if p.Duplicate {
+		t.Fatal("the retried uplink is a duplicate")
+	}
+	if p.Distance != first[0].Distance || p.Speed != first[0].Speed || p.Bearing != first[0].Bearing {
+		t.Errorf("got distance:%v bearing:%v speed:%v expected:%+v", p.Distance, p.Bearing, p.Speed, first[0])
+	}
+	approx(t, "speed", p.Speed, 12*knotsPerKmh, 0.05)
+	if n := len(m.tracks[devID("history3")].fixes); n != 2 {
+		t.Errorf("the retried uplink changed the history fixes:%v", n)
+	}
+}
+
+// fakeRecorder keeps the recorded points.
+type fakeRecorder struct {
+	points []*Data
+}
+
+func (r *fakeRecorder) Record(points []*Data) error {
+	r.points = append(r.points, points...)
+	return nil
+}
+
+// TestRecorder checks that the fixes are recorded once by the manager
+// so that these are stored whichever endpoint parsed the uplink.
+func TestRecorder(t *testing.T) {
+	m := newTestManager()
+	r := &fakeRecorder{}
+	m.SetRecorder(r)
+
+	parseUplink(t, m, "history4", "lion", 1, at(0, 0, t0), at(0, 1000, t0+300))
+	// The same uplink from another endpoint or gateway.
+	parseUplink(t, m, "history4", "lion", 1, at(0, 0, t0), at(0, 1000, t0+300))
+	if len(r.points) != 2 {
+		t.Fatalf("recorded points got:%v expected:2", len(r.points))
+	}
+	for i, p := range r.points {
+		if p.ID != devID("history4") || p.Duplicate {
+			t.Errorf("recorded point:%v got id:%v duplicate:%v", i, p.ID, p.Duplicate)
+		}
+	}
+
+	// A retry after a failed delivery is recorded again and the store keeps a single fix for each fix time.
+	m.Forget(parseUplink(t, m, "history4", "lion", 2, at(0, 2000, t0+600)))
+	parseUplink(t, m, "history4", "lion", 2, at(0, 2000, t0+600))
+	if len(r.points) != 4 {
+		t.Errorf("recorded points got:%v expected:4", len(r.points))
+	}
+}
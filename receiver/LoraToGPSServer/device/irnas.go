@@ -0,0 +1,111 @@
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Uplink ports of the Irnas/SmartParks tracker firmware.
+const (
+	irnasPortGPS       = 1
+	irnasPortStatus    = 2
+	irnasPortLocations = 11
+	irnasPortStatusGPS = 12
+)
+
+// Lengths of the binary uplinks.
+const (
+	irnasLenStatus      = 8
+	irnasLenGPS         = 21
+	irnasLenLocation    = 12
+	irnasLenStatusGPS   = irnasLenStatus + irnasLenLocation
+	irnasCoordinateUnit = 1e5
+)
+
+// irnasDecode decodes the binary FRMPayload of the Irnas/SmartParks tracker uplinks
+// without relying on the chirpstack codec.
+// All values are little endian and the coordinates are int32 degrees*1e5.
+// The reference for the layouts is the decoder of the tag firmware version at
+// https://toolset.smartparks.org/ the same as for the chirpstack codec in the README
+// and these need updating together with irnas_test.go for a new firmware version.
+//
+// Port 1, a periodic or motion triggered fix:
+//
+//	0-3 lat, 4-7 lon, 8-9 alt uint16 meters, 10 satellites, 11 hdop*10,
+//	12 time to fix seconds, 13 ehpe meters, 14 snr, 15 lux, 16 motion, 17-20 fix time epoch uint32.
+//
+// Port 2, a status without gps:
+//
+//	0 resets, 1 errors, 2 battery (value*10+2500 mV), 3 temperature int8 C,
+//	4 uptime hours, 5-7 accelerometer x,y,z int8.
+//
+// Port 11, a resend of the logged locations with one or more records:
+//
+//	0-3 lat, 4-7 lon, 8-11 fix time epoch uint32.
+//
+// Port 12, a status with the last fix:
+//
+//	0-7 the same as port 2, 8-11 lat, 12-15 lon, 16-19 fix time epoch uint32.
+func irnasDecode(fPort uint8, b []byte) ([]*Data, error) {
+	switch fPort {
+	case irnasPortGPS:
+		if len(b) != irnasLenGPS {
+			return nil, fmt.Errorf("invalid gps payload length:%v expected:%v", len(b), irnasLenGPS)
+		}
+		d := irnasLocation(b[0:4], b[4:8], b[17:21])
+		d.Hdop = float64(b[11]) / 10
+		d.Motion = b[16] > 0
+		d.Attr["alt"] = strconv.Itoa(int(binary.LittleEndian.Uint16(b[8:10])))
+		d.Attr["sat"] = strconv.Itoa(int(b[10]))
+		d.Attr["ehpe"] = strconv.Itoa(int(b[13]))
+		return []*Data{d}, nil
+	case irnasPortStatus:
+		if len(b) != irnasLenStatus {
+			return nil, fmt.Errorf("invalid status payload length:%v expected:%v", len(b), irnasLenStatus)
+		}
+		d := &Data{
+			Attr: map[string]string{},
+		}
+		irnasStatus(d, b)
+		return []*Data{d}, nil
+	case irnasPortLocations:
+		if len(b) == 0 || len(b)%irnasLenLocation != 0 {
+			return nil, fmt.Errorf("invalid locations payload length:%v expected multiple of:%v", len(b), irnasLenLocation)
+		}
+		var points []*Data
+		for i := 0; i < len(b); i += irnasLenLocation {
+			r := b[i : i+irnasLenLocation]
+			points = append(points, irnasLocation(r[0:4], r[4:8], r[8:12]))
+		}
+		return points, nil
+	case irnasPortStatusGPS:
+		if len(b) != irnasLenStatusGPS {
+			return nil, fmt.Errorf("invalid status payload length:%v expected:%v", len(b), irnasLenStatusGPS)
+		}
+		d := irnasLocation(b[8:12], b[12:16], b[16:20])
+		irnasStatus(d, b[:irnasLenStatus])
+		return []*Data{d}, nil
+	}
+	return nil, fmt.Errorf("unsuported fport:%v", fPort)
+}
+
+func irnasLocation(lat, lon, fixTime []byte) *Data {
+	d := &Data{
+		Valid: true,
+		Attr:  map[string]string{},
+		Lat:   float64(int32(binary.LittleEndian.Uint32(lat))) / irnasCoordinateUnit,
+		Lon:   float64(int32(binary.LittleEndian.Uint32(lon))) / irnasCoordinateUnit,
+		Time:  int64(binary.LittleEndian.Uint32(fixTime)),
+	}
+	// Same as for the codec object the tag sends zeros when it has no fix.
+	if d.Lat == 0.0 || d.Lon == 0.0 {
+		d.Valid = false
+	}
+	return d
+}
+
+func irnasStatus(d *Data, b []byte) {
+	d.Attr["battery"] = strconv.Itoa(int(b[2])*10 + 2500)
+	d.Attr["temperature"] = strconv.Itoa(int(int8(b[3])))
+}
@@ -0,0 +1,163 @@
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The irnas samples are built field by field from the layouts in the irnasDecode comment.
+const (
+	// lat:-1.25123 lon:36.85456 alt:1650 sat:7 hdop:1.2 ttf:23 ehpe:4 snr:9 lux:3 motion:1 time:1633168800
+	irnasSampleGPS = "3d17feff503c38007206070c1704090301a02d5861"
+	// resets:1 errors:0 battery:3700mV temperature:-5 uptime:48 accelerometer:1,2,-3
+	irnasSampleStatus = "010078fb300102fd"
+	// -1.25,36.85 at 1633168800, -1.2501,36.8501 at 1633169700 and a record without a fix at 1633170600
+	irnasSampleLocations = "b817feff883a3800a02d5861" + "ae17feff923a380024315861" + "0000000000000000a8345861"
+	// battery:3500mV temperature:25 and -1.252,36.852 at 1633170000
+	irnasSampleStatusGPS = "0000641902000040" + "f016feff503b380050325861"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestIrnasDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		fPort    uint8
+		payload  string
+		expected []Data
+	}{
+		{
+			name:    "gps",
+			fPort:   irnasPortGPS,
+			payload: irnasSampleGPS,
+			expected: []Data{{
+				Lat: -1.25123, Lon: 36.85456, Time: 1633168800, Valid: true, Hdop: 1.2, Motion: true,
+				Attr: map[string]string{"alt": "1650", "sat": "7", "ehpe": "4"},
+			}},
+		},
+		{
+			name:    "gps without motion",
+			fPort:   irnasPortGPS,
+			payload: irnasSampleGPS[:32] + "00" + irnasSampleGPS[34:],
+			expected: []Data{{
+				Lat: -1.25123, Lon: 36.85456, Time: 1633168800, Valid: true, Hdop: 1.2,
+				Attr: map[string]string{"alt": "1650", "sat": "7", "ehpe": "4"},
+			}},
+		},
+		{
+			name:     "status",
+			fPort:    irnasPortStatus,
+			payload:  irnasSampleStatus,
+			expected: []Data{{Attr: map[string]string{"battery": "3700", "temperature": "-5"}}},
+		},
+		{
+			name:    "locations",
+			fPort:   irnasPortLocations,
+			payload: irnasSampleLocations,
+			expected: []Data{
+				{Lat: -1.25, Lon: 36.85, Time: 1633168800, Valid: true, Attr: map[string]string{}},
+				{Lat: -1.2501, Lon: 36.8501, Time: 1633169700, Valid: true, Attr: map[string]string{}},
+				{Time: 1633170600, Attr: map[string]string{}},
+			},
+		},
+		{
+			name:    "status with gps",
+			fPort:   irnasPortStatusGPS,
+			payload: irnasSampleStatusGPS,
+			expected: []Data{{
+				Lat: -1.252, Lon: 36.852, Time: 1633170000, Valid: true,
+				Attr: map[string]string{"battery": "3500", "temperature": "25"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := irnasDecode(tt.fPort, mustHex(t, tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != len(tt.expected) {
+				t.Fatalf("points got:%v expected:%v", len(points), len(tt.expected))
+			}
+			for i, e := range tt.expected {
+				p := points[i]
+				if p.Lat != e.Lat || p.Lon != e.Lon || p.Time != e.Time || p.Valid != e.Valid || p.Hdop != e.Hdop || p.Motion != e.Motion {
+					t.Errorf("point:%v got:%+v expected:%+v", i, p, e)
+				}
+				if len(p.Attr) != len(e.Attr) {
+					t.Errorf("point:%v attrs got:%v expected:%v", i, p.Attr, e.Attr)
+				}
+				checkAttrs(t, p, e.Attr)
+			}
+		})
+	}
+}
+
+func TestIrnasDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fPort   uint8
+		payload string
+		err     string
+	}{
+		{name: "truncated gps", fPort: irnasPortGPS, payload: irnasSampleGPS[:40], err: "invalid gps payload length:20 expected:21"},
+		{name: "gps with an extra byte", fPort: irnasPortGPS, payload: irnasSampleGPS + "00", err: "invalid gps payload length:22 expected:21"},
+		{name: "truncated status", fPort: irnasPortStatus, payload: irnasSampleStatus[:14], err: "invalid status payload length:7 expected:8"},
+		{name: "empty locations", fPort: irnasPortLocations, err: "invalid locations payload length:0"},
+		{name: "truncated locations record", fPort: irnasPortLocations, payload: irnasSampleLocations[:46], err: "invalid locations payload length:23 expected multiple of:12"},
+		{name: "truncated status with gps", fPort: irnasPortStatusGPS, payload: irnasSampleStatusGPS[:38], err: "invalid status payload length:19 expected:20"},
+		{name: "status port length on the status with gps port", fPort: irnasPortStatusGPS, payload: irnasSampleStatus, err: "invalid status payload length:8 expected:20"},
+		{name: "unknown port", fPort: 3, payload: irnasSampleStatus, err: "unsuported fport:3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := irnasDecode(tt.fPort, mustHex(t, tt.payload))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
+
+// TestIrnasCodecFallback checks that the codec object is used only when the binary payload can't be decoded.
+func TestIrnasCodecFallback(t *testing.T) {
+	object := map[string]interface{}{"lat": -1.3, "lon": 36.9, "hdop": 2.5, "gps_time": 1633168800.0}
+
+	tests := []struct {
+		name    string
+		payload string
+		object  map[string]interface{}
+		lat     float64
+		err     string
+	}{
+		{name: "binary payload before the object", payload: irnasSampleGPS, object: object, lat: -1.25123},
+		{name: "truncated binary payload with an object", payload: irnasSampleGPS[:40], object: object, lat: -1.3},
+		{name: "only the object", object: object, lat: -1.3},
+		{name: "truncated binary payload without an object", payload: irnasSampleGPS[:40], err: "decoding the binary payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := Irnas(&DataUpPayload{FPort: irnasPortGPS, Data: mustHex(t, tt.payload), Object: tt.object})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error got:%v expected:%v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != 1 || points[0].Lat != tt.lat {
+				t.Fatalf("points got:%+v expected lat:%v", points, tt.lat)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package device
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeProtobuf decodes a chirpstack v3 integration.UplinkEvent
+// as encoded by the "Protobuf" marshaler.
+// Only the fields used by the receiver are decoded and the rest are skipped.
+//
+// integration.UplinkEvent fields:
+//
+//	1 application_id uint64, 2 application_name string, 3 device_name string,
+//	4 dev_eui bytes, 5 rx_info repeated gw.UplinkRXInfo, 6 tx_info gw.UplinkTXInfo,
+//	7 adr bool, 8 dr uint32, 9 f_cnt uint32, 10 f_port uint32, 11 data bytes,
+//	12 object_json string, 13 tags map<string, string>, 18 device_profile_name string.
+func decodeProtobuf(c []byte) (*DataUpPayload, error) {
+	data := &DataUpPayload{}
+	err := protoRange(c, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			data.ApplicationID = strconv.FormatUint(v, 10)
+		case 2:
+			data.ApplicationName = string(b)
+		case 3:
+			data.DeviceName = string(b)
+		case 4:
+			return errors.Wrap(copyEUI(&data.DevEUI, b), "dev_eui")
+		case 5:
+			rxInfo, err := decodeProtobufRXInfo(b)
+			if err != nil {
+				return errors.Wrap(err, "rx_info")
+			}
+			data.RXInfo = append(data.RXInfo, *rxInfo)
+		case 6:
+			// gw.UplinkTXInfo: 1 frequency uint32.
+			return protoRange(b, func(num protowire.Number, v uint64, b []byte) error {
+				if num == 1 {
+					data.TXInfo.Frequency = int(v)
+				}
+				return nil
+			})
+		case 7:
+			data.ADR = protowire.DecodeBool(v)
+		case 8:
+			data.TXInfo.DR = int(v)
+		case 9:
+			data.FCnt = uint32(v)
+		case 10:
+			data.FPort = uint8(v)
+		case 11:
+			data.Data = append([]byte{}, b...)
+		case 12:
+			return decodeObjectJSON(data, string(b))
+		case 13:
+			// Map entries: 1 key string, 2 value string.
+			var key, value string
+			err := protoRange(b, func(num protowire.Number, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					key = string(b)
+				case 2:
+					value = string(b)
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrap(err, "tags")
+			}
+			if data.Tags == nil {
+				data.Tags = make(map[string]string)
+			}
+			data.Tags[key] = value
+		case 18:
+			data.DeviceProfileName = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshaling protobuf")
+	}
+	return data, nil
+}
+
+// decodeProtobufRXInfo decodes a gw.UplinkRXInfo.
+//
+// gw.UplinkRXInfo fields:
+//
+//	1 gateway_id bytes, 2 time google.protobuf.Timestamp, 5 rssi int32,
+//	6 lora_snr double, 11 location common.Location.
+func decodeProtobufRXInfo(c []byte) (*RXInfo, error) {
+	rxInfo := &RXInfo{}
+	err := protoRange(c, func(num protowire.Number, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			return errors.Wrap(copyEUI(&rxInfo.GatewayID, b), "gateway_id")
+		case 2:
+			// google.protobuf.Timestamp: 1 seconds int64, 2 nanos int32.
+			var sec, nsec int64
+			err := protoRange(b, func(num protowire.Number, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					sec = int64(v)
+				case 2:
+					nsec = int64(int32(v))
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Wrap(err, "time")
+			}
+			t := time.Unix(sec, nsec).UTC()
+			rxInfo.Time = &t
+		case 5:
+			rxInfo.RSSI = int(int32(v))
+		case 6:
+			rxInfo.LoRaSNR = math.Float64frombits(v)
+		case 11:
+			// common.Location: 1 latitude double, 2 longitude double, 3 altitude double.
+			rxInfo.Location = &Location{}
+			return protoRange(b, func(num protowire.Number, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					rxInfo.Location.Latitude = math.Float64frombits(v)
+				case 2:
+					rxInfo.Location.Longitude = math.Float64frombits(v)
+				case 3:
+					rxInfo.Location.Altitude = math.Float64frombits(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rxInfo, nil
+}
+
+// protoRange calls fn for each field of a protobuf message.
+// Varint and fixed size values are passed in v and
+// length delimited values in b.
+func protoRange(c []byte, fn func(num protowire.Number, v uint64, b []byte) error) error {
+	for len(c) > 0 {
+		num, typ, n := protowire.ConsumeTag(c)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		c = c[n:]
+
+		var v uint64
+		var b []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(c)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(c)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(c)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(c)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, c)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		c = c[n:]
+
+		if err := fn(num, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
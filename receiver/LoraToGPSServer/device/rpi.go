@@ -0,0 +1,91 @@
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The binary format of the Rpi GPSSender.
+// The legacy format is an ascii "lat,lon[,s]" string
+// so it always starts with a digit or a minus sign
+// and never with the version byte.
+//
+//	0 version, 1 flags, 2-5 lat int32 degrees*1e7, 6-9 lon int32 degrees*1e7,
+//	followed by the optional fields set in the flags in this order:
+//	hdop uint8 *10, satellites uint8, altitude int16 meters.
+//
+// All values are little endian.
+// There are no speed and course fields because the sender reads only the GGA sentences
+// so the speed is always computed from the history of the device.
+const (
+	RpiVersion1 = 0x01
+
+	RpiFlagHdop       = 1 << 0
+	RpiFlagSatellites = 1 << 1
+	RpiFlagAltitude   = 1 << 2
+	RpiFlagSingle     = 1 << 7
+
+	rpiFlags = RpiFlagHdop | RpiFlagSatellites | RpiFlagAltitude | RpiFlagSingle
+
+	rpiCoordinateUnit = 1e7
+	rpiLenHeader      = 10
+)
+
+// rpiBinary decodes the binary format of the Rpi GPSSender.
+func rpiBinary(b []byte) ([]*Data, error) {
+	if len(b) < rpiLenHeader {
+		return nil, fmt.Errorf("invalid payload length:%v expected at least:%v", len(b), rpiLenHeader)
+	}
+	if b[0] != RpiVersion1 {
+		return nil, fmt.Errorf("unsuported payload version:%v", b[0])
+	}
+	flags := b[1]
+	if flags&^rpiFlags != 0 {
+		return nil, fmt.Errorf("unsuported payload flags:%08b", flags)
+	}
+
+	d := &Data{
+		Lat:    float64(int32(binary.LittleEndian.Uint32(b[2:6]))) / rpiCoordinateUnit,
+		Lon:    float64(int32(binary.LittleEndian.Uint32(b[6:10]))) / rpiCoordinateUnit,
+		Attr:   map[string]string{},
+		Valid:  true,
+		Time:   time.Now().Unix(),
+		Motion: true,
+	}
+	if d.Lat < -90 || d.Lat > 90 {
+		return nil, errors.New("latitude outside acceptable values")
+	}
+	if d.Lon < -180 || d.Lon > 180 {
+		return nil, errors.New("longitude outside acceptable values")
+	}
+
+	b = b[rpiLenHeader:]
+	for _, f := range []struct {
+		flag  byte
+		size  int
+		parse func(b []byte)
+	}{
+		{RpiFlagHdop, 1, func(b []byte) { d.Hdop = float64(b[0]) / 10 }},
+		{RpiFlagSatellites, 1, func(b []byte) { d.Attr["sat"] = strconv.Itoa(int(b[0])) }},
+		{RpiFlagAltitude, 2, func(b []byte) { d.Attr["alt"] = strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))) }},
+	} {
+		if flags&f.flag == 0 {
+			continue
+		}
+		if len(b) < f.size {
+			return nil, fmt.Errorf("payload too short for the fields in flags:%08b", flags)
+		}
+		f.parse(b[:f.size])
+		b = b[f.size:]
+	}
+
+	if flags&RpiFlagSingle != 0 {
+		d.Attr["s"] = "true"
+	}
+
+	return []*Data{d}, nil
+}
@@ -0,0 +1,121 @@
+package device
+
+import (
+	"strings"
+	"testing"
+)
+
+// The binary samples are the same as the ones encoded in sender/GPSSender/payload_test.go
+// so that together the two tests check the round trip of the format.
+const (
+	// -1.2512345,36.8545678 hdop:1.2 satellites:7 altitude:1650
+	rpiSampleTrack = "0107a71341ff8e8ff7150c077206"
+	// The same fix as a single point.
+	rpiSampleSingle = "0187a71341ff8e8ff7150c077206"
+	// -89.9999999,-179.9999999 hdop:25.5 satellites:255 altitude:-420
+	rpiSampleLimits = "010701175bca012eb694ffff5cfe"
+)
+
+func TestRpi(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		lat, lon float64
+		hdop     float64
+		attrs    map[string]string
+	}{
+		{
+			name:    "binary track point",
+			payload: rpiSampleTrack,
+			lat:     -1.2512345, lon: 36.8545678, hdop: 1.2,
+			attrs: map[string]string{"sat": "7", "alt": "1650"},
+		},
+		{
+			name:    "binary single point",
+			payload: rpiSampleSingle,
+			lat:     -1.2512345, lon: 36.8545678, hdop: 1.2,
+			attrs: map[string]string{"sat": "7", "alt": "1650", "s": "true"},
+		},
+		{
+			name:    "binary limits",
+			payload: rpiSampleLimits,
+			lat:     -89.9999999, lon: -179.9999999, hdop: 25.5,
+			attrs: map[string]string{"sat": "255", "alt": "-420"},
+		},
+		{
+			name:    "binary without the optional fields",
+			payload: "0100" + rpiSampleTrack[4:20],
+			lat:     -1.2512345, lon: 36.8545678,
+			attrs: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := Rpi(string(mustHex(t, tt.payload)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := points[0]
+			if len(points) != 1 || p.Lat != tt.lat || p.Lon != tt.lon || p.Hdop != tt.hdop || !p.Valid {
+				t.Fatalf("points got:%+v", points)
+			}
+			// The format has no speed so it is always computed from the history.
+			if p.Speed != 0 {
+				t.Errorf("speed got:%v expected:0", p.Speed)
+			}
+			if len(p.Attr) != len(tt.attrs) {
+				t.Errorf("attrs got:%v expected:%v", p.Attr, tt.attrs)
+			}
+			checkAttrs(t, p, tt.attrs)
+		})
+	}
+}
+
+func TestRpiLegacy(t *testing.T) {
+	tests := []struct {
+		payload  string
+		lat, lon float64
+		single   bool
+	}{
+		{payload: "-1.2512345,36.8545678", lat: -1.2512345, lon: 36.8545678},
+		{payload: "-1.25, 36.85,s", lat: -1.25, lon: 36.85, single: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			points, err := Rpi(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := points[0]
+			if p.Lat != tt.lat || p.Lon != tt.lon || (p.Attr["s"] == "true") != tt.single {
+				t.Errorf("point got:%+v", p)
+			}
+		})
+	}
+}
+
+func TestRpiErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		err     string
+	}{
+		{name: "truncated header", payload: rpiSampleTrack[:18], err: "invalid payload length:9 expected at least:10"},
+		{name: "truncated altitude", payload: rpiSampleTrack[:26], err: "payload too short for the fields in flags:00000111"},
+		{name: "speed flag of the earlier format", payload: "010f" + rpiSampleTrack[4:], err: "unsuported payload flags:00001111"},
+		{name: "latitude outside the range", payload: "0100" + "809a3d36" + rpiSampleTrack[12:20], err: "latitude outside acceptable values"},
+		{name: "legacy without a longitude", payload: "-1.25", err: "parsing the cordinates string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := tt.payload
+			if tt.payload[0] == '0' {
+				payload = string(mustHex(t, tt.payload))
+			}
+			_, err := Rpi(payload)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package device
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AlarmMortality is set when a device stays in one place
+// because the animal died or the collar dropped off.
+const AlarmMortality = "mortality"
+
+// AttrStationary is true while the mortality alarm is active and
+// false otherwise for the devices with a stationary profile.
+const AttrStationary = "stationary"
+
+// SetStationary sets the mortality detection profiles per species.
+func (self *Manager) SetStationary(profiles map[string]config.Stationary) error {
+	for species, p := range profiles {
+		if p.Radius <= 0 || p.Duration <= 0 {
+			return errors.Errorf("stationary profile:%v requires a radius and a duration", species)
+		}
+	}
+	self.mtx.Lock()
+	defer self.mtx.Unlock()
+	self.stationary = profiles
+	return nil
+}
+
+// stationaryState is where a device has stayed since the last movement.
+type stationaryState struct {
+	lat, lon float64
+	since    int64
+	last     int64
+	alarm    bool
+}
+
+// checkStationary raises the mortality alarm when all fixes since the first fix
+// of the current place are within the profile radius for longer than its duration
+// and none has a motion flag. A motion flag or a fix outside the radius clears it.
+// Expects the manager lock to be held.
+func (self *Manager) checkStationary(data *Data) {
+	if len(self.stationary) == 0 {
+		return
+	}
+	var species string
+	if data.Payload != nil {
+		species = data.Payload.Tags["species"]
+	}
+	profile, ok := self.stationary[species]
+	if !ok {
+		profile, ok = self.stationary[filterDefault]
+	}
+	if !ok {
+		return
+	}
+
+	state, known := self.stationaryStates[data.ID]
+	if known && data.Valid && data.Time < state.last {
+		// An older fix from a locations log doesn't change the current place.
+		data.setAttr(AttrStationary, strconv.FormatBool(state.alarm))
+		return
+	}
+
+	moved := data.Motion
+	if data.Valid && known && !moved {
+		km, err := Distance(state.lat, state.lon, data.Lat, data.Lon, "K")
+		moved = err != nil || km*1000 > profile.Radius
+	}
+
+	switch {
+	case !known && !data.Valid:
+		return
+	case !known || moved:
+		if known && state.alarm {
+			log.Printf("mortality alarm cleared devID:%v lat:%v lon:%v", data.ID, data.Lat, data.Lon)
+		}
+		if !data.Valid {
+			// A motion flag without a fix starts a new place with the next fix.
+			delete(self.stationaryStates, data.ID)
+			self.metrics.stationary.With(prometheus.Labels{"dev_id": data.ID}).Set(0)
+			data.setAttr(AttrStationary, "false")
+			return
+		}
+		state = &stationaryState{lat: data.Lat, lon: data.Lon, since: data.Time}
+		self.stationaryStates[data.ID] = state
+	case !data.Valid:
+		data.setAttr(AttrStationary, strconv.FormatBool(state.alarm))
+		return
+	}
+
+	state.last = data.Time
+	if !state.alarm && time.Duration(state.last-state.since)*time.Second >= time.Duration(profile.Duration) {
+		state.alarm = true
+		data.addAlarm(AlarmMortality)
+		self.metrics.mortalityAlarms.With(prometheus.Labels{"dev_id": data.ID}).Inc()
+		log.Printf("mortality alarm devID:%v lat:%v lon:%v stationary since:%v", data.ID, state.lat, state.lon, time.Unix(state.since, 0).UTC())
+	}
+	if state.alarm {
+		self.metrics.stationary.With(prometheus.Labels{"dev_id": data.ID}).Set(1)
+	} else {
+		self.metrics.stationary.With(prometheus.Labels{"dev_id": data.ID}).Set(0)
+	}
+	data.setAttr(AttrStationary, strconv.FormatBool(state.alarm))
+}
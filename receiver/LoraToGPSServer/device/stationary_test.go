@@ -0,0 +1,127 @@
+package device
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCheckStationary(t *testing.T) {
+	hour := int64(3600)
+	moving := func(p *Data) *Data {
+		p.Motion = true
+		return p
+	}
+	profiles := map[string]config.Stationary{
+		filterDefault: {Radius: 100, Duration: config.Duration(2 * time.Hour)},
+		"elephant":    {Radius: 500, Duration: config.Duration(6 * time.Hour)},
+	}
+
+	type step struct {
+		name       string
+		point      *Data
+		alarm      string
+		stationary string
+	}
+	tests := []struct {
+		name     string
+		species  string
+		profiles map[string]config.Stationary
+		steps    []step
+	}{
+		{
+			name:    "raise and clear on motion",
+			species: "lion",
+			steps: []step{
+				{name: "first fix", point: at(0, 0, t0), stationary: "false"},
+				{name: "within the radius", point: at(50, 0, t0+hour), stationary: "false"},
+				{name: "after the duration", point: at(0, 50, t0+2*hour), alarm: AlarmMortality, stationary: "true"},
+				{name: "still stationary", point: at(10, 10, t0+3*hour), stationary: "true"},
+				{name: "older fix", point: at(500, 0, t0+2*hour+1800), stationary: "true"},
+				{name: "without a fix", point: &Data{Time: t0 + 4*hour}, stationary: "true"},
+				{name: "motion", point: moving(at(0, 0, t0+5*hour)), stationary: "false"},
+				{name: "the motion fix starts a new place", point: at(0, 0, t0+6*hour), stationary: "false"},
+				{name: "after the duration from the motion fix", point: at(0, 0, t0+7*hour), alarm: AlarmMortality, stationary: "true"},
+			},
+		},
+		{
+			name:    "clear on a fix outside the radius",
+			species: "lion",
+			steps: []step{
+				{name: "first fix", point: at(0, 0, t0), stationary: "false"},
+				{name: "after the duration", point: at(0, 0, t0+2*hour), alarm: AlarmMortality, stationary: "true"},
+				{name: "outside the radius", point: at(200, 0, t0+3*hour), stationary: "false"},
+				{name: "within the radius of the new place", point: at(250, 0, t0+4*hour), stationary: "false"},
+			},
+		},
+		{
+			name:    "motion without a fix",
+			species: "lion",
+			steps: []step{
+				{name: "first fix", point: at(0, 0, t0), stationary: "false"},
+				{name: "after the duration", point: at(0, 0, t0+2*hour), alarm: AlarmMortality, stationary: "true"},
+				{name: "motion without a fix", point: &Data{Motion: true, Time: t0 + 3*hour}, stationary: "false"},
+				{name: "the next fix starts a new place", point: at(0, 0, t0+4*hour), stationary: "false"},
+			},
+		},
+		{
+			name:    "species profile",
+			species: "elephant",
+			steps: []step{
+				{name: "first fix", point: at(0, 0, t0), stationary: "false"},
+				{name: "within the species radius", point: at(300, 0, t0+3*hour), stationary: "false"},
+				{name: "after the species duration", point: at(0, 300, t0+6*hour), alarm: AlarmMortality, stationary: "true"},
+			},
+		},
+		{
+			name:     "without a profile",
+			species:  "lion",
+			profiles: map[string]config.Stationary{"elephant": profiles["elephant"]},
+			steps: []step{
+				{name: "first fix", point: at(0, 0, t0)},
+				{name: "after the duration", point: at(0, 0, t0+24*hour)},
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager()
+			p := tt.profiles
+			if p == nil {
+				p = profiles
+			}
+			if err := m.SetStationary(p); err != nil {
+				t.Fatal(err)
+			}
+
+			name := "stationary" + string(rune('a'+i))
+			for _, step := range tt.steps {
+				p := parse(t, m, name, tt.species, step.point)[0]
+				if p.Attr[AttrAlarm] != step.alarm || p.Attr[AttrStationary] != step.stationary {
+					t.Errorf("step:%v alarm got:%q expected:%q stationary got:%q expected:%q",
+						step.name, p.Attr[AttrAlarm], step.alarm, p.Attr[AttrStationary], step.stationary)
+				}
+			}
+
+			last := tt.steps[len(tt.steps)-1]
+			var expected float64
+			if last.stationary == "true" {
+				expected = 1
+			}
+			if got := testutil.ToFloat64(testMetrics.stationary.With(prometheus.Labels{"dev_id": devID(name)})); got != expected {
+				t.Errorf("stationary metric got:%v expected:%v", got, expected)
+			}
+		})
+	}
+}
+
+func TestSetStationaryErrors(t *testing.T) {
+	err := newTestManager().SetStationary(map[string]config.Stationary{"lion": {Duration: config.Duration(time.Hour)}})
+	if err == nil || !strings.Contains(err.Error(), "requires a radius and a duration") {
+		t.Fatalf("error got:%v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ParseTTN parses an uplink message webhook from The Things Stack v3.
+// The device type is taken from the "type" end device attribute and
+// when the webhook doesn't include the attributes
+// from the "type" query parameter of the webhook url.
+func (self *Manager) ParseTTN(r *http.Request) ([]*Data, error) {
+	c, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading request body")
+	}
+
+	if os.Getenv("DEBUG") == "1" {
+		log.Printf("incoming ttn request body:%v RemoteAddr:%v headers:%+v \n", string(c), r.RemoteAddr, r.Header)
+	}
+
+	data, err := DecodeTTN(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := data.Tags["type"]; !ok {
+		if devType := r.URL.Query().Get("type"); devType != "" {
+			data.Tags["type"] = devType
+		}
+	}
+
+	return self.ParsePayload(data)
+}
+
+// DecodeTTN maps a The Things Stack v3 uplink message to a DataUpPayload.
+func DecodeTTN(c []byte) (*DataUpPayload, error) {
+	msg := &ttnUplink{}
+	if err := json.Unmarshal(c, msg); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling ttn uplink message")
+	}
+	if msg.UplinkMessage == nil {
+		return nil, errors.New("the ttn message doesn't include an uplink_message")
+	}
+
+	up := msg.UplinkMessage
+	data := &DataUpPayload{
+		ApplicationID:   msg.EndDeviceIDs.ApplicationIDs.ApplicationID,
+		ApplicationName: msg.EndDeviceIDs.ApplicationIDs.ApplicationID,
+		DeviceName:      msg.EndDeviceIDs.DeviceID,
+		FCnt:            up.FCnt,
+		FPort:           up.FPort,
+		Data:            up.FRMPayload,
+		Object:          up.DecodedPayload,
+		Tags:            make(map[string]string),
+	}
+
+	if msg.EndDeviceIDs.DevEUI != "" {
+		if err := data.DevEUI.UnmarshalText([]byte(msg.EndDeviceIDs.DevEUI)); err != nil {
+			return nil, errors.Wrapf(err, "parsing dev_eui:%v", msg.EndDeviceIDs.DevEUI)
+		}
+	}
+
+	if up.Settings.Frequency != "" {
+		freq, err := strconv.Atoi(up.Settings.Frequency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing frequency:%v", up.Settings.Frequency)
+		}
+		data.TXInfo.Frequency = freq
+	}
+
+	for n, v := range msg.Attributes {
+		data.Tags[n] = v
+	}
+	for n, v := range up.Attributes {
+		data.Tags[n] = v
+	}
+
+	for _, rx := range up.RXMetadata {
+		rxInfo := RXInfo{
+			Name:     rx.GatewayIDs.GatewayID,
+			Time:     rx.Time,
+			RSSI:     rx.RSSI,
+			LoRaSNR:  rx.SNR,
+			Location: rx.Location,
+		}
+		// Gateways received through packet broker don't have an EUI.
+		if rx.GatewayIDs.EUI != "" {
+			if err := rxInfo.GatewayID.UnmarshalText([]byte(rx.GatewayIDs.EUI)); err != nil {
+				return nil, errors.Wrapf(err, "parsing gateway eui:%v", rx.GatewayIDs.EUI)
+			}
+		}
+		data.RXInfo = append(data.RXInfo, rxInfo)
+	}
+
+	return data, nil
+}
+
+// ttnUplink is a The Things Stack v3 uplink message webhook.
+type ttnUplink struct {
+	EndDeviceIDs struct {
+		DeviceID       string `json:"device_id"`
+		ApplicationIDs struct {
+			ApplicationID string `json:"application_id"`
+		} `json:"application_ids"`
+		DevEUI string `json:"dev_eui"`
+	} `json:"end_device_ids"`
+	ReceivedAt    *time.Time        `json:"received_at,omitempty"`
+	Attributes    map[string]string `json:"attributes,omitempty"`
+	UplinkMessage *struct {
+		FPort          uint8                  `json:"f_port"`
+		FCnt           uint32                 `json:"f_cnt"`
+		FRMPayload     []byte                 `json:"frm_payload"`
+		DecodedPayload map[string]interface{} `json:"decoded_payload,omitempty"`
+		Attributes     map[string]string      `json:"attributes,omitempty"`
+		RXMetadata     []struct {
+			GatewayIDs struct {
+				GatewayID string `json:"gateway_id"`
+				EUI       string `json:"eui"`
+			} `json:"gateway_ids"`
+			Time     *time.Time `json:"time,omitempty"`
+			RSSI     int        `json:"rssi"`
+			SNR      float64    `json:"snr"`
+			Location *Location  `json:"location,omitempty"`
+		} `json:"rx_metadata"`
+		Settings struct {
+			Frequency string `json:"frequency"`
+		} `json:"settings"`
+	} `json:"uplink_message"`
+}
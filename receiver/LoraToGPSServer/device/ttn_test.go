@@ -0,0 +1,242 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+)
+
+// ttsUplink is a The Things Stack v3 uplink message webhook in the layout of the TTS documentation
+// received by a gateway of the network and a gateway through packet broker.
+const ttsUplink = `{
+	"end_device_ids": {
+		"device_id": "tracker1",
+		"application_ids": { "application_id": "gps-tracker" },
+		"dev_eui": "70B3D57ED0041234",
+		"join_eui": "0000000000000000",
+		"dev_addr": "260B1234"
+	},
+	"correlation_ids": [ "as:up:01FH5QYV8TW9N0Z3D7E2QXK2M4" ],
+	"received_at": "2021-10-02T10:00:01.123456789Z",
+	"uplink_message": {
+		"session_key_id": "AXxKk0JdVf3XgPpG6nM2rQ==",
+		"f_port": 1,
+		"f_cnt": 42,
+		"frm_payload": "LTEuMjUsMzYuODU=",
+		"decoded_payload": { "lat": -1.25, "lon": 36.85 },
+		"rx_metadata": [
+			{
+				"gateway_ids": { "gateway_id": "eui-b827ebfffe6c1234", "eui": "B827EBFFFE6C1234" },
+				"time": "2021-10-02T10:00:00.987654Z",
+				"timestamp": 2463457000,
+				"rssi": -97,
+				"channel_rssi": -97,
+				"snr": 7.25,
+				"location": { "latitude": -1.2, "longitude": 36.8, "altitude": 1650, "source": "SOURCE_REGISTRY" },
+				"uplink_token": "CiIKIAoUZXVpLWI4MjdlYmZmZmU2YzEyMzQ=",
+				"channel_index": 2
+			},
+			{
+				"gateway_ids": { "gateway_id": "packetbroker" },
+				"packet_broker": { "forwarder_net_id": "000013", "forwarder_tenant_id": "ttn", "forwarder_cluster_id": "eu1.cloud.thethings.network" },
+				"rssi": -112,
+				"channel_rssi": -112,
+				"snr": -4.5,
+				"uplink_token": "eyJnIjoiWlhsS2FHSkhZMmxQYVVwQ1RWUkpORkl3VGs1VE1XTnBURU5LYkdKdFRXbFBhVXBDVFZSSk5GSXdUazVKYVhkcFlWaFphVTlwU21oa"
+			}
+		],
+		"settings": {
+			"data_rate": { "lora": { "bandwidth": 125000, "spreading_factor": 7 } },
+			"coding_rate": "4/5",
+			"frequency": "868100000",
+			"timestamp": 2463457000,
+			"time": "2021-10-02T10:00:00.987654Z"
+		},
+		"received_at": "2021-10-02T10:00:01.012345678Z",
+		"consumed_airtime": "0.061696s",
+		"network_ids": { "net_id": "000013", "tenant_id": "ttn", "cluster_id": "eu1", "cluster_address": "eu1.cloud.thethings.network" }
+	}
+}`
+
+// ttsMessage returns the sample uplink message changed by f.
+func ttsMessage(t *testing.T, f func(msg map[string]interface{})) []byte {
+	t.Helper()
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(ttsUplink), &msg); err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		f(msg)
+	}
+	c, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func uplinkMessage(msg map[string]interface{}) map[string]interface{} {
+	return msg["uplink_message"].(map[string]interface{})
+}
+
+func TestDecodeTTN(t *testing.T) {
+	data, err := DecodeTTN([]byte(ttsUplink))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.DeviceName != "tracker1" || data.ApplicationID != "gps-tracker" || data.ApplicationName != "gps-tracker" {
+		t.Errorf("ids got device:%v application:%v name:%v", data.DeviceName, data.ApplicationID, data.ApplicationName)
+	}
+	if data.DevEUI != (lorawan.EUI64{0x70, 0xb3, 0xd5, 0x7e, 0xd0, 0x04, 0x12, 0x34}) {
+		t.Errorf("DevEUI got:%v", data.DevEUI)
+	}
+	if data.FCnt != 42 || data.FPort != 1 || string(data.Data) != "-1.25,36.85" {
+		t.Errorf("got fCnt:%v fPort:%v data:%q", data.FCnt, data.FPort, data.Data)
+	}
+	if data.Object["lat"] != -1.25 || data.Object["lon"] != 36.85 {
+		t.Errorf("object got:%v", data.Object)
+	}
+	if data.TXInfo.Frequency != 868100000 {
+		t.Errorf("frequency got:%v", data.TXInfo.Frequency)
+	}
+	if len(data.Tags) != 0 {
+		t.Errorf("tags got:%v", data.Tags)
+	}
+
+	if len(data.RXInfo) != 2 {
+		t.Fatalf("rxInfo got:%v expected:2", len(data.RXInfo))
+	}
+	gw := data.RXInfo[0]
+	if gw.GatewayID != (lorawan.EUI64{0xb8, 0x27, 0xeb, 0xff, 0xfe, 0x6c, 0x12, 0x34}) || gw.Name != "eui-b827ebfffe6c1234" ||
+		gw.RSSI != -97 || gw.LoRaSNR != 7.25 || gw.Time == nil {
+		t.Errorf("gateway got:%+v", gw)
+	}
+	if gw.Location == nil || gw.Location.Latitude != -1.2 || gw.Location.Longitude != 36.8 || gw.Location.Altitude != 1650 {
+		t.Errorf("gateway location got:%+v", gw.Location)
+	}
+	// The packet broker gateways have no EUI, time or location.
+	pb := data.RXInfo[1]
+	if pb.GatewayID != (lorawan.EUI64{}) || pb.Name != "packetbroker" || pb.RSSI != -112 || pb.LoRaSNR != -4.5 || pb.Time != nil || pb.Location != nil {
+		t.Errorf("packet broker gateway got:%+v", pb)
+	}
+}
+
+func TestDecodeTTNWithoutDevEUI(t *testing.T) {
+	c := ttsMessage(t, func(msg map[string]interface{}) {
+		delete(msg["end_device_ids"].(map[string]interface{}), "dev_eui")
+	})
+	data, err := DecodeTTN(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.DevEUI != (lorawan.EUI64{}) {
+		t.Errorf("DevEUI got:%v expected zero", data.DevEUI)
+	}
+	if id := GenID(data); id != "tracker1-0000000000000000" {
+		t.Errorf("ID got:%v", id)
+	}
+}
+
+func TestDecodeTTNErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []byte
+		err  string
+	}{
+		{name: "invalid json", msg: []byte(`{"end_device_ids": `), err: "unmarshaling ttn uplink message"},
+		{
+			name: "join accept message",
+			msg: ttsMessage(t, func(msg map[string]interface{}) {
+				delete(msg, "uplink_message")
+				msg["join_accept"] = map[string]interface{}{"session_key_id": "AXxKk0JdVf3XgPpG6nM2rQ=="}
+			}),
+			err: "doesn't include an uplink_message",
+		},
+		{
+			name: "invalid dev_eui",
+			msg: ttsMessage(t, func(msg map[string]interface{}) {
+				msg["end_device_ids"].(map[string]interface{})["dev_eui"] = "70B3D57E"
+			}),
+			err: "parsing dev_eui",
+		},
+		{
+			name: "invalid frequency",
+			msg: ttsMessage(t, func(msg map[string]interface{}) {
+				uplinkMessage(msg)["settings"].(map[string]interface{})["frequency"] = "868.1MHz"
+			}),
+			err: "parsing frequency",
+		},
+		{
+			name: "invalid gateway eui",
+			msg: ttsMessage(t, func(msg map[string]interface{}) {
+				gw := uplinkMessage(msg)["rx_metadata"].([]interface{})[0].(map[string]interface{})
+				gw["gateway_ids"].(map[string]interface{})["eui"] = "B827EB"
+			}),
+			err: "parsing gateway eui",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeTTN(tt.msg)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseTTNType(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		attrs      map[string]interface{}
+		uplinkAttr map[string]interface{}
+		devType    string
+		err        string
+	}{
+		{name: "type query parameter", query: "?type=rpi", devType: "rpi"},
+		{name: "end device attribute", attrs: map[string]interface{}{"type": "rpi", "species": "rhino"}, devType: "rpi"},
+		{name: "end device attribute before the query parameter", query: "?type=irnas", attrs: map[string]interface{}{"type": "rpi"}, devType: "rpi"},
+		{name: "uplink attribute before the end device attribute", attrs: map[string]interface{}{"type": "irnas"}, uplinkAttr: map[string]interface{}{"type": "rpi"}, devType: "rpi"},
+		{name: "unknown type", query: "?type=collar", err: "unsuported device type:collar"},
+		{name: "without a type", err: "doesn't include device type tags"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ttsMessage(t, func(msg map[string]interface{}) {
+				if tt.attrs != nil {
+					msg["attributes"] = tt.attrs
+				}
+				if tt.uplinkAttr != nil {
+					uplinkMessage(msg)["attributes"] = tt.uplinkAttr
+				}
+			})
+			r := httptest.NewRequest("POST", "/ttn"+tt.query, bytes.NewReader(c))
+			points, err := newTestManager().ParseTTN(r)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error got:%v expected:%v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != 1 {
+				t.Fatalf("points got:%v expected:1", len(points))
+			}
+			p := points[0]
+			if p.Type != tt.devType || p.ID != "tracker1-70b3d57ed0041234" || !p.Valid || p.Lat != -1.25 || p.Lon != 36.85 {
+				t.Errorf("point got:%+v", p)
+			}
+			if species, ok := tt.attrs["species"]; ok && p.Payload.Tags["species"] != species {
+				t.Errorf("species tag got:%v", p.Payload.Tags["species"])
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package dispatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/worker"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Sink delivers the parsed points to a remote server.
+type Sink interface {
+	Name() string
+	Send(points []*device.Data) error
+}
+
+// SinkFunc is an adapter to allow the use of ordinary functions as sinks.
+func SinkFunc(name string, send func(points []*device.Data) error) Sink {
+	return &sinkFunc{name: name, send: send}
+}
+
+type sinkFunc struct {
+	name string
+	send func(points []*device.Data) error
+}
+
+func (s *sinkFunc) Name() string {
+	return s.name
+}
+
+func (s *sinkFunc) Send(points []*device.Data) error {
+	return s.send(points)
+}
+
+// New creates a dispatcher without any sinks.
+func New(m *device.Manager) *Dispatcher {
+	return &Dispatcher{
+		devManager: m,
+		metrics:    newMetrics(),
+	}
+}
+
+// Dispatcher parses each uplink once and
+// sends the points to all enabled sinks concurrently.
+type Dispatcher struct {
+	devManager *device.Manager
+	metrics    *metrics
+	mtx        sync.RWMutex
+	sinks      []Sink
+	// pool is nil when the points are sent before replying to the ingestion request.
+	pool *worker.Pool
+}
+
+// SetPool sends the points in the background by the worker pool.
+func (d *Dispatcher) SetPool(p *worker.Pool) {
+	d.pool = p
+}
+
+// Register enables a sink.
+func (d *Dispatcher) Register(s Sink) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.sinks = append(d.sinks, s)
+}
+
+// Sinks returns the names of the enabled sinks.
+func (d *Dispatcher) Sinks() []string {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	var names []string
+	for _, s := range d.sinks {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// Result is the delivery result for a single sink.
+type Result struct {
+	Sink     string        `json:"sink"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+}
+
+// Dispatch sends the points to all sinks concurrently.
+// A failure or a panic in one sink doesn't affect the others.
+// The points of a duplicate uplink are already sent so are dropped.
+func (d *Dispatcher) Dispatch(points []*device.Data) []Result {
+	if len(points) == 0 || points[0].Duplicate {
+		return []Result{}
+	}
+
+	d.mtx.RLock()
+	sinks := d.sinks
+	d.mtx.RUnlock()
+
+	results := make([]Result, len(sinks))
+	var wg sync.WaitGroup
+	for i, s := range sinks {
+		wg.Add(1)
+		go func(i int, s Sink) {
+			defer wg.Done()
+			start := time.Now()
+			err := send(s, points)
+
+			results[i] = Result{
+				Sink:     s.Name(),
+				Duration: time.Since(start),
+			}
+			status := "success"
+			if err != nil {
+				results[i].Error = err.Error()
+				status = "error"
+				log.Printf("[error] sink:%v err:%v", s.Name(), err)
+			}
+			d.metrics.deliveries.With(prometheus.Labels{"sink": s.Name(), "status": status}).Inc()
+			d.metrics.duration.With(prometheus.Labels{"sink": s.Name()}).Observe(results[i].Duration.Seconds())
+		}(i, s)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func send(s Sink, points []*device.Data) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sink panic:%v", r)
+		}
+	}()
+	return s.Send(points)
+}
+
+// Handle dispatches the points and combines the errors of all sinks.
+// It is used by the ingestion paths which can't report per sink results.
+// With a worker pool it waits only while the queue is full
+// and the sink errors are only logged.
+func (d *Dispatcher) Handle(points []*device.Data) error {
+	if d.pool != nil {
+		return d.pool.Submit(key(points), func() { d.Dispatch(points) })
+	}
+	return d.handle(points)
+}
+
+// TryHandle is the same as Handle but with a worker pool
+// it doesn't wait when the queue is full.
+func (d *Dispatcher) TryHandle(points []*device.Data) error {
+	if d.pool != nil {
+		return d.pool.TrySubmit(key(points), func() { d.Dispatch(points) })
+	}
+	return d.handle(points)
+}
+
+// key queues the points of the same device to the same worker.
+func key(points []*device.Data) string {
+	if len(points) == 0 {
+		return ""
+	}
+	return points[0].ID
+}
+
+func (d *Dispatcher) handle(points []*device.Data) error {
+	var errs error
+	for _, r := range d.Dispatch(points) {
+		if r.Error != "" {
+			errs = multierror.Append(errs, errors.Errorf("sink:%v err:%v", r.Sink, r.Error))
+		}
+	}
+	return errs
+}
+
+// ServeHTTP is the single ingestion endpoint for the chirpstack HTTP integration.
+// It replies with the per sink results and
+// with status 502 when any of the sinks failed so that the uplink is retried.
+// With a worker pool it replies with status 202 once the points are queued
+// and with status 503 when the queue is full.
+func (d *Dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	points, err := d.devManager.Parse(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if d.pool != nil {
+		if err := d.TryHandle(points); err != nil {
+			d.devManager.Forget(points)
+			if !worker.Unavailable(w, err) {
+				httpError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	results := d.Dispatch(points)
+
+	status := http.StatusOK
+	for _, r := range results {
+		if r.Error != "" {
+			status = http.StatusBadGateway
+		}
+	}
+
+	if os.Getenv("DEBUG") == "1" {
+		log.Printf("dispatch results:%+v", results)
+	}
+
+	// The retry of a failed delivery would be dropped as a duplicate.
+	if status != http.StatusOK {
+		d.devManager.Forget(points)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(struct {
+		Results []Result `json:"results"`
+	}{results}); err != nil {
+		log.Printf("[error] writing the response err:%v", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, err string, code int) {
+	_, fn, line, _ := runtime.Caller(1)
+	log.Printf("[error] %s:%d %v", fn, line, err)
+	http.Error(w, err, code)
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		deliveries: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sink_deliveries_total",
+				Help: "The total number of point deliveries to each sink by status.",
+			},
+			[]string{"sink", "status"},
+		),
+		duration: promauto.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "sink_delivery_duration_seconds",
+				Help: "The duration of the point deliveries to each sink.",
+			},
+			[]string{"sink"},
+		),
+	}
+}
+
+type metrics struct {
+	deliveries *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+}
@@ -0,0 +1,128 @@
+package dispatcher
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+)
+
+// The manager and the metrics are shared by the tests because these can be registered only once.
+var (
+	manager     = device.NewManager()
+	testMetrics = newMetrics()
+)
+
+// fCnt is increased for every uplink because the manager records the uplinks of all test runs.
+var fCnt int
+
+func newTestDispatcher() *Dispatcher {
+	return &Dispatcher{
+		devManager: manager,
+		metrics:    testMetrics,
+	}
+}
+
+// uplink is a chirpstack v4 uplink event of a rpi tracker.
+func uplink(devEUI string, fCnt int, data string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"deviceInfo": {
+			"applicationName": "gpsTracker",
+			"deviceName": "tracker",
+			"devEui": "%v",
+			"tags": {"type": "rpi"}
+		},
+		"fCnt": %v,
+		"fPort": 1,
+		"data": "%v",
+		"rxInfo": [{"gatewayId": "0000000000000001", "rssi": -80, "snr": 5.5}]
+	}`, devEUI, fCnt, base64.StdEncoding.EncodeToString([]byte(data))))
+}
+
+func post(t *testing.T, h http.Handler, body []byte) (int, []Result) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	resp := struct {
+		Results []Result `json:"results"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, resp.Results
+}
+
+// TestServeHTTPRetry checks that the uplink of a failed delivery
+// is sent again when retried and dropped only after a successful delivery.
+func TestServeHTTPRetry(t *testing.T) {
+	d := newTestDispatcher()
+
+	var (
+		mtx   sync.Mutex
+		sent  [][]*device.Data
+		calls int
+	)
+	d.Register(SinkFunc("flaky", func(points []*device.Data) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		calls++
+		if calls == 1 {
+			return errors.New("connection refused")
+		}
+		sent = append(sent, points)
+		return nil
+	}))
+	d.Register(SinkFunc("stable", func(points []*device.Data) error { return nil }))
+
+	fCnt++
+	body := uplink("7076050000000301", fCnt, "-1.25,36.85")
+
+	tests := []struct {
+		name    string
+		status  int
+		results []Result
+		sent    int
+	}{
+		{name: "failed delivery", status: http.StatusBadGateway, results: []Result{{Sink: "flaky", Error: "connection refused"}, {Sink: "stable"}}},
+		{name: "retry", status: http.StatusOK, results: []Result{{Sink: "flaky"}, {Sink: "stable"}}, sent: 1},
+		{name: "duplicate after the delivery", status: http.StatusOK, results: []Result{}, sent: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, results := post(t, d, body)
+			if status != tt.status {
+				t.Errorf("status got:%v expected:%v", status, tt.status)
+			}
+			if len(results) != len(tt.results) {
+				t.Fatalf("results got:%+v expected:%+v", results, tt.results)
+			}
+			for i, r := range tt.results {
+				if results[i].Sink != r.Sink || results[i].Error != r.Error {
+					t.Errorf("result:%v got:%+v expected:%+v", i, results[i], r)
+				}
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if len(sent) != tt.sent {
+				t.Fatalf("sent got:%v expected:%v", len(sent), tt.sent)
+			}
+		})
+	}
+
+	if len(sent) == 0 {
+		t.Fatal("the points weren't sent")
+	}
+	if p := sent[0][0]; p.Lat != -1.25 || p.Lon != 36.85 || p.Duplicate {
+		t.Errorf("sent point got:%+v", p)
+	}
+}
@@ -0,0 +1,392 @@
+package homeRange
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	geom "github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/xy"
+)
+
+// earthRadius in meters for the local projection.
+const earthRadius = 6371008.8
+
+// DefaultGrid is the number of KDE grid cells along the longer side of the extent.
+const DefaultGrid = 200
+
+// maxGrid limits the KDE grid size and the time to estimate it.
+const maxGrid = 2000
+
+// minArea in m² and minBandwidth in meters are below the gps accuracy
+// so smaller estimates are from the fixes on a line or at the same position.
+const (
+	minArea      = 1
+	minBandwidth = 1
+)
+
+// kernelExtent is how many bandwidths around each fix are added to the KDE grid.
+const kernelExtent = 4
+
+// Fix is a stored gps fix.
+type Fix struct {
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+	Time int64   `json:"time"`
+}
+
+// Estimate is a home range polygon with its area.
+type Estimate struct {
+	Method  string
+	Percent float64
+	Polygon *geom.MultiPolygon
+	AreaKm2 float64
+	// Bandwidth is the KDE reference bandwidth in meters.
+	Bandwidth float64
+}
+
+// point is a fix in meters in a local equirectangular projection around the mean position
+// which keeps the areas accurate for the size of a home range.
+type point struct {
+	x, y float64
+}
+
+type projection struct {
+	lat0, lon0, cosLat0 float64
+}
+
+func newProjection(fixes []Fix) projection {
+	var lat, lon float64
+	for _, f := range fixes {
+		lat += f.Lat
+		lon += f.Lon
+	}
+	p := projection{lat0: lat / float64(len(fixes)), lon0: lon / float64(len(fixes))}
+	p.cosLat0 = math.Cos(p.lat0 * math.Pi / 180)
+	return p
+}
+
+func (p projection) forward(f Fix) point {
+	return point{
+		x: (f.Lon - p.lon0) * math.Pi / 180 * earthRadius * p.cosLat0,
+		y: (f.Lat - p.lat0) * math.Pi / 180 * earthRadius,
+	}
+}
+
+func (p projection) inverse(pt point) geom.Coord {
+	return geom.Coord{
+		p.lon0 + pt.x/(earthRadius*p.cosLat0)*180/math.Pi,
+		p.lat0 + pt.y/earthRadius*180/math.Pi,
+	}
+}
+
+// MCP is the minimum convex polygon of the percent of the fixes nearest to their mean position.
+func MCP(fixes []Fix, percent float64) (*Estimate, error) {
+	if percent <= 0 || percent > 100 {
+		return nil, errors.Errorf("invalid MCP percent:%v", percent)
+	}
+	proj := newProjection(fixes)
+	var pts []point
+	for _, f := range fixes {
+		pts = append(pts, proj.forward(f))
+	}
+	// The mean position is the projection origin.
+	sort.SliceStable(pts, func(i, j int) bool {
+		return pts[i].x*pts[i].x+pts[i].y*pts[i].y < pts[j].x*pts[j].x+pts[j].y*pts[j].y
+	})
+	n := int(math.Ceil(float64(len(pts)) * percent / 100))
+	pts = pts[:n]
+
+	hull := convexHull(pts)
+	// The projection rounding leaves a tiny area for the fixes on a line.
+	if len(hull) < 3 || area(hull) < minArea {
+		return nil, errors.Errorf("MCP %v%% requires at least 3 fixes which are not on a line, fixes:%v", percent, n)
+	}
+	ring := ringCoords(proj, hull)
+	return &Estimate{
+		Method:  "mcp",
+		Percent: percent,
+		Polygon: geom.NewMultiPolygon(geom.XY).MustSetCoords([][][]geom.Coord{{ring}}),
+		AreaKm2: area(hull) / 1e6,
+	}, nil
+}
+
+// convexHull returns the hull points in counter clockwise order by the monotone chain algorithm.
+func convexHull(pts []point) []point {
+	p := append([]point{}, pts...)
+	sort.Slice(p, func(i, j int) bool {
+		return p[i].x < p[j].x || (p[i].x == p[j].x && p[i].y < p[j].y)
+	})
+	if len(p) < 3 {
+		return p
+	}
+	cross := func(o, a, b point) float64 {
+		return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x)
+	}
+	var hull []point
+	for _, pt := range p {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], pt) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, pt)
+	}
+	lower := len(hull) + 1
+	for i := len(p) - 2; i >= 0; i-- {
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], p[i]) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p[i])
+	}
+	return hull[:len(hull)-1]
+}
+
+// area is the signed shoelace area which is positive for counter clockwise rings.
+func area(ring []point) float64 {
+	var a float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		a += ring[i].x*ring[j].y - ring[j].x*ring[i].y
+	}
+	return a / 2
+}
+
+// ringCoords converts a ring to closed lon,lat coordinates.
+func ringCoords(proj projection, ring []point) []geom.Coord {
+	var coords []geom.Coord
+	for _, pt := range ring {
+		coords = append(coords, proj.inverse(pt))
+	}
+	return append(coords, coords[0])
+}
+
+// KDE is the percent isopleth of the utilisation distribution estimated by
+// a bivariate normal kernel with the reference bandwidth on a grid with
+// the given number of cells along the longer side.
+func KDE(fixes []Fix, percent float64, grid int) (*Estimate, error) {
+	if percent <= 0 || percent >= 100 {
+		return nil, errors.Errorf("invalid KDE percent:%v", percent)
+	}
+	if grid < 10 || grid > maxGrid {
+		return nil, errors.Errorf("the KDE grid should be between 10 and %v cells got:%v", maxGrid, grid)
+	}
+	if len(fixes) < 5 {
+		return nil, errors.Errorf("KDE requires at least 5 fixes got:%v", len(fixes))
+	}
+
+	proj := newProjection(fixes)
+	pts := make([]point, len(fixes))
+	var varX, varY float64
+	for i, f := range fixes {
+		pts[i] = proj.forward(f)
+		varX += pts[i].x * pts[i].x
+		varY += pts[i].y * pts[i].y
+	}
+	n := float64(len(pts))
+	h := math.Sqrt((varX/(n-1)+varY/(n-1))/2) * math.Pow(n, -1.0/6)
+	if h < minBandwidth {
+		return nil, errors.New("KDE requires fixes at more than one position")
+	}
+
+	minX, minY, maxX, maxY := pts[0].x, pts[0].y, pts[0].x, pts[0].y
+	for _, pt := range pts {
+		minX, maxX = math.Min(minX, pt.x), math.Max(maxX, pt.x)
+		minY, maxY = math.Min(minY, pt.y), math.Max(maxY, pt.y)
+	}
+	minX, minY = minX-kernelExtent*h, minY-kernelExtent*h
+	maxX, maxY = maxX+kernelExtent*h, maxY+kernelExtent*h
+	cell := math.Max(maxX-minX, maxY-minY) / float64(grid)
+	cols := int(math.Ceil((maxX-minX)/cell)) + 1
+	rows := int(math.Ceil((maxY-minY)/cell)) + 1
+
+	// The density at the cell centers with the kernel truncated at the extent.
+	density := make([]float64, cols*rows)
+	reach := int(math.Ceil(kernelExtent * h / cell))
+	for _, pt := range pts {
+		c0 := int((pt.x - minX) / cell)
+		r0 := int((pt.y - minY) / cell)
+		for r := max(r0-reach, 0); r <= min(r0+reach, rows-1); r++ {
+			cy := minY + (float64(r)+0.5)*cell
+			for c := max(c0-reach, 0); c <= min(c0+reach, cols-1); c++ {
+				cx := minX + (float64(c)+0.5)*cell
+				d2 := (cx-pt.x)*(cx-pt.x) + (cy-pt.y)*(cy-pt.y)
+				density[r*cols+c] += math.Exp(-d2 / (2 * h * h))
+			}
+		}
+	}
+
+	// The isopleth includes the densest cells up to the percent of the volume.
+	order := make([]int, len(density))
+	var total float64
+	for i, d := range density {
+		order[i] = i
+		total += d
+	}
+	sort.Slice(order, func(i, j int) bool { return density[order[i]] > density[order[j]] })
+	mask := make([]bool, len(density))
+	var sum float64
+	var cells int
+	for _, i := range order {
+		if sum >= total*percent/100 {
+			break
+		}
+		sum += density[i]
+		mask[i] = true
+		cells++
+	}
+
+	polygon, err := maskPolygons(proj, mask, cols, rows, minX, minY, cell)
+	if err != nil {
+		return nil, err
+	}
+	return &Estimate{
+		Method:    "kde",
+		Percent:   percent,
+		Polygon:   polygon,
+		AreaKm2:   float64(cells) * cell * cell / 1e6,
+		Bandwidth: h,
+	}, nil
+}
+
+// vertex is a grid corner.
+type vertex struct {
+	c, r int
+}
+
+// maskPolygons traces the outlines of the grid cells in the mask
+// into polygons with the outer rings counter clockwise and the holes clockwise.
+func maskPolygons(proj projection, mask []bool, cols, rows int, minX, minY, cell float64) (*geom.MultiPolygon, error) {
+	in := func(c, r int) bool {
+		return c >= 0 && r >= 0 && c < cols && r < rows && mask[r*cols+c]
+	}
+	// The directed boundary edges keep the mask on the left side.
+	edges := make(map[vertex][]vertex)
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
+			if !in(c, r) {
+				continue
+			}
+			if !in(c, r-1) {
+				edges[vertex{c, r}] = append(edges[vertex{c, r}], vertex{c + 1, r})
+			}
+			if !in(c+1, r) {
+				edges[vertex{c + 1, r}] = append(edges[vertex{c + 1, r}], vertex{c + 1, r + 1})
+			}
+			if !in(c, r+1) {
+				edges[vertex{c + 1, r + 1}] = append(edges[vertex{c + 1, r + 1}], vertex{c, r + 1})
+			}
+			if !in(c-1, r) {
+				edges[vertex{c, r + 1}] = append(edges[vertex{c, r + 1}], vertex{c, r})
+			}
+		}
+	}
+
+	var outers, holes [][]point
+	for len(edges) > 0 {
+		var start vertex
+		for v := range edges {
+			start = v
+			break
+		}
+		var ring []vertex
+		prev, cur := start, start
+		// Each vertex has as many incoming as outgoing edges so the walk returns to the start.
+		for {
+			next := nextVertex(prev, cur, edges[cur])
+			removeEdge(edges, cur, next)
+			ring = append(ring, cur)
+			prev, cur = cur, next
+			if cur == start {
+				break
+			}
+		}
+
+		var pts []point
+		for i, v := range ring {
+			// Skip the vertices on a straight line.
+			p := ring[(i+len(ring)-1)%len(ring)]
+			n := ring[(i+1)%len(ring)]
+			if (n.c-v.c)*(v.r-p.r) == (n.r-v.r)*(v.c-p.c) {
+				continue
+			}
+			pts = append(pts, point{x: minX + float64(v.c)*cell, y: minY + float64(v.r)*cell})
+		}
+		if area(pts) > 0 {
+			outers = append(outers, pts)
+		} else {
+			holes = append(holes, pts)
+		}
+	}
+	if len(outers) == 0 {
+		return nil, errors.New("the KDE isopleth is empty")
+	}
+
+	// Each hole belongs to the smallest outer ring which contains it.
+	polygons := make([][][]geom.Coord, len(outers))
+	flat := make([][]float64, len(outers))
+	for i, o := range outers {
+		polygons[i] = [][]geom.Coord{ringCoords(proj, o)}
+		for _, pt := range o {
+			flat[i] = append(flat[i], pt.x, pt.y)
+		}
+		flat[i] = append(flat[i], o[0].x, o[0].y)
+	}
+	for _, hole := range holes {
+		best := -1
+		for i, o := range outers {
+			if xy.IsPointInRing(geom.XY, geom.Coord{hole[0].x, hole[0].y}, flat[i]) &&
+				(best == -1 || area(o) < area(outers[best])) {
+				best = i
+			}
+		}
+		if best == -1 {
+			return nil, errors.New("the KDE isopleth has a hole outside of all rings")
+		}
+		polygons[best] = append(polygons[best], ringCoords(proj, hole))
+	}
+	return geom.NewMultiPolygon(geom.XY).SetCoords(polygons)
+}
+
+// nextVertex picks the left most turn at the corners where
+// two cells touch diagonally so that these are traced as separate rings.
+func nextVertex(prev, cur vertex, out []vertex) vertex {
+	if len(out) == 1 {
+		return out[0]
+	}
+	dc, dr := cur.c-prev.c, cur.r-prev.r
+	for _, o := range out {
+		// The left turn in the grid with the rows going up.
+		if o.c-cur.c == -dr && o.r-cur.r == dc {
+			return o
+		}
+	}
+	return out[0]
+}
+
+func removeEdge(edges map[vertex][]vertex, from, to vertex) {
+	out := edges[from]
+	for i, v := range out {
+		if v == to {
+			out = append(out[:i], out[i+1:]...)
+			break
+		}
+	}
+	if len(out) == 0 {
+		delete(edges, from)
+		return
+	}
+	edges[from] = out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,278 @@
+package homeRange
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/twpayne/go-geom"
+)
+
+// offset returns the fix at the given meters east and north of the origin.
+func offset(lat0, lon0, east, north float64) Fix {
+	return Fix{
+		Lat: lat0 + north/earthRadius*180/math.Pi,
+		Lon: lon0 + east/(earthRadius*math.Cos(lat0*math.Pi/180))*180/math.Pi,
+	}
+}
+
+// signedArea is positive for the counter clockwise rings.
+func signedArea(ring []geom.Coord) float64 {
+	var a float64
+	for i := 0; i < len(ring)-1; i++ {
+		a += ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+	}
+	return a / 2
+}
+
+func checkClosed(t *testing.T, ring []geom.Coord) {
+	t.Helper()
+	if len(ring) < 4 {
+		t.Fatalf("ring with coords:%v", len(ring))
+	}
+	if !ring[0].Equal(geom.XY, ring[len(ring)-1]) {
+		t.Fatalf("ring not closed first:%v last:%v", ring[0], ring[len(ring)-1])
+	}
+}
+
+func TestMCP(t *testing.T) {
+	lat0, lon0 := -1.25, 36.85
+	square := []Fix{
+		offset(lat0, lon0, 0, 0),
+		offset(lat0, lon0, 1000, 0),
+		offset(lat0, lon0, 1000, 1000),
+		offset(lat0, lon0, 0, 1000),
+		offset(lat0, lon0, 500, 500),
+		offset(lat0, lon0, 400, 600),
+		offset(lat0, lon0, 600, 400),
+	}
+	outlier := append(append([]Fix{}, square...), offset(lat0, lon0, 10000, 10000))
+
+	tests := []struct {
+		name    string
+		fixes   []Fix
+		percent float64
+		areaKm2 float64
+		err     bool
+	}{
+		{name: "all fixes", fixes: square, percent: 100, areaKm2: 1},
+		{name: "the far fix excluded", fixes: outlier, percent: 87.5, areaKm2: 1},
+		{name: "the far fix included", fixes: outlier, percent: 100, areaKm2: 10},
+		{name: "zero percent", fixes: square, percent: 0, err: true},
+		{name: "over 100 percent", fixes: square, percent: 101, err: true},
+		{name: "fixes on a line", percent: 100, err: true, fixes: []Fix{
+			offset(lat0, lon0, 0, 0),
+			offset(lat0, lon0, 100, 100),
+			offset(lat0, lon0, 200, 200),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := MCP(tt.fixes, tt.percent)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(e.AreaKm2-tt.areaKm2) > tt.areaKm2*0.01 {
+				t.Errorf("area got:%v expected:%v", e.AreaKm2, tt.areaKm2)
+			}
+			if e.Polygon.NumPolygons() != 1 {
+				t.Fatalf("polygons got:%v expected:1", e.Polygon.NumPolygons())
+			}
+			ring := e.Polygon.Polygon(0).LinearRing(0).Coords()
+			checkClosed(t, ring)
+			if signedArea(ring) <= 0 {
+				t.Error("the hull isn't counter clockwise")
+			}
+		})
+	}
+}
+
+// TestKDE compares the isopleth areas of normally distributed fixes
+// with the areas of the normal distribution widened by the bandwidth.
+func TestKDE(t *testing.T) {
+	lat0, lon0 := -1.25, 36.85
+	sigma := 1000.0
+	r := rand.New(rand.NewSource(1))
+	var fixes []Fix
+	for i := 0; i < 2000; i++ {
+		fixes = append(fixes, offset(lat0, lon0, r.NormFloat64()*sigma, r.NormFloat64()*sigma))
+	}
+
+	var last float64
+	for _, percent := range []float64{50, 95} {
+		e, err := KDE(fixes, percent, DefaultGrid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := sigma*sigma + e.Bandwidth*e.Bandwidth
+		expected := -2 * math.Pi * v * math.Log(1-percent/100) / 1e6
+		if math.Abs(e.AreaKm2-expected) > expected*0.1 {
+			t.Errorf("KDE %v area got:%v expected:%v", percent, e.AreaKm2, expected)
+		}
+		if e.AreaKm2 <= last {
+			t.Errorf("KDE %v area:%v isn't larger than the smaller isopleth:%v", percent, e.AreaKm2, last)
+		}
+		last = e.AreaKm2
+		for i := 0; i < e.Polygon.NumPolygons(); i++ {
+			ring := e.Polygon.Polygon(i).LinearRing(0).Coords()
+			checkClosed(t, ring)
+			if signedArea(ring) <= 0 {
+				t.Errorf("KDE %v outer ring:%v isn't counter clockwise", percent, i)
+			}
+		}
+	}
+}
+
+func TestKDEErrors(t *testing.T) {
+	lat0, lon0 := -1.25, 36.85
+	var fixes, same []Fix
+	for i := 0; i < 10; i++ {
+		fixes = append(fixes, offset(lat0, lon0, float64(i*100), float64(i%3*100)))
+		same = append(same, offset(lat0, lon0, 0, 0))
+	}
+
+	tests := []struct {
+		name    string
+		fixes   []Fix
+		percent float64
+		grid    int
+	}{
+		{name: "zero percent", fixes: fixes, percent: 0, grid: DefaultGrid},
+		{name: "100 percent", fixes: fixes, percent: 100, grid: DefaultGrid},
+		{name: "small grid", fixes: fixes, percent: 95, grid: 5},
+		{name: "large grid", fixes: fixes, percent: 95, grid: maxGrid + 1},
+		{name: "few fixes", fixes: fixes[:4], percent: 95, grid: DefaultGrid},
+		{name: "one position", fixes: same, percent: 95, grid: DefaultGrid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := KDE(tt.fixes, tt.percent, tt.grid); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestMaskPolygons(t *testing.T) {
+	tests := []struct {
+		name string
+		// mask rows from the top so that these read like the grid.
+		mask []string
+		// rings is the number of rings of each polygon.
+		rings []int
+		// corners is the number of corners of the outer ring of each polygon.
+		corners []int
+	}{
+		{
+			name:    "single cell",
+			mask:    []string{"#"},
+			rings:   []int{1},
+			corners: []int{4},
+		},
+		{
+			name: "L shape",
+			mask: []string{
+				"#.",
+				"##",
+			},
+			rings:   []int{1},
+			corners: []int{6},
+		},
+		{
+			name: "hole",
+			mask: []string{
+				"###",
+				"#.#",
+				"###",
+			},
+			rings:   []int{2},
+			corners: []int{4},
+		},
+		{
+			name: "diagonal cells",
+			mask: []string{
+				"#.",
+				".#",
+			},
+			rings:   []int{1, 1},
+			corners: []int{4, 4},
+		},
+		{
+			name: "separate polygons with a hole",
+			mask: []string{
+				"###..",
+				"#.#..",
+				"###.#",
+			},
+			rings:   []int{2, 1},
+			corners: []int{4, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, cols := len(tt.mask), len(tt.mask[0])
+			mask := make([]bool, rows*cols)
+			for i, line := range tt.mask {
+				r := rows - 1 - i
+				for c, v := range line {
+					mask[r*cols+c] = v == '#'
+				}
+			}
+			proj := projection{cosLat0: 1}
+			mp, err := maskPolygons(proj, mask, cols, rows, 0, 0, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mp.NumPolygons() != len(tt.rings) {
+				t.Fatalf("polygons got:%v expected:%v", mp.NumPolygons(), len(tt.rings))
+			}
+
+			// The polygons are in no particular order so match them by the rings and corners.
+			var got []string
+			for i := 0; i < mp.NumPolygons(); i++ {
+				p := mp.Polygon(i)
+				for j := 0; j < p.NumLinearRings(); j++ {
+					ring := p.LinearRing(j).Coords()
+					checkClosed(t, ring)
+					if a := signedArea(ring); (j == 0) != (a > 0) {
+						t.Errorf("polygon:%v ring:%v signed area:%v outer rings should be counter clockwise and holes clockwise", i, j, a)
+					}
+				}
+				got = append(got, shape(p.NumLinearRings(), p.LinearRing(0).NumCoords()-1))
+			}
+			var expected []string
+			for i := range tt.rings {
+				expected = append(expected, shape(tt.rings[i], tt.corners[i]))
+			}
+			for _, e := range expected {
+				found := false
+				for i, g := range got {
+					if g == e {
+						got = append(got[:i], got[i+1:]...)
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("missing polygon:%v", e)
+				}
+			}
+		})
+	}
+}
+
+func TestMaskPolygonsEmpty(t *testing.T) {
+	if _, err := maskPolygons(projection{cosLat0: 1}, make([]bool, 4), 2, 2, 0, 0, 100); err == nil {
+		t.Fatal("expected an error for an empty mask")
+	}
+}
+
+func shape(rings, corners int) string {
+	return string(rune('0'+rings)) + " rings " + string(rune('0'+corners)) + " corners"
+}
@@ -0,0 +1,227 @@
+package homeRange
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+// The default percents when no estimates are selected.
+var (
+	DefaultMCP = []float64{95, 100}
+	DefaultKDE = []float64{50, 95}
+)
+
+// Query selects the fixes of a device within a time window and the estimates.
+type Query struct {
+	// Device is the device ID, name or DevEUI.
+	Device string
+	From   time.Time
+	To     time.Time
+	// MCP and KDE are the percents of the estimates and
+	// when both are empty the defaults are used.
+	MCP []float64
+	KDE []float64
+	// Grid is the number of KDE grid cells along the longer side.
+	Grid int
+}
+
+// HomeRange estimates the home ranges of a device
+// as GeoJSON features with the area in km² in the properties.
+func (s *Store) HomeRange(q Query) (*geojson.FeatureCollection, error) {
+	if q.Device == "" {
+		return nil, errors.New("missing device")
+	}
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	if len(q.MCP) == 0 && len(q.KDE) == 0 {
+		q.MCP, q.KDE = DefaultMCP, DefaultKDE
+	}
+	if q.Grid == 0 {
+		q.Grid = DefaultGrid
+	}
+
+	devID, err := s.Device(q.Device)
+	if err != nil {
+		return nil, err
+	}
+	fixes, err := s.Fixes(devID, q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+	if len(fixes) < 3 {
+		return nil, errors.Errorf("device:%v has only fixes:%v within the time window", devID, len(fixes))
+	}
+
+	var estimates []*Estimate
+	for _, p := range q.MCP {
+		e, err := MCP(fixes, p)
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, e)
+	}
+	for _, p := range q.KDE {
+		e, err := KDE(fixes, p, q.Grid)
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, e)
+	}
+
+	fc := &geojson.FeatureCollection{}
+	for _, e := range estimates {
+		props := map[string]interface{}{
+			"device":  devID,
+			"method":  e.Method,
+			"percent": e.Percent,
+			"areaKm2": e.AreaKm2,
+			"fixes":   len(fixes),
+			"from":    time.Unix(fixes[0].Time, 0).UTC().Format(time.RFC3339),
+			"to":      time.Unix(fixes[len(fixes)-1].Time, 0).UTC().Format(time.RFC3339),
+		}
+		if e.Bandwidth > 0 {
+			props["bandwidthMeters"] = e.Bandwidth
+		}
+		fc.Features = append(fc.Features, &geojson.Feature{
+			Geometry:   e.Polygon,
+			Properties: props,
+		})
+	}
+	return fc, nil
+}
+
+// NewHandler creates the home range endpoint.
+func NewHandler(s *Store) *Handler {
+	return &Handler{store: s}
+}
+
+// Handler replies with the home range estimates of a device for the query
+// ?device=..&from=RFC3339&to=RFC3339&mcp=95&kde=50&kde=95&grid=200
+type Handler struct {
+	store *Store
+}
+
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fc, err := s.store.HomeRange(q)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := fc.MarshalJSON()
+	if err != nil {
+		httpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	if _, err := w.Write(b); err != nil {
+		log.Printf("[error] writing the response err:%v", err)
+	}
+}
+
+func parseQuery(r *http.Request) (Query, error) {
+	v := r.URL.Query()
+	q := Query{Device: v.Get("device")}
+	var err error
+	if from := v.Get("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, errors.Wrap(err, "parsing from")
+		}
+	}
+	if to := v.Get("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, errors.Wrap(err, "parsing to")
+		}
+	}
+	for _, p := range v["mcp"] {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return q, errors.Wrap(err, "parsing the mcp percent")
+		}
+		q.MCP = append(q.MCP, f)
+	}
+	for _, p := range v["kde"] {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return q, errors.Wrap(err, "parsing the kde percent")
+		}
+		q.KDE = append(q.KDE, f)
+	}
+	if grid := v.Get("grid"); grid != "" {
+		if q.Grid, err = strconv.Atoi(grid); err != nil {
+			return q, errors.Wrap(err, "parsing the grid")
+		}
+	}
+	return q, nil
+}
+
+// Values encodes the query for the home range endpoint.
+func (q Query) Values() url.Values {
+	v := url.Values{}
+	v.Set("device", q.Device)
+	if !q.From.IsZero() {
+		v.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.Format(time.RFC3339))
+	}
+	for _, p := range q.MCP {
+		v.Add("mcp", strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	for _, p := range q.KDE {
+		v.Add("kde", strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	if q.Grid != 0 {
+		v.Set("grid", strconv.Itoa(q.Grid))
+	}
+	return v
+}
+
+// Fetch requests the home range estimates from the endpoint of a running receiver
+// because the receiver locks the history file.
+// The token is sent as a bearer token when not empty.
+func Fetch(server, token string, q Query) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(server, "/")+"/homeRange?"+q.Values().Encode(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the home range request")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "requesting the home range")
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading the home range response")
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("home range request status:%v body:%v", res.Status, strings.TrimSpace(string(b)))
+	}
+	return b, nil
+}
+
+// fetchClient waits for the KDE of long tracks on a fine grid.
+var fetchClient = &http.Client{Timeout: 5 * time.Minute}
+
+func httpError(w http.ResponseWriter, err string, code int) {
+	_, fn, line, _ := runtime.Caller(1)
+	log.Printf("[error] %s:%d %v", fn, line, err)
+	http.Error(w, err, code)
+}
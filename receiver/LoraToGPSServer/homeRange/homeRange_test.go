@@ -0,0 +1,79 @@
+package homeRange
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/twpayne/go-geom/encoding/geojson"
+)
+
+func TestFetch(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "history.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	var points []*device.Data
+	for i := 0; i < 20; i++ {
+		f := offset(-1.25, 36.85, float64(i%5*200), float64(i/5*200))
+		points = append(points, &device.Data{ID: "lion1-7076050000000011", Lat: f.Lat, Lon: f.Lon, Time: start.Add(time.Duration(i) * time.Hour).Unix(), Valid: true})
+	}
+	// Invalid points aren't stored.
+	points = append(points, &device.Data{ID: "lion1-7076050000000011", Lat: 10, Lon: 10, Time: start.Unix() + 1})
+	if err := s.Record(points); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(NewHandler(s))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		q        Query
+		features int
+		fixes    float64
+		err      string
+	}{
+		{name: "defaults by name", q: Query{Device: "lion1"}, features: 4, fixes: 20},
+		{name: "by DevEUI", q: Query{Device: "7076050000000011", MCP: []float64{100}}, features: 1, fixes: 20},
+		{name: "time window", q: Query{Device: "lion1", From: start.Add(8 * time.Hour), To: start.Add(12 * time.Hour), MCP: []float64{100}}, features: 1, fixes: 5},
+		{name: "few fixes", q: Query{Device: "lion1", From: start, To: start.Add(time.Hour)}, err: "has only fixes:2"},
+		{name: "unknown device", q: Query{Device: "rhino1"}, err: "no fixes for device:rhino1"},
+		{name: "invalid percent", q: Query{Device: "lion1", KDE: []float64{100}}, err: "invalid KDE percent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := Fetch(srv.URL, "", tt.q)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error got:%v expected:%v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			fc := &geojson.FeatureCollection{}
+			if err := fc.UnmarshalJSON(b); err != nil {
+				t.Fatal(err)
+			}
+			if len(fc.Features) != tt.features {
+				t.Fatalf("features got:%v expected:%v", len(fc.Features), tt.features)
+			}
+			for _, f := range fc.Features {
+				if f.Properties["fixes"] != tt.fixes {
+					t.Errorf("fixes got:%v expected:%v", f.Properties["fixes"], tt.fixes)
+				}
+				if f.Properties["device"] != "lion1-7076050000000011" {
+					t.Errorf("device got:%v", f.Properties["device"])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package homeRange
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// pruneInterval is how often the fixes older than the retention are removed.
+const pruneInterval = time.Hour
+
+// Open opens or creates the history file with the fixes of all devices.
+// The fixes older than the retention are removed and when it is 0 these are kept forever.
+func Open(path string, retention time.Duration) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening the history file:%v", path)
+	}
+	s := &Store{
+		db:        db,
+		retention: retention,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if retention == 0 {
+		close(s.done)
+		return s, nil
+	}
+	go s.run()
+	return s, nil
+}
+
+// Store keeps the fixes in a bolt database with a bucket for each device
+// and the fixes keyed by the fix time so that the retried deliveries aren't stored twice.
+type Store struct {
+	db        *bolt.DB
+	retention time.Duration
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+// Record stores the valid fixes as the recorder of the device manager.
+func (s *Store) Record(points []*device.Data) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, point := range points {
+			if !point.Valid {
+				continue
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(point.ID))
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(&Fix{Lat: point.Lat, Lon: point.Lon, Time: point.Time})
+			if err != nil {
+				return err
+			}
+			if err := b.Put(itob(point.Time), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "storing the fixes")
+}
+
+// Devices returns the IDs of the devices with stored fixes.
+func (s *Store) Devices() ([]string, error) {
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			ids = append(ids, string(name))
+			return nil
+		})
+	})
+	sort.Strings(ids)
+	return ids, err
+}
+
+// Device returns the ID of the device matched by its ID, name or DevEUI.
+func (s *Store) Device(q string) (string, error) {
+	ids, err := s.Devices()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, id := range ids {
+		if id == q {
+			return id, nil
+		}
+		if strings.HasPrefix(id, q+"-") || strings.HasSuffix(id, "-"+strings.ToLower(q)) {
+			found = append(found, id)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", errors.Errorf("no fixes for device:%v", q)
+	case 1:
+		return found[0], nil
+	default:
+		return "", errors.Errorf("several devices match:%v", strings.Join(found, ","))
+	}
+}
+
+// Fixes returns the fixes of a device within the time window in fix time order.
+func (s *Store) Fixes(devID string, from, to time.Time) ([]Fix, error) {
+	var fixes []Fix
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(devID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek(itob(from.Unix())); k != nil && int64(binary.BigEndian.Uint64(k)) <= to.Unix(); k, v = c.Next() {
+			var f Fix
+			if err := json.Unmarshal(v, &f); err != nil {
+				return err
+			}
+			fixes = append(fixes, f)
+		}
+		return nil
+	})
+	return fixes, errors.Wrapf(err, "reading the fixes of device:%v", devID)
+}
+
+// Close stops removing the old fixes and closes the file.
+func (s *Store) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.quit)
+		<-s.done
+	}
+	return s.db.Close()
+}
+
+func (s *Store) run() {
+	defer close(s.done)
+	t := time.NewTicker(pruneInterval)
+	defer t.Stop()
+	for {
+		if err := s.prune(time.Now().Add(-s.retention)); err != nil {
+			log.Printf("[error] removing the old fixes from the history err:%v", err)
+		}
+		select {
+		case <-s.quit:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Store) prune(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var empty [][]byte
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k)) < before.Unix(); k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			if k, _ := c.First(); k == nil {
+				empty = append(empty, append([]byte{}, name...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range empty {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// itob encodes the fix time so that the keys sort in time order.
+// The times before 1970 aren't valid fixes.
+func itob(v int64) []byte {
+	if v < 0 {
+		v = 0
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
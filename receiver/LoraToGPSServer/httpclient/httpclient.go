@@ -0,0 +1,98 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/pkg/errors"
+)
+
+// The defaults for the timeouts which are not set in the config.
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultRequestTimeout = 30 * time.Second
+	DefaultIdleTimeout    = 90 * time.Second
+)
+
+// New creates an http client with the TLS trust and the timeouts from the config.
+func New(cfg config.Client) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.CA != "" {
+		c, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading the CA file")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(c) {
+			return nil, errors.Errorf("no certificates in the CA file:%v", cfg.CA)
+		}
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading the client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case cfg.Fingerprint != "":
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(cfg.Fingerprint, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, errors.Errorf("invalid SHA-256 fingerprint:%v", cfg.Fingerprint)
+		}
+		// The pinned certificate replaces the CA verification.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no server certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], fingerprint) {
+				return errors.Errorf("server certificate fingerprint:%v doesn't match the pinned fingerprint", hex.EncodeToString(sum[:]))
+			}
+			return nil
+		}
+	case cfg.Insecure:
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	connectTimeout := time.Duration(cfg.ConnectTimeout)
+	if connectTimeout == 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	requestTimeout := time.Duration(cfg.RequestTimeout)
+	if requestTimeout == 0 {
+		requestTimeout = DefaultRequestTimeout
+	}
+	idleTimeout := time.Duration(cfg.IdleTimeout)
+	if idleTimeout == 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
+	return &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   connectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: connectTimeout,
+			IdleConnTimeout:     idleTimeout,
+			MaxIdleConnsPerHost: 10,
+		},
+	}, nil
+}
@@ -0,0 +1,225 @@
+package httpclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+)
+
+// testCert is a certificate with its key as parsed values and PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	tls      tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+var serial int64
+
+// newTestCert creates a certificate signed by the parent or self signed when the parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, tmpl *x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl.SerialNumber = big.NewInt(serial)
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		tls:      tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		certFile: filepath.Join(t.TempDir(), name+".crt"),
+		keyFile:  filepath.Join(t.TempDir(), name+".key"),
+	}
+	if err := ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// testPKI is a CA with a server and a client certificate.
+type testPKI struct {
+	ca     *testCert
+	server *testCert
+	client *testCert
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	ca := newTestCert(t, "ca", nil, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return &testPKI{
+		ca: ca,
+		server: newTestCert(t, "server", ca, &x509.Certificate{
+			IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}),
+		client: newTestCert(t, "client", ca, &x509.Certificate{
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}),
+	}
+}
+
+func newTLSServer(t *testing.T, cfg *tls.Config) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	// The rejected handshakes are expected so keep these out of the test output.
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	if cfg != nil {
+		srv.TLS = cfg
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// fingerprint is the SHA-256 fingerprint in the format shown by openssl.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+func TestNewTLS(t *testing.T) {
+	pki := newTestPKI(t)
+
+	// The default httptest certificate is not trusted by any CA.
+	selfSigned := newTLSServer(t, nil)
+	signed := newTLSServer(t, &tls.Config{Certificates: []tls.Certificate{pki.server.tls}})
+	mutual := newTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.server.tls},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    x509.NewCertPool(),
+	})
+	mutual.TLS.ClientCAs.AddCert(pki.ca.cert)
+
+	otherCA := newTestCert(t, "other-ca", nil, &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+
+	tests := []struct {
+		name string
+		srv  *httptest.Server
+		cfg  config.Client
+		err  string
+	}{
+		{name: "matching pin", srv: selfSigned, cfg: config.Client{Fingerprint: fingerprint(selfSigned.Certificate())}},
+		{name: "matching pin without separators", srv: selfSigned, cfg: config.Client{Fingerprint: strings.ToLower(strings.ReplaceAll(fingerprint(selfSigned.Certificate()), ":", ""))}},
+		{name: "wrong pin", srv: selfSigned, cfg: config.Client{Fingerprint: fingerprint(pki.server.cert)}, err: "doesn't match the pinned fingerprint"},
+		{name: "pin of a CA signed certificate", srv: signed, cfg: config.Client{Fingerprint: fingerprint(pki.server.cert)}},
+		{name: "self signed without a pin", srv: selfSigned, err: "certificate signed by unknown authority"},
+		{name: "insecure", srv: selfSigned, cfg: config.Client{Insecure: true}},
+		{name: "custom CA", srv: signed, cfg: config.Client{CA: pki.ca.certFile}},
+		{name: "other CA", srv: signed, cfg: config.Client{CA: otherCA.certFile}, err: "certificate signed by unknown authority"},
+		{name: "mutual TLS", srv: mutual, cfg: config.Client{CA: pki.ca.certFile, Cert: pki.client.certFile, Key: pki.client.keyFile}},
+		{name: "mutual TLS without a client certificate", srv: mutual, cfg: config.Client{CA: pki.ca.certFile}, err: "remote error"},
+		{name: "mutual TLS with a pin", srv: mutual, cfg: config.Client{Fingerprint: fingerprint(pki.server.cert), Cert: pki.client.certFile, Key: pki.client.keyFile}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := New(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(tt.srv.URL)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error got:%v expected:%v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status got:%v expected:%v", resp.StatusCode, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	pki := newTestPKI(t)
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.Client
+		err  string
+	}{
+		{name: "short fingerprint", cfg: config.Client{Fingerprint: "AB:CD"}, err: "invalid SHA-256 fingerprint:AB:CD"},
+		{name: "fingerprint not in hex", cfg: config.Client{Fingerprint: strings.Repeat("ZZ", sha256.Size)}, err: "invalid SHA-256 fingerprint"},
+		{name: "missing CA file", cfg: config.Client{CA: filepath.Join(t.TempDir(), "missing.crt")}, err: "reading the CA file"},
+		{name: "CA file without certificates", cfg: config.Client{CA: notPEM}, err: "no certificates in the CA file"},
+		{name: "client certificate without a key", cfg: config.Client{Cert: pki.client.certFile}, err: "loading the client certificate"},
+		{name: "client key of another certificate", cfg: config.Client{Cert: pki.client.certFile, Key: pki.server.keyFile}, err: "loading the client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
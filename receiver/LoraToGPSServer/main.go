@@ -1,16 +1,31 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/auth"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
 	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/dispatcher"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/homeRange"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/mqtt"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/outbox"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/smartConnect"
 	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/traccar"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/ttn"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/worker"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -25,26 +40,374 @@ func main() {
 		Default("8070").
 		Short('p').
 		String()
+	mqttServer := app.Flag("mqttServer", "mqtt broker to subscribe to for chirpstack uplink events, for example tcp://chirpstack-mosquitto:1883. Disabled when empty").
+		Envar("MQTT_SERVER").
+		String()
+	mqttTopic := app.Flag("mqttTopic", "mqtt topic for the chirpstack uplink events").
+		Envar("MQTT_TOPIC").
+		Default(mqtt.DefaultTopic).
+		String()
+	configFile := app.Flag("config", "json config file with the SMART connect servers, routes and patrol uploads").
+		Envar("CONFIG_FILE").
+		String()
+	smartServer := app.Flag("smartServer", "SMART connect server for all devices without a route in the config file, for example https://smart-connect:8443").
+		Envar("SMART_SERVER").
+		String()
+	smartUser := app.Flag("smartUser", "SMART connect user").
+		Envar("SMART_USER").
+		String()
+	smartPass := app.Flag("smartPass", "SMART connect password").
+		Envar("SMART_PASS").
+		String()
+	smartCarea := app.Flag("smartCarea", "SMART connect conservation area uuid").
+		Envar("SMART_CAREA").
+		String()
+	authToken := app.Flag("authToken", "bearer token for the http endpoints in addition to the auth section of the config file").
+		Envar("AUTH_TOKEN").
+		String()
+	traccarServer := app.Flag("traccarServer", "traccar server for the points received through the /uplink endpoint, mqtt and ttn, for example http://traccar:5055").
+		Envar("TRACCAR_SERVER").
+		String()
+	devEUIPrefixes := app.Flag("decoderDevEUIPrefix", "select the decoder for devices without a type tag by a DevEUI prefix, for example 70b3d5=irnas. Can be repeated").
+		Envar("DECODER_DEVEUI_PREFIX").
+		StringMap()
+	fPorts := app.Flag("decoderFPort", "select the decoder for uplinks without a type tag or a matching DevEUI prefix by the FPort, for example 1=irnas. Can be repeated").
+		Envar("DECODER_FPORT").
+		StringMap()
+	codecDir := app.Flag("codecDir", "directory with javascript codecs, each file name.js is a decoder for the device type or profile with the same name").
+		Envar("CODEC_DIR").
+		String()
+	codecTimeout := app.Flag("codecTimeout", "execution time limit for a javascript codec").
+		Envar("CODEC_TIMEOUT").
+		Default("100ms").
+		Duration()
+	hdop := app.Flag("hdop", "reject the points with a higher HDOP for the device types without a maxHdop filter in the config file").
+		Envar("HDOP").
+		Float64()
+	geofences := app.Flag("geofences", "GeoJSON file with the geofence polygons like parks or villages, the points which enter or exit a geofence get the alarm attributes").
+		Envar("GEOFENCES").
+		String()
+	historySize := app.Flag("historySize", "number of fixes kept for each device to calculate the speed and bearing between the fixes in fix time order").
+		Envar("HISTORY_SIZE").
+		Default(strconv.Itoa(device.DefaultHistorySize)).
+		Int()
+	dedupTTL := app.Flag("dedupTTL", "how long to remember an uplink to detect duplicates from several gateways or integrations").
+		Envar("DEDUP_TTL").
+		Default("1m").
+		Duration()
+	dedupRedis := app.Flag("dedupRedis", "redis url to store the uplink de-duplication cache, for example redis://chirpstack-redis:6379. In memory when empty").
+		Envar("DEDUP_REDIS").
+		String()
+
+	outboxPath := app.Flag("outboxPath", "file to queue the sink deliveries and retry the failed ones also after a restart, for example /data/outbox.db. Disabled when empty").
+		Envar("OUTBOX_PATH").
+		String()
+	outboxMinBackoff := app.Flag("outboxMinBackoff", "wait after the first failed delivery which doubles after each next failure").
+		Envar("OUTBOX_MIN_BACKOFF").
+		Default("5s").
+		Duration()
+	outboxMaxBackoff := app.Flag("outboxMaxBackoff", "max wait between the delivery attempts").
+		Envar("OUTBOX_MAX_BACKOFF").
+		Default("10m").
+		Duration()
+	outboxMaxAge := app.Flag("outboxMaxAge", "drop the deliveries which still fail after this long").
+		Envar("OUTBOX_MAX_AGE").
+		Default("168h").
+		Duration()
+
+	workers := app.Flag("workers", "number of workers which send the points to the sinks after the ingestion request is answered. When 0 the points are sent before answering").
+		Envar("WORKERS").
+		Default("4").
+		Int()
+	queueSize := app.Flag("queueSize", "max number of uplinks waiting for the workers, when full the ingestion requests are answered with 503").
+		Envar("QUEUE_SIZE").
+		Default("1000").
+		Int()
+	retryAfter := app.Flag("retryAfter", "the Retry-After header when the queue is full").
+		Envar("RETRY_AFTER").
+		Default("10s").
+		Duration()
+	shutdownTimeout := app.Flag("shutdownTimeout", "max wait for the queued uplinks to be sent on SIGTERM").
+		Envar("SHUTDOWN_TIMEOUT").
+		Default("30s").
+		Duration()
 
-	if _, err := app.Parse(os.Args[1:]); err != nil {
+	historyPath := app.Flag("historyPath", "file to store the fixes of all devices for the home range estimates, for example /data/history.db. Disabled when empty").
+		Envar("HISTORY_PATH").
+		String()
+	historyRetention := app.Flag("historyRetention", "remove the stored fixes older than this, kept forever when 0").
+		Envar("HISTORY_RETENTION").
+		Default("0").
+		Duration()
+
+	app.Command("serve", "receive the uplinks and send the points to the sinks").Default()
+	homeRangeCmd := app.Command("homeRange", "print the home range estimates of a device as GeoJSON from the /homeRange endpoint of the running receiver")
+	homeRangeServer := homeRangeCmd.Flag("server", "url of the running receiver with the historyPath set").Default("http://localhost:8070").String()
+	homeRangeDevice := homeRangeCmd.Arg("device", "device ID, name or DevEUI").Required().String()
+	homeRangeFrom := homeRangeCmd.Flag("from", "start of the time window in RFC3339 format like 2021-10-01T00:00:00Z").String()
+	homeRangeTo := homeRangeCmd.Flag("to", "end of the time window in RFC3339 format").String()
+	homeRangeMCP := homeRangeCmd.Flag("mcp", "minimum convex polygon percent, can be repeated. Defaults to 95 and 100 when no mcp or kde is set").Float64List()
+	homeRangeKDE := homeRangeCmd.Flag("kde", "kernel density isopleth percent, can be repeated. Defaults to 50 and 95 when no mcp or kde is set").Float64List()
+	homeRangeGrid := homeRangeCmd.Flag("grid", "number of kernel density grid cells along the longer side").Default(strconv.Itoa(homeRange.DefaultGrid)).Int()
+
+	cmd, err := app.Parse(os.Args[1:])
+	if err != nil {
 		fmt.Fprintln(os.Stderr, errors.Wrapf(err, "Error parsing commandline arguments"))
 		app.Usage(os.Args[1:])
 		os.Exit(2)
 	}
 
+	if cmd == homeRangeCmd.FullCommand() {
+		q := homeRange.Query{
+			Device: *homeRangeDevice,
+			MCP:    *homeRangeMCP,
+			KDE:    *homeRangeKDE,
+			Grid:   *homeRangeGrid,
+		}
+		if *homeRangeFrom != "" {
+			if q.From, err = time.Parse(time.RFC3339, *homeRangeFrom); err != nil {
+				log.Fatalf("parsing from err:%v", err)
+			}
+		}
+		if *homeRangeTo != "" {
+			if q.To, err = time.Parse(time.RFC3339, *homeRangeTo); err != nil {
+				log.Fatalf("parsing to err:%v", err)
+			}
+		}
+		if err := printHomeRange(*homeRangeServer, *authToken, q); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := &config.Config{}
+	if *configFile != "" {
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// The server from the env vars is added last so
+	// the routes from the config file take precedence.
+	if *smartServer != "" {
+		if *smartCarea == "" {
+			log.Fatal("the smartServer requires the conservation area uuid set with smartCarea")
+		}
+		cfg.SmartConnect.Servers = append(cfg.SmartConnect.Servers, config.SmartServer{
+			Name:              "default",
+			URL:               *smartServer,
+			User:              *smartUser,
+			Pass:              *smartPass,
+			ConservationAreas: map[string]string{"default": *smartCarea},
+		})
+		cfg.SmartConnect.Routes = append(cfg.SmartConnect.Routes, config.SmartRoute{
+			Server:           "default",
+			ConservationArea: "default",
+		})
+	}
+
+	if *authToken != "" {
+		cfg.Auth.Tokens = append(cfg.Auth.Tokens, *authToken)
+	}
+	authenticator, err := auth.New(cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	manager := device.NewManager()
-	// smartConnectHandler := smartConnect.NewHandler(manager)
-	traccarHandler := traccar.NewHandler(manager)
+	if *dedupRedis != "" {
+		dedup, err := device.NewRedisDedup(*dedupRedis, *dedupTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		manager.SetDedup(dedup)
+	} else {
+		manager.SetDedup(device.NewMemoryDedup(*dedupTTL))
+	}
+	if *codecDir != "" {
+		if err := manager.LoadCodecs(*codecDir, *codecTimeout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	manager.SetHistorySize(*historySize)
+	if *hdop > 0 {
+		if cfg.Filters.Types == nil {
+			cfg.Filters.Types = make(map[string]config.TypeFilter)
+		}
+		tf := cfg.Filters.Types["default"]
+		if tf.MaxHdop == 0 {
+			tf.MaxHdop = *hdop
+			cfg.Filters.Types["default"] = tf
+		}
+	}
+	if err := manager.SetFilters(cfg.Filters); err != nil {
+		log.Fatal(err)
+	}
+	if err := manager.SetStationary(cfg.Stationary); err != nil {
+		log.Fatal(err)
+	}
+	if err := manager.SetEncounters(cfg.Encounters); err != nil {
+		log.Fatal(err)
+	}
+	if *geofences != "" {
+		if err := manager.LoadGeofences(*geofences); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for prefix, devType := range *devEUIPrefixes {
+		if err := manager.Decoders().RegisterDevEUIPrefix(prefix, devType); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for fPort, devType := range *fPorts {
+		p, err := strconv.ParseUint(fPort, 10, 8)
+		if err != nil {
+			log.Fatalf("parsing the decoder fport:%v err:%v", fPort, err)
+		}
+		if err := manager.Decoders().RegisterFPort(uint8(p), devType); err != nil {
+			log.Fatal(err)
+		}
+	}
+	smartConnectHandler, err := smartConnect.NewHandler(manager, cfg.SmartConnect)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer smartConnectHandler.Close()
+	traccarHandler, err := traccar.NewHandler(manager, cfg.Traccar.Client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The sinks which receive the points from the single ingestion endpoint,
+	// mqtt and ttn.
+	var sinks []dispatcher.Sink
+	if *traccarServer != "" {
+		if _, err := url.ParseRequestURI(*traccarServer); err != nil {
+			log.Fatal("invalid traccarServer url format expected: http://serverNameOrIP")
+		}
+		sinks = append(sinks, dispatcher.SinkFunc("traccar", func(points []*device.Data) error {
+			return traccarHandler.Send(*traccarServer, points)
+		}))
+	}
+	if len(cfg.SmartConnect.Routes) > 0 {
+		sinks = append(sinks, dispatcher.SinkFunc("smartConnect", smartConnectHandler.Send))
+	}
+
+	dispatch := dispatcher.New(manager)
+	if *outboxPath != "" {
+		store, err := outbox.Open(*outboxPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer store.Close()
+		for _, sink := range sinks {
+			o, err := store.Wrap(sink, outbox.Config{
+				MinBackoff: *outboxMinBackoff,
+				MaxBackoff: *outboxMaxBackoff,
+				MaxAge:     *outboxMaxAge,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer o.Close()
+			dispatch.Register(o)
+		}
+		log.Println("queuing the sink deliveries in:", *outboxPath)
+	} else {
+		for _, sink := range sinks {
+			dispatch.Register(sink)
+		}
+	}
+	// The history is stored directly as it is on the local disk
+	// and by the manager so that it includes the fixes of all endpoints.
+	var history *homeRange.Store
+	if *historyPath != "" {
+		history, err = homeRange.Open(*historyPath, *historyRetention)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer history.Close()
+		manager.SetRecorder(history)
+	}
+	log.Println("enabled sinks:", dispatch.Sinks())
+
+	var pool *worker.Pool
+	if *workers > 0 {
+		pool = worker.NewPool(*workers, *queueSize, *retryAfter)
+		dispatch.SetPool(pool)
+		traccarHandler.SetPool(pool)
+		smartConnectHandler.SetPool(pool)
+	}
+
+	var sub *mqtt.Subscriber
+	if *mqttServer != "" {
+		if len(dispatch.Sinks()) == 0 {
+			log.Fatal("the mqtt ingestion requires at least one enabled sink")
+		}
+		log.Println("subscribing to mqtt server:", *mqttServer)
+		sub, err = mqtt.NewSubscriber(manager, *mqttServer, *mqttTopic, dispatch.Handle)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	log.Println("starting server at port:", *receivePort)
+	if !authenticator.Enabled() {
+		log.Println("the http endpoints are without authentication")
+	}
 	if os.Getenv("DEBUG") == "1" {
 		log.Println("with debug logs")
 	}
 
-	// Keep handlers separate so that if one server returns an error
-	// it doesn't affect updates to the others.
-	// http.Handle("/smartConnect", smartConnectHandler)
-	http.Handle("/traccar", traccarHandler)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(":"+*receivePort, nil))
+	// The single ingestion endpoint sends to all sinks and
+	// a failure in one sink doesn't affect the others.
+	handle := func(path string, h http.Handler) {
+		http.Handle(path, authenticator.Handler(path, h))
+	}
+	handle("/uplink", dispatch)
+	handle("/ttn", ttn.NewHandler(manager, dispatch.TryHandle))
+	// The per sink endpoints.
+	handle("/smartConnect", smartConnectHandler)
+	handle("/traccar", traccarHandler)
+	handle("/metrics", promhttp.Handler())
+	if history != nil {
+		handle("/homeRange", homeRange.NewHandler(history))
+	}
+
+	srv := &http.Server{Addr: ":" + *receivePort}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+
+	// Stop the ingestion before draining the queue and
+	// the deferred closes stop the outbox and upload the patrols.
+	log.Println("shutting down, sending the queued uplinks")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("[error] stopping the http server err:%v", err)
+	}
+	if sub != nil {
+		sub.Close()
+	}
+	if pool != nil {
+		if err := pool.Close(ctx); err != nil {
+			log.Printf("[error] %v", err)
+		}
+	}
+}
+
+func printHomeRange(server, token string, q homeRange.Query) error {
+	b, err := homeRange.Fetch(server, token, q)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
 }
@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+)
+
+// DefaultTopic matches the uplink events of all chirpstack applications and devices.
+const DefaultTopic = "application/+/device/+/event/up"
+
+// HandleFunc receives the points parsed from a single uplink event.
+type HandleFunc func(points []*device.Data) error
+
+// NewSubscriber connects to the mqtt broker and subscribes to the chirpstack uplink events.
+// The connection is kept open and re-established on disconnects.
+func NewSubscriber(m *device.Manager, server, topic string, handle HandleFunc) (*Subscriber, error) {
+	s := &Subscriber{
+		devManager: m,
+		topic:      topic,
+		handle:     handle,
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(server).
+		SetClientID("lora-gps-server-" + strconv.FormatInt(time.Now().UnixNano(), 36)).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetOnConnectHandler(s.subscribe).
+		SetConnectionLostHandler(func(c paho.Client, err error) {
+			log.Println("mqtt connection lost err:", err)
+		})
+
+	s.client = paho.NewClient(opts)
+
+	// With the connect retry the token completes only after a successful connection
+	// so don't wait for it to allow starting before the broker is available.
+	token := s.client.Connect()
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		return nil, errors.Wrapf(token.Error(), "connecting to the mqtt server:%v", server)
+	}
+
+	return s, nil
+}
+
+// Subscriber parses the uplink events received from the mqtt broker.
+type Subscriber struct {
+	client     paho.Client
+	devManager *device.Manager
+	topic      string
+	handle     HandleFunc
+}
+
+// subscribe is called on every connect so that
+// the subscription is restored after a reconnect.
+func (s *Subscriber) subscribe(c paho.Client) {
+	log.Println("mqtt connected, subscribing to topic:", s.topic)
+	token := c.Subscribe(s.topic, 1, s.onMessage)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("[error] mqtt subscribe to topic:%v err:%v", s.topic, token.Error())
+	}
+}
+
+func (s *Subscriber) onMessage(c paho.Client, msg paho.Message) {
+	if os.Getenv("DEBUG") == "1" {
+		log.Printf("incoming mqtt message topic:%v payload:%v \n", msg.Topic(), string(msg.Payload()))
+	}
+
+	// The marshaler is set in the chirpstack config
+	// and mqtt has no content type so let the parser detect it.
+	points, err := s.devManager.ParseUplink("", msg.Payload())
+	if err != nil {
+		log.Printf("[error] parsing mqtt message topic:%v err:%v", msg.Topic(), err)
+		return
+	}
+
+	if err := s.handle(points); err != nil {
+		log.Printf("[error] handling mqtt message topic:%v err:%v", msg.Topic(), err)
+	}
+}
+
+// Close disconnects from the mqtt broker.
+func (s *Subscriber) Close() {
+	s.client.Disconnect(250)
+}
@@ -0,0 +1,428 @@
+package outbox
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/dispatcher"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	bolt "go.etcd.io/bbolt"
+)
+
+// idleInterval is how often the queue is checked when nothing is due.
+const idleInterval = time.Minute
+
+// Config sets the retries of the queued deliveries.
+type Config struct {
+	// MinBackoff is the wait after the first failed delivery
+	// and it doubles after each next failure up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAge drops the deliveries which still fail after this long.
+	MaxAge time.Duration
+}
+
+// Open opens or creates the outbox database file.
+func Open(path string) (*Store, error) {
+	return open(path, newMetrics())
+}
+
+func open(path string, m *metrics) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening the outbox file:%v", path)
+	}
+	return &Store{
+		db:      db,
+		metrics: m,
+	}, nil
+}
+
+// Store keeps the queued deliveries of all sinks in a single bolt database
+// with a bucket for each sink and a nested bucket for each device.
+type Store struct {
+	db      *bolt.DB
+	metrics *metrics
+}
+
+// Close closes the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Wrap returns a sink which writes the points to the outbox and
+// delivers them to the wrapped sink in the background.
+// Failed deliveries are retried with an exponential backoff and
+// the points of each device are delivered in the order they were received.
+func (s *Store) Wrap(sink dispatcher.Sink, cfg Config) (*Outbox, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(sink.Name()))
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating the outbox bucket for sink:%v", sink.Name())
+	}
+
+	o := &Outbox{
+		store:  s,
+		sink:   sink,
+		cfg:    cfg,
+		notify: make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go o.run()
+	return o, nil
+}
+
+// item is a queued delivery of a single point so that
+// a failed point doesn't resend the already delivered points of the same batch.
+type item struct {
+	Point    *device.Data `json:"point"`
+	Created  time.Time    `json:"created"`
+	Attempts int          `json:"attempts"`
+	// Next is the time of the next attempt after a failure.
+	Next time.Time `json:"next"`
+}
+
+// Outbox is a sink which queues the deliveries on disk.
+type Outbox struct {
+	store  *Store
+	sink   dispatcher.Sink
+	cfg    Config
+	notify chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// Name returns the name of the wrapped sink.
+func (o *Outbox) Name() string {
+	return o.sink.Name()
+}
+
+// Send writes the points to the outbox and returns without waiting for the delivery.
+func (o *Outbox) Send(points []*device.Data) error {
+	// Keep the order of the devices in the batch.
+	var devIDs []string
+	byDev := make(map[string][]*device.Data)
+	for _, point := range points {
+		if _, ok := byDev[point.ID]; !ok {
+			devIDs = append(devIDs, point.ID)
+		}
+		byDev[point.ID] = append(byDev[point.ID], point)
+	}
+	// The sinks order the points of a locations log by the fix time
+	// within a delivery so keep the same order with the single point deliveries.
+	for _, points := range byDev {
+		sort.SliceStable(points, func(i, j int) bool {
+			return points[i].Time < points[j].Time
+		})
+	}
+
+	now := time.Now()
+	err := o.store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(o.sink.Name()))
+		for _, devID := range devIDs {
+			db, err := b.CreateBucketIfNotExists([]byte(devID))
+			if err != nil {
+				return err
+			}
+			for _, point := range byDev[devID] {
+				seq, err := db.NextSequence()
+				if err != nil {
+					return err
+				}
+				v, err := json.Marshal(&item{Point: point, Created: now})
+				if err != nil {
+					return err
+				}
+				if err := db.Put(itob(seq), v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "writing to the outbox")
+	}
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops the background deliveries.
+// The queued deliveries are kept for the next start.
+func (o *Outbox) Close() {
+	close(o.quit)
+	<-o.done
+}
+
+func (o *Outbox) run() {
+	defer close(o.done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-o.quit:
+			return
+		case <-o.notify:
+		case <-timer.C:
+		}
+
+		wait := o.deliver()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// deliver sends all due items and returns the wait until the next due item.
+func (o *Outbox) deliver() time.Duration {
+	var devIDs []string
+	err := o.store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(o.sink.Name())).ForEach(func(k, v []byte) error {
+			// Only the nested device buckets have a nil value.
+			if v == nil {
+				devIDs = append(devIDs, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("[error] reading the outbox sink:%v err:%v", o.sink.Name(), err)
+		return idleInterval
+	}
+
+	wait := idleInterval
+	for _, devID := range devIDs {
+		select {
+		case <-o.quit:
+			return wait
+		default:
+		}
+		if w := o.deliverDevice(devID); w < wait {
+			wait = w
+		}
+	}
+	o.updateMetrics()
+	return wait
+}
+
+// deliverDevice sends the items of a device in order until a delivery fails
+// and returns the wait until the next due item of the device.
+func (o *Outbox) deliverDevice(devID string) time.Duration {
+	for {
+		key, it, err := o.first(devID)
+		if err != nil {
+			log.Printf("[error] reading the outbox sink:%v devID:%v err:%v", o.sink.Name(), devID, err)
+			return idleInterval
+		}
+		if it == nil {
+			return idleInterval
+		}
+
+		now := time.Now()
+		if now.Sub(it.Created) > o.cfg.MaxAge {
+			log.Printf("[error] dropping an outbox delivery after attempts:%v sink:%v devID:%v", it.Attempts, o.sink.Name(), devID)
+			o.store.metrics.dropped.With(prometheus.Labels{"sink": o.sink.Name()}).Inc()
+			if err := o.remove(devID, key); err != nil {
+				log.Printf("[error] removing from the outbox sink:%v devID:%v err:%v", o.sink.Name(), devID, err)
+				return idleInterval
+			}
+			continue
+		}
+		if it.Next.After(now) {
+			return it.Next.Sub(now)
+		}
+
+		if err := send(o.sink, []*device.Data{it.Point}); err != nil {
+			it.Attempts++
+			it.Next = now.Add(o.backoff(it.Attempts))
+			log.Printf("[error] outbox delivery attempt:%v sink:%v devID:%v next attempt in:%v err:%v", it.Attempts, o.sink.Name(), devID, it.Next.Sub(now), err)
+			o.store.metrics.retries.With(prometheus.Labels{"sink": o.sink.Name()}).Inc()
+			if err := o.put(devID, key, it); err != nil {
+				log.Printf("[error] updating the outbox sink:%v devID:%v err:%v", o.sink.Name(), devID, err)
+			}
+			return it.Next.Sub(now)
+		}
+
+		if os.Getenv("DEBUG") == "1" {
+			log.Printf("outbox delivered sink:%v devID:%v fixTime:%v attempts:%v", o.sink.Name(), devID, it.Point.Time, it.Attempts+1)
+		}
+		if err := o.remove(devID, key); err != nil {
+			log.Printf("[error] removing from the outbox sink:%v devID:%v err:%v", o.sink.Name(), devID, err)
+			return idleInterval
+		}
+	}
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	d := o.cfg.MinBackoff
+	for i := 1; i < attempts && d < o.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.cfg.MaxBackoff {
+		d = o.cfg.MaxBackoff
+	}
+	return d
+}
+
+// first returns the oldest item of a device or nil when the device queue is empty.
+func (o *Outbox) first(devID string) ([]byte, *item, error) {
+	var key []byte
+	var it *item
+	err := o.store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(o.sink.Name())).Bucket([]byte(devID))
+		if b == nil {
+			return nil
+		}
+		k, v := b.Cursor().First()
+		if k == nil {
+			return nil
+		}
+		key = append([]byte{}, k...)
+		it = &item{}
+		return json.Unmarshal(v, it)
+	})
+	return key, it, err
+}
+
+func (o *Outbox) put(devID string, key []byte, it *item) error {
+	v, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	return o.store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(o.sink.Name())).Bucket([]byte(devID))
+		if b == nil {
+			return nil
+		}
+		return b.Put(key, v)
+	})
+}
+
+// remove deletes an item and the device bucket when it becomes empty.
+func (o *Outbox) remove(devID string, key []byte) error {
+	return o.store.db.Update(func(tx *bolt.Tx) error {
+		sb := tx.Bucket([]byte(o.sink.Name()))
+		b := sb.Bucket([]byte(devID))
+		if b == nil {
+			return nil
+		}
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			return sb.DeleteBucket([]byte(devID))
+		}
+		return nil
+	})
+}
+
+func (o *Outbox) updateMetrics() {
+	var depth int
+	var oldest time.Time
+	err := o.store.db.View(func(tx *bolt.Tx) error {
+		sb := tx.Bucket([]byte(o.sink.Name()))
+		return sb.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			b := sb.Bucket(k)
+			depth += b.Stats().KeyN
+			// The first item is the oldest for the device.
+			if _, v := b.Cursor().First(); v != nil {
+				it := &item{}
+				if err := json.Unmarshal(v, it); err != nil {
+					return err
+				}
+				if oldest.IsZero() || it.Created.Before(oldest) {
+					oldest = it.Created
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("[error] reading the outbox metrics sink:%v err:%v", o.sink.Name(), err)
+		return
+	}
+
+	var age float64
+	if !oldest.IsZero() {
+		age = time.Since(oldest).Seconds()
+	}
+	o.store.metrics.depth.With(prometheus.Labels{"sink": o.sink.Name()}).Set(float64(depth))
+	o.store.metrics.age.With(prometheus.Labels{"sink": o.sink.Name()}).Set(age)
+}
+
+func send(s dispatcher.Sink, points []*device.Data) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("sink panic:%v", r)
+		}
+	}()
+	return s.Send(points)
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		depth: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "outbox_queue_depth",
+				Help: "The number of queued deliveries for each sink.",
+			},
+			[]string{"sink"},
+		),
+		age: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "outbox_oldest_age_seconds",
+				Help: "The age of the oldest queued delivery for each sink.",
+			},
+			[]string{"sink"},
+		),
+		retries: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "outbox_retries_total",
+				Help: "The total number of failed delivery attempts for each sink.",
+			},
+			[]string{"sink"},
+		),
+		dropped: promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "outbox_dropped_total",
+				Help: "The total number of deliveries dropped after the max age for each sink.",
+			},
+			[]string{"sink"},
+		),
+	}
+}
+
+type metrics struct {
+	depth   *prometheus.GaugeVec
+	age     *prometheus.GaugeVec
+	retries *prometheus.CounterVec
+	dropped *prometheus.CounterVec
+}
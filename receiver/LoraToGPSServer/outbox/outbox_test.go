@@ -0,0 +1,306 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testMetrics are shared by the tests because the metrics can be registered only once.
+var testMetrics = newMetrics()
+
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := open(path, testMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// fakeSink records the delivered points and
+// fails the deliveries for which fail returns true.
+type fakeSink struct {
+	name      string
+	mtx       sync.Mutex
+	fail      func(point *device.Data, attempt int) bool
+	attempts  map[string]int
+	attempted []time.Time
+	delivered []string
+}
+
+func newFakeSink(name string, fail func(point *device.Data, attempt int) bool) *fakeSink {
+	return &fakeSink{name: name, fail: fail, attempts: make(map[string]int)}
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) Send(points []*device.Data) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(points) != 1 {
+		return fmt.Errorf("points got:%v expected:1", len(points))
+	}
+	key := pointKey(points[0])
+	s.attempts[key]++
+	s.attempted = append(s.attempted, time.Now())
+	if s.fail != nil && s.fail(points[0], s.attempts[key]) {
+		return errors.New("connection refused")
+	}
+	s.delivered = append(s.delivered, key)
+	return nil
+}
+
+func (s *fakeSink) deliveries() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]string{}, s.delivered...)
+}
+
+func pointKey(point *device.Data) string {
+	return fmt.Sprintf("%v/%v", point.ID, point.Time)
+}
+
+func point(devID string, fixTime int64) *device.Data {
+	return &device.Data{ID: devID, Lat: -1.25, Lon: 36.85, Time: fixTime, Valid: true}
+}
+
+// waitDeliveries waits until the sink has the expected number of deliveries.
+func waitDeliveries(t *testing.T, s *fakeSink, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d := s.deliveries()
+		if len(d) >= n {
+			return d
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries got:%v expected:%v", d, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func index(keys []string, key string) int {
+	for i, k := range keys {
+		if k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestOutboxDeviceOrder(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer store.Close()
+
+	// The second point of collar1 fails once so
+	// the next points of collar1 wait for its retry.
+	sink := newFakeSink("order", func(point *device.Data, attempt int) bool {
+		return pointKey(point) == "collar1/2" && attempt == 1
+	})
+	o, err := store.Wrap(sink, Config{MinBackoff: 20 * time.Millisecond, MaxBackoff: time.Second, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	// The points of each device are delivered in the fix time order.
+	err = o.Send([]*device.Data{
+		point("collar1", 3),
+		point("collar2", 1),
+		point("collar1", 1),
+		point("collar1", 2),
+		point("collar2", 2),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := waitDeliveries(t, sink, 5)
+	for _, order := range [][]string{
+		{"collar1/1", "collar1/2", "collar1/3"},
+		{"collar2/1", "collar2/2"},
+	} {
+		for i := 1; i < len(order); i++ {
+			if index(d, order[i-1]) > index(d, order[i]) {
+				t.Errorf("deliveries got:%v expected %v before %v", d, order[i-1], order[i])
+			}
+		}
+	}
+	// The failure of one device doesn't hold back the other devices.
+	if index(d, "collar2/2") > index(d, "collar1/2") {
+		t.Errorf("deliveries got:%v expected collar2 before the retry of collar1", d)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := &Outbox{cfg: Config{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}}
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{attempts: 1, expected: time.Second},
+		{attempts: 2, expected: 2 * time.Second},
+		{attempts: 3, expected: 4 * time.Second},
+		{attempts: 4, expected: 8 * time.Second},
+		{attempts: 5, expected: 10 * time.Second},
+		{attempts: 50, expected: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := o.backoff(tt.attempts); got != tt.expected {
+			t.Errorf("attempts:%v backoff got:%v expected:%v", tt.attempts, got, tt.expected)
+		}
+	}
+}
+
+func TestOutboxRetrySchedule(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer store.Close()
+
+	sink := newFakeSink("schedule", func(point *device.Data, attempt int) bool {
+		return attempt <= 3
+	})
+	cfg := Config{MinBackoff: 20 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, MaxAge: time.Hour}
+	retries := testMetrics.retries.With(prometheus.Labels{"sink": sink.Name()})
+	before := testutil.ToFloat64(retries)
+
+	o, err := store.Wrap(sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if err := o.Send([]*device.Data{point("collar1", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	waitDeliveries(t, sink, 1)
+
+	sink.mtx.Lock()
+	attempted := sink.attempted
+	sink.mtx.Unlock()
+	if len(attempted) != 4 {
+		t.Fatalf("attempts got:%v expected:4", len(attempted))
+	}
+	// Each retry is not before its scheduled next attempt.
+	for i := 1; i < len(attempted); i++ {
+		if gap, min := attempted[i].Sub(attempted[i-1]), o.backoff(i); gap < min {
+			t.Errorf("attempt:%v after:%v expected at least:%v", i+1, gap, min)
+		}
+	}
+	if got := testutil.ToFloat64(retries) - before; got != 3 {
+		t.Errorf("retries metric got:%v expected:3", got)
+	}
+}
+
+func TestOutboxNextAttempt(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "outbox.db"))
+	defer store.Close()
+
+	sink := newFakeSink("next", func(point *device.Data, attempt int) bool { return true })
+	o, err := store.Wrap(sink, Config{MinBackoff: time.Hour, MaxBackoff: time.Hour, MaxAge: 2 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := o.Send([]*device.Data{point("collar1", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sink.mtx.Lock()
+		n := len(sink.attempted)
+		sink.mtx.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the point wasn't attempted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	o.Close()
+
+	// The failed item keeps its place with the time of the next attempt.
+	_, it, err := o.first("collar1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it == nil || it.Attempts != 1 || pointKey(it.Point) != "collar1/1" {
+		t.Fatalf("item got:%+v", it)
+	}
+	if it.Next.Before(start.Add(time.Hour)) || it.Next.After(time.Now().Add(time.Hour)) {
+		t.Errorf("next attempt got:%v expected in an hour from:%v", it.Next, start)
+	}
+	// Not due yet so nothing is sent and the wait is until the next attempt.
+	if wait := o.deliverDevice("collar1"); wait < 59*time.Minute {
+		t.Errorf("device wait got:%v expected about an hour", wait)
+	}
+	if n := len(sink.attempted); n != 1 {
+		t.Errorf("attempts got:%v expected:1", n)
+	}
+}
+
+func TestOutboxReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+
+	// The first delivery fails and the outbox is closed before the retry.
+	failed := make(chan struct{}, 1)
+	store := openTestStore(t, path)
+	sink := newFakeSink("reopen", func(point *device.Data, attempt int) bool {
+		select {
+		case failed <- struct{}{}:
+		default:
+		}
+		return true
+	})
+	cfg := Config{MinBackoff: 20 * time.Millisecond, MaxBackoff: time.Second, MaxAge: time.Hour}
+	o, err := store.Wrap(sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Send([]*device.Data{point("collar1", 1), point("collar1", 2), point("collar2", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the point wasn't attempted")
+	}
+	o.Close()
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openTestStore(t, path)
+	defer store.Close()
+	sink = newFakeSink("reopen", nil)
+
+	// The failed item keeps its attempts and the other items are still queued.
+	_, it, err := (&Outbox{store: store, sink: sink}).first("collar1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it == nil || it.Attempts != 1 || pointKey(it.Point) != "collar1/1" {
+		t.Fatalf("item after the reopen got:%+v", it)
+	}
+
+	o, err = store.Wrap(sink, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	d := waitDeliveries(t, sink, 3)
+	if index(d, "collar1/1") > index(d, "collar1/2") || index(d, "collar2/1") < 0 {
+		t.Errorf("deliveries got:%v", d)
+	}
+}
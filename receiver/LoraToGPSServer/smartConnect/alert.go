@@ -0,0 +1,164 @@
+package smartConnect
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+)
+
+// hdopAccuracy is the horizontal accuracy in meters for HDOP 1
+// used when the device doesn't report the estimated position error.
+const hdopAccuracy = 5
+
+// knotsToKmh converts the speed in knots to km/h.
+const knotsToKmh = 1.852
+
+// alertFeatureCollection is the connect alert request body.
+type alertFeatureCollection struct {
+	Type     string         `json:"type"`
+	Features []alertFeature `json:"features"`
+}
+
+type alertFeature struct {
+	Type       string          `json:"type"`
+	Geometry   alertGeometry   `json:"geometry"`
+	Properties alertProperties `json:"properties"`
+}
+
+type alertGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates [2]string `json:"coordinates"`
+}
+
+type alertProperties struct {
+	DeviceID    string   `json:"deviceId"`
+	ID          string   `json:"id"`
+	Latitude    float64  `json:"latitude"`
+	Longitude   float64  `json:"longitude"`
+	Altitude    float64  `json:"altitude"`
+	Accuracy    float64  `json:"accuracy"`
+	CaUUID      string   `json:"caUuid"`
+	Level       string   `json:"level"`
+	Description string   `json:"description"`
+	TypeUUID    string   `json:"typeUuid"`
+	Sighting    struct{} `json:"sighting"`
+}
+
+func newAlert(dest *Destination, data *device.Data, alertID string, level int) *alertFeatureCollection {
+	props := alertProperties{
+		DeviceID:    data.ID,
+		ID:          "0",
+		Latitude:    data.Lat,
+		Longitude:   data.Lon,
+		Altitude:    attrFloat(data, "alt"),
+		Accuracy:    accuracy(data),
+		CaUUID:      dest.CA,
+		Level:       strconv.Itoa(level),
+		Description: description(data),
+		TypeUUID:    alertID,
+	}
+
+	return &alertFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []alertFeature{
+			{
+				Type: "Feature",
+				Geometry: alertGeometry{
+					Type: "Point",
+					Coordinates: [2]string{
+						strconv.FormatFloat(data.Lon, 'f', -1, 64),
+						strconv.FormatFloat(data.Lat, 'f', -1, 64),
+					},
+				},
+				Properties: props,
+			},
+		},
+	}
+}
+
+// accuracy returns the estimated horizontal position error in meters
+// when reported by the device or otherwise an estimate from the HDOP.
+func accuracy(data *device.Data) float64 {
+	if ehpe := attrFloat(data, "ehpe"); ehpe > 0 {
+		return ehpe
+	}
+	return data.Hdop * hdopAccuracy
+}
+
+// description is a readable summary of the device status for the rangers.
+func description(data *device.Data) string {
+	var parts []string
+	add := func(name, value string) {
+		parts = append(parts, name+": "+value)
+	}
+
+	if v, ok := data.Attr[device.AttrAlarm]; ok {
+		add("alarm", v)
+	}
+	if v, ok := data.Attr[device.AttrGeofence]; ok {
+		add("geofence", v)
+	}
+	if v, ok := data.Attr[device.AttrEncounter]; ok {
+		add("encounter", v)
+		add("encounter distance", data.Attr[device.AttrEncounterDistance]+" m")
+	}
+
+	if data.Speed > 0 {
+		add("speed", strconv.FormatFloat(data.Speed*knotsToKmh, 'f', 1, 64)+" km/h")
+	}
+	if data.Motion {
+		add("motion", "yes")
+	} else {
+		add("motion", "no")
+	}
+	if v, ok := data.Attr["battery"]; ok {
+		add("battery", v)
+	}
+	if v, ok := data.Attr["temperature"]; ok {
+		add("temperature", v+" C")
+	}
+	if v, ok := data.Attr["alt"]; ok {
+		add("altitude", v+" m")
+	}
+	if data.Hdop > 0 {
+		add("hdop", strconv.FormatFloat(data.Hdop, 'f', -1, 64))
+	}
+	if v, ok := data.Attr["sat"]; ok {
+		add("satellites", v)
+	}
+	// The signal is from the same gateway as the name and
+	// not the best rssi and snr of all gateways.
+	if gw := gateway(data); gw != nil {
+		name := gw.Name
+		if name == "" {
+			name = gw.GatewayID.String()
+		}
+		add("gateway", name)
+		add("rssi", strconv.Itoa(gw.RSSI)+" dBm")
+		add("snr", strconv.FormatFloat(gw.LoRaSNR, 'f', -1, 64)+" dB")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// gateway returns the gateway with the strongest signal.
+func gateway(data *device.Data) *device.RXInfo {
+	if data.Payload == nil {
+		return nil
+	}
+	var best *device.RXInfo
+	for i, g := range data.Payload.RXInfo {
+		if best == nil || g.LoRaSNR > best.LoRaSNR {
+			best = &data.Payload.RXInfo[i]
+		}
+	}
+	return best
+}
+
+func attrFloat(data *device.Data, name string) float64 {
+	v, err := strconv.ParseFloat(data.Attr[name], 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
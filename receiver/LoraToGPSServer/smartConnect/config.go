@@ -0,0 +1,99 @@
+package smartConnect
+
+import (
+	"net/url"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/pkg/errors"
+)
+
+// Destination is a SMART connect server and conservation area.
+type Destination struct {
+	Server,
+	User,
+	Pass,
+	CA string
+}
+
+type route struct {
+	devices      map[string]struct{}
+	applications map[string]struct{}
+	dest         *Destination
+}
+
+func (r *route) match(data *device.Data) bool {
+	if len(r.devices) == 0 && len(r.applications) == 0 {
+		return true
+	}
+	if _, ok := r.devices[data.Payload.DeviceName]; ok {
+		return true
+	}
+	if _, ok := r.devices[data.Payload.DevEUI.String()]; ok {
+		return true
+	}
+	if _, ok := r.applications[data.Payload.ApplicationName]; ok {
+		return true
+	}
+	if _, ok := r.applications[data.Payload.ApplicationID]; ok {
+		return true
+	}
+	return false
+}
+
+func newRoutes(cfg config.SmartConnect) ([]*route, error) {
+	servers := make(map[string]config.SmartServer)
+	for _, server := range cfg.Servers {
+		if _, err := url.ParseRequestURI(server.URL); err != nil {
+			return nil, errors.Errorf("invalid url for server:%v format expected: https://serverNameOrIP", server.Name)
+		}
+		if _, ok := servers[server.Name]; ok {
+			return nil, errors.Errorf("duplicate server name:%v", server.Name)
+		}
+		servers[server.Name] = server
+	}
+
+	// Share the destinations between the routes so that
+	// the caches keyed by destination are also shared.
+	dests := make(map[string]*Destination)
+	var routes []*route
+	for i, r := range cfg.Routes {
+		server, ok := servers[r.Server]
+		if !ok {
+			return nil, errors.Errorf("route:%v unknown server:%v", i, r.Server)
+		}
+		ca, ok := server.ConservationAreas[r.ConservationArea]
+		if !ok {
+			return nil, errors.Errorf("route:%v unknown conservation area:%v for server:%v", i, r.ConservationArea, r.Server)
+		}
+		if ca == "" {
+			return nil, errors.Errorf("route:%v empty uuid for conservation area:%v of server:%v", i, r.ConservationArea, r.Server)
+		}
+
+		key := r.Server + "/" + r.ConservationArea
+		dest, ok := dests[key]
+		if !ok {
+			dest = &Destination{
+				Server: server.URL,
+				User:   server.User,
+				Pass:   server.Pass,
+				CA:     ca,
+			}
+			dests[key] = dest
+		}
+
+		rr := &route{
+			devices:      make(map[string]struct{}),
+			applications: make(map[string]struct{}),
+			dest:         dest,
+		}
+		for _, d := range r.Devices {
+			rr.devices[d] = struct{}{}
+		}
+		for _, a := range r.Applications {
+			rr.applications[a] = struct{}{}
+		}
+		routes = append(routes, rr)
+	}
+	return routes, nil
+}
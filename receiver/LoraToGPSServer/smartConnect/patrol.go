@@ -0,0 +1,359 @@
+package smartConnect
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/pkg/errors"
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/wkt"
+)
+
+// patrolCheckInterval is how often the tracks are checked for an upload.
+const patrolCheckInterval = time.Minute
+
+// defaultTrackGap closes the tracks when the config doesn't set a gap.
+const defaultTrackGap = time.Hour
+
+// maxTrackPoints limits the buffered points of a track
+// when the uploads keep failing.
+const maxTrackPoints = 10000
+
+// defaultPatrolTemplate follows the SMART desktop patrol xml export.
+// Each day of the track is a patrol day with the points as waypoints.
+const defaultPatrolTemplate = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<ns2:Patrol xmlns:ns2="http://www.smartconservationsoftware.org/xml/1.0/patrol" id="{{xml .ID}}" startDate="{{date .Start}}" endDate="{{date .End}}" isArmed="false" patrolType="{{xml (index .Metadata "patrolType")}}">
+    <ns2:objective>
+        <ns2:description>{{xml .Device}} track</ns2:description>
+    </ns2:objective>
+    {{- with index .Metadata "team"}}
+    <ns2:team value="{{xml .}}"/>
+    {{- end}}
+    {{- with index .Metadata "station"}}
+    <ns2:station value="{{xml .}}"/>
+    {{- end}}
+    {{- with index .Metadata "mandate"}}
+    <ns2:mandate value="{{xml .}}"/>
+    {{- end}}
+    <ns2:legs id="1" startDate="{{date .Start}}" endDate="{{date .End}}" transportType="{{xml (index .Metadata "transportType")}}">
+        {{- with index .Metadata "employeeId"}}
+        <ns2:members employeeId="{{xml .}}" isLeader="true" isPilot="false"/>
+        {{- end}}
+        {{- range .Days}}
+        <ns2:days date="{{date .Date}}" startTime="{{clock .Start}}" endTime="{{clock .End}}" restMinutes="0">
+            {{- range .Waypoints}}
+            <ns2:waypoints id="{{.ID}}" x="{{coord .X}}" y="{{coord .Y}}" time="{{clock .Time}}"/>
+            {{- end}}
+        </ns2:days>
+        {{- end}}
+    </ns2:legs>
+</ns2:Patrol>
+`
+
+// patrolData is the data for the patrol xml template.
+type patrolData struct {
+	ID       string
+	Device   string
+	Start    time.Time
+	End      time.Time
+	Days     []patrolDay
+	Metadata map[string]string
+	// Track is the WKT geometry of all points.
+	Track string
+}
+
+type patrolDay struct {
+	Date      time.Time
+	Start     time.Time
+	End       time.Time
+	Waypoints []patrolWaypoint
+	// Track is the WKT geometry of the day points.
+	Track string
+}
+
+type patrolWaypoint struct {
+	ID   int
+	X, Y float64
+	Time time.Time
+	Data *device.Data
+}
+
+// track buffers the points of a device for a conservation area.
+type track struct {
+	key    string
+	dest   *Destination
+	devID  string
+	device string
+	// points are sorted by fix time.
+	points []*device.Data
+	// received is the time of the last received point.
+	received time.Time
+	// uploaded is the time of the last upload or the track start.
+	uploaded time.Time
+}
+
+// insert adds the points in fix time order and
+// skips points with the same fix time.
+func (t *track) insert(points ...*device.Data) {
+	for _, point := range points {
+		i := sort.Search(len(t.points), func(i int) bool {
+			return t.points[i].Time >= point.Time
+		})
+		if i < len(t.points) && t.points[i].Time == point.Time {
+			continue
+		}
+		t.points = append(t.points, nil)
+		copy(t.points[i+1:], t.points[i:])
+		t.points[i] = point
+	}
+	if len(t.points) > maxTrackPoints {
+		t.points = t.points[len(t.points)-maxTrackPoints:]
+	}
+}
+
+func newPatrols(cfg config.Patrol, upload func(dest *Destination, name string, content []byte) error) (*patrols, error) {
+	tmpl := defaultPatrolTemplate
+	if cfg.Template != "" {
+		c, err := ioutil.ReadFile(cfg.Template)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading the patrol template")
+		}
+		tmpl = string(c)
+	}
+
+	p := &patrols{
+		cfg:    cfg,
+		upload: upload,
+		tracks: make(map[string]*track),
+		loc:    time.UTC,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	var err error
+	p.tmpl, err = template.New("patrol").Funcs(template.FuncMap{
+		"date":  func(t time.Time) string { return t.Format("2006-01-02") },
+		"clock": func(t time.Time) string { return t.Format("15:04:05") },
+		"coord": func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) },
+		"xml": func(s string) (string, error) {
+			b := &bytes.Buffer{}
+			err := xml.EscapeText(b, []byte(s))
+			return b.String(), err
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing the patrol template")
+	}
+
+	if cfg.TimeZone != "" {
+		p.loc, err = time.LoadLocation(cfg.TimeZone)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading the patrol time zone")
+		}
+	}
+	if p.cfg.TrackGap == 0 {
+		p.cfg.TrackGap = config.Duration(defaultTrackGap)
+	}
+	if p.cfg.Metadata == nil {
+		p.cfg.Metadata = make(map[string]string)
+	}
+	if _, ok := p.cfg.Metadata["patrolType"]; !ok {
+		p.cfg.Metadata["patrolType"] = "GROUND"
+	}
+
+	go p.run()
+	return p, nil
+}
+
+// patrols generates the SMART desktop patrols from the device tracks.
+// A patrol is uploaded on a schedule and when a track closes
+// after no points are received for the track gap.
+type patrols struct {
+	cfg    config.Patrol
+	tmpl   *template.Template
+	loc    *time.Location
+	upload func(dest *Destination, name string, content []byte) error
+	mtx    sync.Mutex
+	tracks map[string]*track
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+func (p *patrols) add(dest *Destination, points []*device.Data) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+	for _, point := range points {
+		key := dest.Server + "/" + dest.CA + "/" + point.ID
+		t, ok := p.tracks[key]
+		if !ok {
+			t = &track{
+				key:      key,
+				dest:     dest,
+				devID:    point.ID,
+				device:   point.Payload.DeviceName,
+				uploaded: now,
+			}
+			p.tracks[key] = t
+		}
+		t.received = now
+		t.insert(point)
+	}
+}
+
+func (p *patrols) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(patrolCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			p.check(time.Now(), true)
+			return
+		case now := <-ticker.C:
+			p.check(now, false)
+		}
+	}
+}
+
+// close stops the schedule and uploads all buffered tracks.
+func (p *patrols) close() {
+	close(p.quit)
+	<-p.done
+}
+
+// check uploads the tracks which are closed or due by the schedule.
+func (p *patrols) check(now time.Time, closeAll bool) {
+	type due struct {
+		t      *track
+		points []*device.Data
+	}
+	var uploads []due
+
+	p.mtx.Lock()
+	for key, t := range p.tracks {
+		closed := closeAll || now.Sub(t.received) >= time.Duration(p.cfg.TrackGap)
+		scheduled := p.cfg.Interval > 0 && now.Sub(t.uploaded) >= time.Duration(p.cfg.Interval)
+		if !closed && !scheduled {
+			continue
+		}
+		if closed {
+			delete(p.tracks, key)
+		}
+		if len(t.points) > 0 {
+			uploads = append(uploads, due{t: t, points: t.points})
+		}
+		t.points = nil
+		t.uploaded = now
+	}
+	p.mtx.Unlock()
+
+	for _, u := range uploads {
+		if err := p.send(u.t, u.points); err != nil {
+			log.Printf("[error] uploading the patrol for devName:%v err:%v", u.t.device, err)
+			if !closeAll {
+				p.requeue(u.t, u.points)
+			}
+		}
+	}
+}
+
+// requeue adds back the points of a failed upload so that
+// these are included in the next upload.
+func (p *patrols) requeue(t *track, points []*device.Data) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	cur, ok := p.tracks[t.key]
+	if !ok {
+		cur = t
+		p.tracks[t.key] = t
+	}
+	cur.insert(points...)
+}
+
+func (p *patrols) send(t *track, points []*device.Data) error {
+	data := &patrolData{
+		ID:       t.devID + "-" + strconv.FormatInt(points[0].Time, 10),
+		Device:   t.device,
+		Start:    time.Unix(points[0].Time, 0).In(p.loc),
+		End:      time.Unix(points[len(points)-1].Time, 0).In(p.loc),
+		Metadata: p.cfg.Metadata,
+	}
+
+	var err error
+	data.Track, err = trackWKT(points)
+	if err != nil {
+		return err
+	}
+
+	var day *patrolDay
+	var dayPoints []*device.Data
+	for i, point := range points {
+		ts := time.Unix(point.Time, 0).In(p.loc)
+		date := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, p.loc)
+		if day == nil || !day.Date.Equal(date) {
+			if day != nil {
+				if day.Track, err = trackWKT(dayPoints); err != nil {
+					return err
+				}
+				data.Days = append(data.Days, *day)
+			}
+			day = &patrolDay{Date: date, Start: ts}
+			dayPoints = nil
+		}
+		day.End = ts
+		day.Waypoints = append(day.Waypoints, patrolWaypoint{
+			ID:   i + 1,
+			X:    point.Lon,
+			Y:    point.Lat,
+			Time: ts,
+			Data: point,
+		})
+		dayPoints = append(dayPoints, point)
+	}
+	if day.Track, err = trackWKT(dayPoints); err != nil {
+		return err
+	}
+	data.Days = append(data.Days, *day)
+
+	b := &bytes.Buffer{}
+	if err := p.tmpl.Execute(b, data); err != nil {
+		return errors.Wrap(err, "executing the patrol template")
+	}
+
+	if os.Getenv("DEBUG") == "1" {
+		log.Printf("uploading patrol:%v points:%v", data.ID, len(points))
+	}
+	return p.upload(t.dest, data.ID+".xml", b.Bytes())
+}
+
+// trackWKT returns the WKT geometry of the points,
+// a point for a single point or otherwise a line string.
+func trackWKT(points []*device.Data) (string, error) {
+	var g geom.T
+	if len(points) == 1 {
+		g = geom.NewPoint(geom.XY).MustSetCoords(geom.Coord{points[0].Lon, points[0].Lat})
+	} else {
+		coords := make([]geom.Coord, 0, len(points))
+		for _, point := range points {
+			coords = append(coords, geom.Coord{point.Lon, point.Lat})
+		}
+		g = geom.NewLineString(geom.XY).MustSetCoords(coords)
+	}
+	s, err := wkt.Marshal(g)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal the track geometry")
+	}
+	return s, nil
+}
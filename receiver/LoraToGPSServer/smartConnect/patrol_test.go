@@ -0,0 +1,171 @@
+package smartConnect
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	// The patrol times are checked in a time zone which may not be installed.
+	_ "time/tzdata"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+)
+
+// update rewrites the golden files with the generated patrols,
+// go test ./smartConnect -run Patrol -update
+var update = flag.Bool("update", false, "update the golden files")
+
+// fakeUploads records the uploaded patrols and fails the upload while fail is set.
+type fakeUploads struct {
+	mtx   sync.Mutex
+	fail  bool
+	names []string
+	files [][]byte
+}
+
+func (f *fakeUploads) upload(dest *Destination, name string, content []byte) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.fail {
+		return errors.New("connection refused")
+	}
+	f.names = append(f.names, name)
+	f.files = append(f.files, content)
+	return nil
+}
+
+func newTestPatrols(t *testing.T, uploads *fakeUploads) *patrols {
+	t.Helper()
+	p, err := newPatrols(config.Patrol{
+		Interval: config.Duration(time.Hour),
+		TrackGap: config.Duration(2 * time.Hour),
+		TimeZone: "Africa/Nairobi",
+		Metadata: map[string]string{"team": "Rangers & Scouts", "station": "North gate", "employeeId": "ranger1"},
+	}, uploads.upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.close)
+	return p
+}
+
+func patrolPoint(lat, lon float64, fixTime int64) *device.Data {
+	return &device.Data{
+		ID:      "collar1-7076050000000401",
+		Payload: &device.DataUpPayload{DeviceName: "collar1"},
+		Lat:     lat,
+		Lon:     lon,
+		Time:    fixTime,
+		Valid:   true,
+	}
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Errorf("patrol:%v got:\n%s\nexpected:\n%s", name, got, expected)
+	}
+}
+
+func TestPatrolScheduledAndClosed(t *testing.T) {
+	uploads := &fakeUploads{}
+	p := newTestPatrols(t, uploads)
+	dest := &Destination{Server: "https://smart-connect:8443", CA: testCA}
+
+	// The points aren't in the fix time order and cross midnight in Nairobi.
+	// The point with the same fix time as an earlier one is skipped.
+	p.add(dest, []*device.Data{
+		patrolPoint(-1.2500, 36.8500, 1633203000), // 22:30 local time
+		patrolPoint(-1.2520, 36.8520, 1633210200), // 00:30 the next day
+		patrolPoint(-1.2510, 36.8510, 1633206600), // 23:30
+		patrolPoint(-1.2999, 36.8999, 1633206600),
+	})
+
+	// Due by the schedule but the track stays open.
+	p.check(time.Now().Add(time.Hour), false)
+	if len(uploads.files) != 1 {
+		t.Fatalf("uploads got:%v expected:1", len(uploads.files))
+	}
+	if name := uploads.names[0]; name != "collar1-7076050000000401-1633203000.xml" {
+		t.Errorf("file name got:%v", name)
+	}
+	checkGolden(t, "patrol_scheduled.xml", uploads.files[0])
+	if len(p.tracks) != 1 {
+		t.Fatalf("tracks got:%v expected the scheduled track to stay open", len(p.tracks))
+	}
+
+	// Not due yet because the track was just uploaded.
+	p.add(dest, []*device.Data{
+		patrolPoint(-1.2530, 36.8530, 1633213800),
+		patrolPoint(-1.2540, 36.8540, 1633217400),
+	})
+	p.check(time.Now().Add(30*time.Minute), false)
+	if len(uploads.files) != 1 {
+		t.Fatalf("uploads got:%v expected:1", len(uploads.files))
+	}
+
+	// Closed after no points for the track gap.
+	p.check(time.Now().Add(3*time.Hour), false)
+	if len(uploads.files) != 2 {
+		t.Fatalf("uploads got:%v expected:2", len(uploads.files))
+	}
+	checkGolden(t, "patrol_closed.xml", uploads.files[1])
+	if len(p.tracks) != 0 {
+		t.Errorf("tracks got:%v expected the closed track to be removed", len(p.tracks))
+	}
+}
+
+func TestPatrolRequeue(t *testing.T) {
+	uploads := &fakeUploads{fail: true}
+	p := newTestPatrols(t, uploads)
+	dest := &Destination{Server: "https://smart-connect:8443", CA: testCA}
+
+	p.add(dest, []*device.Data{
+		patrolPoint(-1.2500, 36.8500, 1633203000),
+		patrolPoint(-1.2510, 36.8510, 1633206600),
+	})
+	p.check(time.Now().Add(time.Hour), false)
+	if len(uploads.files) != 0 {
+		t.Fatalf("uploads got:%v expected:0", len(uploads.files))
+	}
+
+	// The next upload includes the points of the failed upload.
+	p.add(dest, []*device.Data{patrolPoint(-1.2520, 36.8520, 1633210200)})
+	uploads.fail = false
+	p.check(time.Now().Add(3*time.Hour), false)
+	if len(uploads.files) != 1 {
+		t.Fatalf("uploads got:%v expected:1", len(uploads.files))
+	}
+	if name := uploads.names[0]; name != "collar1-7076050000000401-1633203000.xml" {
+		t.Errorf("file name got:%v", name)
+	}
+	checkGolden(t, "patrol_requeued.xml", uploads.files[0])
+
+	// A closed track is also requeued when its upload fails.
+	p.add(dest, []*device.Data{patrolPoint(-1.2530, 36.8530, 1633213800)})
+	uploads.fail = true
+	p.check(time.Now().Add(3*time.Hour), false)
+	if len(p.tracks) != 1 {
+		t.Fatalf("tracks got:%v expected the failed track to be requeued", len(p.tracks))
+	}
+	uploads.fail = false
+	p.check(time.Now().Add(3*time.Hour), false)
+	if len(uploads.files) != 2 || len(p.tracks) != 0 {
+		t.Errorf("uploads got:%v tracks:%v expected the requeued track to be uploaded", len(uploads.files), len(p.tracks))
+	}
+}
@@ -2,7 +2,6 @@ package smartConnect
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,37 +11,52 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
 	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
-	"github.com/twpayne/go-geom"
-	"github.com/twpayne/go-geom/encoding/wkt"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/httpclient"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/worker"
+	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
 )
 
 // NewHandler creates a new alert type handler.
-func NewHandler(m *device.Manager) *Handler {
+func NewHandler(m *device.Manager, cfg config.SmartConnect) (*Handler, error) {
+	routes, err := newRoutes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	styles, err := newStyles(cfg.Styles)
+	if err != nil {
+		return nil, err
+	}
+	client, err := httpclient.New(cfg.Client)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the SMART connect http client")
+	}
 	a := &Handler{
 		devManager: m,
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			},
-		},
-		allDevIDs: make(map[string]string),
-		careasBuf: make(map[string]struct{}),
-	}
-	return a
+		routes:     routes,
+		styles:     styles,
+		httpClient: client,
+		allDevIDs:  make(map[string]string),
+		careasBuf:  make(map[string]struct{}),
+	}
+	if cfg.Patrol != nil {
+		a.patrols, err = newPatrols(*cfg.Patrol, a.createPatrolUpload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
 }
 
 // Handler is the alert type handler struct.
 type Handler struct {
-	server,
-	user,
-	pass,
-	ca string
 	httpClient *http.Client
 	// allDevIDs is used to reduce the SMART connect API calls
 	// when checking if an alert type exists.
@@ -52,170 +66,224 @@ type Handler struct {
 	careasBuf  map[string]struct{}
 	mtx        sync.Mutex
 	devManager *device.Manager
+	routes     []*route
+	// styles always ends with the default style.
+	styles []*style
+	// patrols is nil when the SMART desktop uploads are disabled.
+	patrols *patrols
+	// pool is nil when the points are sent before replying.
+	pool *worker.Pool
+}
+
+// Close uploads the buffered patrols.
+func (s *Handler) Close() {
+	if s.patrols != nil {
+		s.patrols.close()
+	}
 }
 
 func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	data, err := s.devManager.Parse(r)
+	points, err := s.devManager.Parse(r)
 	if err != nil {
 		httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.SetPrefix("devName:" + data.Payload.DeviceName + ", msg:")
-	defer log.SetPrefix("")
 
-	if !data.Valid {
-		if os.Getenv("DEBUG") == "1" {
-			log.Printf("skipping data with invalid gps coords, body:%+v", data)
+	if s.pool != nil && len(points) > 0 {
+		err := s.pool.TrySubmit(points[0].ID, func() {
+			if err := s.Send(points); err != nil {
+				log.Printf("[error] sending to SMART connect err:%v", err)
+			}
+		})
+		if err != nil {
+			s.devManager.Forget(points)
+			if !worker.Unavailable(w, err) {
+				httpError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
 		}
-		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
 
-	if !data.Valid && os.Getenv("DEBUG") == "1" {
-		log.Printf("skipping data with invalid gps coords, body:%+v", data)
-		w.WriteHeader(http.StatusOK)
+	if err := s.Send(points); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	server, ok := r.Header["Smartserver"]
-	if !ok || len(server) != 1 {
-		httpError(w, "missing or incorrect SmartServer header", http.StatusBadRequest)
-		return
-	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	_, err = url.ParseRequestURI(server[0])
-	if err != nil {
-		httpError(w, "invalid SmartServer url format expected: https://serverNameOrIP", http.StatusBadRequest)
-		return
+// SetPool sends the points in the background by the worker pool
+// and the requests are answered once the points are queued.
+func (s *Handler) SetPool(p *worker.Pool) {
+	s.pool = p
+}
+
+// Send creates the alerts for the points in
+// the conservation area of the first matching route.
+func (s *Handler) Send(points []*device.Data) error {
+	dests, groups := s.destinations(points)
+	var errs error
+	for _, dest := range dests {
+		if err := s.send(dest, groups[dest]); err != nil {
+			errs = multierror.Append(errs, err)
+		}
 	}
+	return errs
+}
 
-	user, ok := r.Header["Smartuser"]
-	if !ok || len(user) != 1 {
-		httpError(w, "missing or incorrect SmartUser header", http.StatusBadRequest)
-		return
+// destinations groups the points by their destination.
+// The destinations are returned in the order of the first point for each.
+func (s *Handler) destinations(points []*device.Data) ([]*Destination, map[*Destination][]*device.Data) {
+	var dests []*Destination
+	groups := make(map[*Destination][]*device.Data)
+	for _, point := range points {
+		var dest *Destination
+		for _, r := range s.routes {
+			if r.match(point) {
+				dest = r.dest
+				break
+			}
+		}
+		if dest == nil {
+			if os.Getenv("DEBUG") == "1" {
+				log.Printf("skipping data without a matching SMART connect route devName:%v", point.Payload.DeviceName)
+			}
+			continue
+		}
+		if _, ok := groups[dest]; !ok {
+			dests = append(dests, dest)
+		}
+		groups[dest] = append(groups[dest], point)
 	}
-	pass, ok := r.Header["Smartpass"]
-	if !ok || len(pass) != 1 {
-		httpError(w, "missing or incorrect SmartPass header", http.StatusBadRequest)
-		return
+	return dests, groups
+}
+
+// send creates a connect alert for each valid point.
+// The points of a locations log are sent in fix time order
+// so that the track in SMART connect follows the fix times.
+func (s *Handler) send(dest *Destination, points []*device.Data) error {
+	var valid []*device.Data
+	for _, point := range points {
+		if !point.Valid {
+			if os.Getenv("DEBUG") == "1" {
+				log.Printf("skipping data with invalid gps coords, body:%+v", point)
+			}
+			continue
+		}
+		valid = append(valid, point)
 	}
-	carea, ok := r.Header["Smartcarea"]
-	if !ok || len(carea) != 1 {
-		httpError(w, "missing or incorrect SmartCarea header", http.StatusBadRequest)
-		return
+	if len(valid) == 0 {
+		return nil
 	}
+	sort.SliceStable(valid, func(i, j int) bool {
+		return valid[i].Time < valid[j].Time
+	})
 
-	s.server = server[0]
-	s.user = user[0]
-	s.pass = pass[0]
-	s.ca = carea[0]
+	if err := s.checkCarea(dest); err != nil {
+		return err
+	}
 
-	if _, ok := s.careasBuf[carea[0]]; !ok {
-		exists, err := s.careaExists(carea[0])
-		if err != nil {
-			httpError(w, "checking if a  conservation area exists, err:"+err.Error(), http.StatusBadRequest)
-			return
-		}
-		if !exists {
-			httpError(w, "conservation area doesn't exist:"+carea[0], http.StatusNotFound)
-			return
-		}
+	if s.patrols != nil {
+		s.patrols.add(dest, valid)
+	}
 
-		// Reset the buffer if too big.
-		if len(s.careasBuf) > 100 {
-			s.careasBuf = make(map[string]struct{})
+	var errs error
+	for _, point := range valid {
+		if err := s.createAlert(dest, point); err != nil {
+			errs = multierror.Append(errs, errors.Wrapf(err, "creating an alert for devName:%v fix time:%v", point.Payload.DeviceName, point.Time))
 		}
-		s.careasBuf[carea[0]] = struct{}{}
 	}
+	return errs
+}
 
-	if err := s.createAlert(w, r, data); err != nil {
-		httpError(w, "creating an alert err:"+err.Error(), http.StatusBadRequest)
-		return
+// checkCarea checks that the conservation area exists
+// only on the first request for each server and area.
+func (s *Handler) checkCarea(dest *Destination) error {
+	key := dest.Server + "/" + dest.CA
+
+	s.mtx.Lock()
+	_, ok := s.careasBuf[key]
+	s.mtx.Unlock()
+	if ok {
+		return nil
 	}
 
-	fileContent, ok := r.Header["Smartdesktopfile"]
-	if !ok || len(fileContent) != 1 {
-		if os.Getenv("DEBUG") == "1" {
-			log.Printf("Smartdesktopfile header is empty so NOT creating an upload for SMART desktop")
-		}
-	} else {
-		if err := s.createPatrolUpload(w, r, []byte(fileContent[0])); err != nil {
-			httpError(w, "creating an upload err:"+err.Error(), http.StatusBadRequest)
-		}
-		log.Println("new upload created")
+	exists, err := s.careaExists(dest)
+	if err != nil {
+		return errors.Wrap(err, "checking if a  conservation area exists")
+	}
+	if !exists {
+		return errors.New("conservation area doesn't exist:" + dest.CA)
 	}
 
-	w.WriteHeader(http.StatusOK)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// Reset the buffer if too big.
+	if len(s.careasBuf) > 100 {
+		s.careasBuf = make(map[string]struct{})
+	}
+	s.careasBuf[key] = struct{}{}
+	return nil
 }
 
-func (s *Handler) createAlert(w http.ResponseWriter, r *http.Request, data *device.Data) error {
-	var err error
+func (s *Handler) createAlert(dest *Destination, data *device.Data) error {
+	st := s.style(data)
+	label := st.label(data)
 
-	// When the device id is present in all alerts map this guarantees that
-	// the alert type exists so no need to create it.
+	// When the label is present in all alerts map this guarantees that
+	// the alert type exists with the current style so no need to check it.
+	// The alert types are per server.
+	key := dest.Server + "/" + label
 	s.mtx.Lock()
-	alertID, ok := s.allDevIDs[data.ID]
+	alertID, ok := s.allDevIDs[key]
 	s.mtx.Unlock()
 	if !ok {
-		alertID, err = s.alertID(data.ID)
+		alertType, err := s.alertType(dest, label)
 		if err != nil {
-
-			return fmt.Errorf("getting the alert id by the device ID:%v err:%v", data.ID, err)
+			return fmt.Errorf("getting the alert type by the label:%v err:%v", label, err)
 		}
-		// AlertID with this devID doesn't exists so need to create it.
-		if alertID == "" {
-			log.Println("alert type with the given device label doesn't exist so creating a new one dev id:", data.ID)
-			alertID, err = s.createAlertType(data.ID)
+		if alertType == nil {
+			// Alert type with this label doesn't exists so need to create it.
+			log.Println("alert type with the given device label doesn't exist so creating a new one label:", label)
+			alertID, err = s.createAlertType(dest, st.alertType(label))
 			if err != nil {
-				return fmt.Errorf("creating a new alertType for devID:%v err:%v", data.ID, err)
+				return fmt.Errorf("creating a new alertType for label:%v err:%v", label, err)
+			}
+		} else {
+			alertID = alertType.UUID
+			if !st.same(alertType) {
+				log.Println("alert type style has changed so updating it label:", label)
+				if err := s.updateAlertType(dest, alertID, st.alertType(label)); err != nil {
+					return fmt.Errorf("updating the alertType for label:%v err:%v", label, err)
+				}
 			}
 		}
 		s.mtx.Lock()
-		s.allDevIDs[data.ID] = alertID
+		s.allDevIDs[key] = alertID
 		s.mtx.Unlock()
 	}
 
-	url := s.server + "/server/api/connectalert/"
-	// Use the same alert identifier when want to have a continious line
-	// or use the current time as unique identifier when want to display each alert as an  individual point.
+	url := dest.Server + "/server/api/connectalert/"
+	// Use the same alert identifier when want to display only the last position as a single point
+	// or a unique identifier for each fix when want to display a continious line.
 	if _, single := data.Attr["s"]; single {
 		url += data.ID
 	} else {
-		url += strconv.Itoa(int(time.Now().UnixNano()))
+		url += data.ID + "-" + strconv.FormatInt(data.Time, 10)
 	}
 
-	var jsonStr = []byte(`
-	{
-		"type":"FeatureCollection",
-		"features":[
-			{
-				"type":"Feature",
-				"geometry":	{
-					"type":"Point",
-					"coordinates":["` + strconv.FormatFloat(data.Lon, 'f', -1, 64) + `","` + strconv.FormatFloat(data.Lat, 'f', -1, 64) + `"]
-				},
-				"properties":{
-					"deviceId":"` + data.ID + `",
-					"id":"0",
-					"latitude":0,
-					"longitude":0,
-					"altitude":0,
-					"accuracy":0,
-					"caUuid":"` + s.ca + `",
-					"level":"1",
-					"description":"",
-					"typeUuid":"` + alertID + `",
-					"sighting":{}
-					}
-			}
-		]
-	}`)
+	jsonStr, err := json.Marshal(newAlert(dest, data, alertID, st.cfg.Level))
+	if err != nil {
+		return fmt.Errorf("marshal the alert err:%v", err)
+	}
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
 	if err != nil {
 		return fmt.Errorf("creating a request err:%v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(s.user, s.pass)
+	req.SetBasicAuth(dest.User, dest.Pass)
 
 	res, err := s.httpClient.Do(req)
 	if err != nil {
@@ -250,30 +318,27 @@ func (s *Handler) createAlert(w http.ResponseWriter, r *http.Request, data *devi
 	return nil
 }
 
-func (s *Handler) createPatrolUpload(w http.ResponseWriter, r *http.Request, fileContent []byte) error {
-	_, _ = wkt.Marshal(geom.NewPoint(geom.XY).MustSetCoords(geom.Coord{1, 2}))
-	// if err != nil {
-	// 	return fmt.Errorf("marshal geo location err:%v", err)
-	// }
-	fileName := "patrol.xml"
+// createPatrolUpload adds a patrol xml file to the SMART desktop upload queue.
+func (s *Handler) createPatrolUpload(dest *Destination, fileName string, fileContent []byte) error {
 	requestJSON := []byte(`
 	{
-		"conservationArea":"` + s.ca + `",
+		"conservationArea":"` + dest.CA + `",
 		"type":"PATROL_XML",
 		"name":"` + fileName + `"
 	 }
 	`)
-	req, err := http.NewRequest("POST", s.server+"/server/api/dataqueue/items/", bytes.NewBuffer(requestJSON))
+	req, err := http.NewRequest("POST", dest.Server+"/server/api/dataqueue/items/", bytes.NewBuffer(requestJSON))
 	if err != nil {
 		return fmt.Errorf("creating an upload request err:%v", err)
 	}
-	req.SetBasicAuth(s.user, s.pass)
+	req.SetBasicAuth(dest.User, dest.Pass)
 	req.Header.Add("X-Upload-Content-Length", strconv.Itoa(len(fileContent)))
 	req.Header.Set("Content-Type", "application/json")
 	res, err := s.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("sending file upload request err:%v", err)
 	}
+	res.Body.Close()
 	if res.StatusCode/100 != 2 {
 		return fmt.Errorf("unexpected response status code:%v", res.StatusCode)
 	}
@@ -282,7 +347,6 @@ func (s *Handler) createPatrolUpload(w http.ResponseWriter, r *http.Request, fil
 	if err != nil {
 		return fmt.Errorf("getting response location err:%v", err)
 	}
-	res.Body.Close()
 
 	// Make the actual file upload.
 	{
@@ -301,7 +365,7 @@ func (s *Handler) createPatrolUpload(w http.ResponseWriter, r *http.Request, fil
 		}
 
 		req.Header.Add("Content-Type", writer.FormDataContentType())
-		req.SetBasicAuth(s.user, s.pass)
+		req.SetBasicAuth(dest.User, dest.Pass)
 		res, err := s.httpClient.Do(req)
 		if err != nil {
 			return fmt.Errorf("sending the upload request err:%v", err)
@@ -315,14 +379,14 @@ func (s *Handler) createPatrolUpload(w http.ResponseWriter, r *http.Request, fil
 	return nil
 }
 
-func (s *Handler) careaExists(ca string) (bool, error) {
-	url := s.server + "/server/api/conservationarea"
+func (s *Handler) careaExists(dest *Destination) (bool, error) {
+	url := dest.Server + "/server/api/conservationarea"
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return false, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(s.user, s.pass)
+	req.SetBasicAuth(dest.User, dest.Pass)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
@@ -343,17 +407,17 @@ func (s *Handler) careaExists(ca string) (bool, error) {
 		log.Println("CA area check response body:", string(body))
 	}
 
-	return strings.Contains(string(body), `"uuid":"`+s.ca+`"`), nil
+	return strings.Contains(string(body), `"uuid":"`+dest.CA+`"`), nil
 }
 
-func (s *Handler) createCarea(data *device.Data) error {
-	url := s.server + "/server/api/conservationarea?cauuid=" + s.ca + "&name=" + data.Payload.ApplicationName
+func (s *Handler) createCarea(dest *Destination, data *device.Data) error {
+	url := dest.Server + "/server/api/conservationarea?cauuid=" + dest.CA + "&name=" + data.Payload.ApplicationName
 	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(s.user, s.pass)
+	req.SetBasicAuth(dest.User, dest.Pass)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
@@ -367,61 +431,57 @@ func (s *Handler) createCarea(data *device.Data) error {
 	return nil
 }
 
-func (s *Handler) alertID(devID string) (string, error) {
-	url := s.server + "/server/api/connectalert/alertTypes"
+// alertType returns the alert type with the label or nil when it doesn't exist.
+func (s *Handler) alertType(dest *Destination, label string) (*SMARTAlertType, error) {
+	url := dest.Server + "/server/api/connectalert/alertTypes"
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(s.user, s.pass)
+	req.SetBasicAuth(dest.User, dest.Pass)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("invalid status code response: %v", resp.Status)
+		return nil, fmt.Errorf("invalid status code response: %v", resp.Status)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	alertTypes := make([]SMARTAlertType, 0)
 	err = json.Unmarshal(body, &alertTypes)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	for _, alertType := range alertTypes {
-		if alertType.Label == devID {
-			return alertType.UUID, nil
+		if alertType.Label == label {
+			return &alertType, nil
 		}
 	}
-	return "", nil
+	return nil, nil
 }
 
-func (s *Handler) createAlertType(label string) (string, error) {
-	url := s.server + "/server/api/connectalert/alertTypes/" + label
+func (s *Handler) createAlertType(dest *Destination, alertType alertTypeStyle) (string, error) {
+	url := dest.Server + "/server/api/connectalert/alertTypes/" + url.PathEscape(alertType.Label)
 
-	var jsonStr = []byte(`
-	{
-		"label":"` + label + `",
-		"color":"FF0000",
-		"opacity":".80",
-		"markerIcon":"car",
-		"markerColor":"black",
-		"spin":"false"
-	  }`)
+	jsonStr, err := json.Marshal(alertType)
+	if err != nil {
+		return "", err
+	}
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonStr))
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(s.user, s.pass)
+	req.SetBasicAuth(dest.User, dest.Pass)
 
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
@@ -433,22 +493,53 @@ func (s *Handler) createAlertType(label string) (string, error) {
 		log.Println("reading the response body err:", err)
 	}
 	if resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("invalid status code:%v body:%v request:%v", resp.Status, body, jsonStr)
+		return "", fmt.Errorf("invalid status code:%v body:%v request:%v", resp.Status, string(body), string(jsonStr))
 	}
 
 	response := &SMARTAlertType{}
 	err = json.Unmarshal(body, response)
 	if err != nil {
-		return "", fmt.Errorf("unmarshal the response reply err:%v , response body:%v", err, body)
+		return "", fmt.Errorf("unmarshal the response reply err:%v , response body:%v", err, string(body))
 	}
 	return response.UUID, nil
 }
 
+func (s *Handler) updateAlertType(dest *Destination, uuid string, alertType alertTypeStyle) error {
+	url := dest.Server + "/server/api/connectalert/alertTypes/" + uuid
+
+	jsonStr, err := json.Marshal(alertType)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(dest.User, dest.Pass)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("invalid status code:%v body:%v request:%v", resp.Status, string(body), string(jsonStr))
+	}
+	return nil
+}
+
 // SMARTAlertType details.
 type SMARTAlertType struct {
-	UUID     string `json:"uuid"`
-	TypeUUID string `json:"typeUuid"`
-	Label    string `json:"label"`
+	UUID        string     `json:"uuid"`
+	TypeUUID    string     `json:"typeUuid"`
+	Label       string     `json:"label"`
+	Color       flexString `json:"color"`
+	Opacity     flexString `json:"opacity"`
+	MarkerIcon  flexString `json:"markerIcon"`
+	MarkerColor flexString `json:"markerColor"`
+	Spin        flexString `json:"spin"`
 }
 
 func httpError(w http.ResponseWriter, error string, code int) {
@@ -0,0 +1,237 @@
+package smartConnect
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+)
+
+// manager is shared by the tests because its metrics can be registered only once.
+var manager = device.NewManager()
+
+const (
+	testCA       = "2f2c9e0a-6c3e-4b1b-9d5e-1a2b3c4d5e6f"
+	testTypeUUID = "8d7c6b5a-4f3e-4d2c-9b1a-0f1e2d3c4b5a"
+)
+
+// fakeSmart is a local SMART connect API which records the created alerts.
+type fakeSmart struct {
+	mtx        sync.Mutex
+	alertTypes []SMARTAlertType
+	alerts     []fakeAlert
+}
+
+type fakeAlert struct {
+	path  string
+	props alertProperties
+}
+
+func (f *fakeSmart) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "smart" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/server/api/conservationarea":
+		fmt.Fprintf(w, `[{"uuid":"%v","label":"park"}]`, testCA)
+	case r.Method == http.MethodGet && r.URL.Path == "/server/api/connectalert/alertTypes":
+		json.NewEncoder(w).Encode(f.alertTypes)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/server/api/connectalert/alertTypes/"):
+		t := SMARTAlertType{UUID: testTypeUUID, Label: strings.TrimPrefix(r.URL.Path, "/server/api/connectalert/alertTypes/")}
+		f.alertTypes = append(f.alertTypes, t)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/server/api/connectalert/"):
+		fc := &alertFeatureCollection{}
+		if err := json.NewDecoder(r.Body).Decode(fc); err != nil || len(fc.Features) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.alerts = append(f.alerts, fakeAlert{path: r.URL.Path, props: fc.Features[0].Properties})
+		fmt.Fprintf(w, `{"typeUuid":"%v"}`, testTypeUUID)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestHandler(t *testing.T) (*Handler, *fakeSmart) {
+	t.Helper()
+	fake := &fakeSmart{}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	h, err := NewHandler(manager, config.SmartConnect{
+		Servers: []config.SmartServer{{
+			Name:              "park",
+			URL:               srv.URL,
+			User:              "smart",
+			Pass:              "secret",
+			ConservationAreas: map[string]string{"north": testCA},
+		}},
+		Routes: []config.SmartRoute{{Server: "park", ConservationArea: "north"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, fake
+}
+
+// uplink is a chirpstack v4 uplink event.
+func uplink(devEUI, devType string, fPort int, data []byte, object string) []byte {
+	return []byte(fmt.Sprintf(`{
+		"deviceInfo": {
+			"applicationId": "1",
+			"applicationName": "gpsTracker",
+			"deviceName": "tracker",
+			"devEui": "%v",
+			"tags": {"type": "%v"}
+		},
+		"fCnt": 1,
+		"fPort": %v,
+		"data": "%v",
+		"object": %v,
+		"rxInfo": [{"gatewayId": "0000000000000001", "rssi": -80, "snr": 5.5}]
+	}`, devEUI, devType, fPort, base64.StdEncoding.EncodeToString(data), object))
+}
+
+func post(t *testing.T, h http.Handler, body []byte) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/smartConnect", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		b, _ := ioutil.ReadAll(w.Body)
+		t.Fatalf("status got:%v expected:%v body:%v", w.Code, http.StatusOK, string(b))
+	}
+}
+
+func TestServeHTTPLocationsLog(t *testing.T) {
+	h, fake := newTestHandler(t)
+
+	// The log isn't in the fix time order and the invalid location has no alert.
+	post(t, h, uplink("7076050000000101", "irnas", 11, nil, `{"locations": [
+		{"lat": -1.252, "lon": 36.852, "time": 1633170600},
+		{"lat": -1.250, "lon": 36.850, "time": 1633168800},
+		{"lat": 0, "lon": 0, "time": 1633169400},
+		{"lat": -1.251, "lon": 36.851, "time": 1633169700}
+	]}`))
+
+	devID := "tracker-7076050000000101"
+	expected := []struct {
+		time     int64
+		lat, lon float64
+	}{
+		{1633168800, -1.250, 36.850},
+		{1633169700, -1.251, 36.851},
+		{1633170600, -1.252, 36.852},
+	}
+	if len(fake.alerts) != len(expected) {
+		t.Fatalf("alerts got:%v expected:%v", len(fake.alerts), len(expected))
+	}
+	for i, e := range expected {
+		a := fake.alerts[i]
+		if path := fmt.Sprintf("/server/api/connectalert/%v-%v", devID, e.time); a.path != path {
+			t.Errorf("alert:%v path got:%v expected:%v", i, a.path, path)
+		}
+		if a.props.Latitude != e.lat || a.props.Longitude != e.lon {
+			t.Errorf("alert:%v position got:%v,%v expected:%v,%v", i, a.props.Latitude, a.props.Longitude, e.lat, e.lon)
+		}
+		if a.props.DeviceID != devID || a.props.CaUUID != testCA || a.props.TypeUUID != testTypeUUID {
+			t.Errorf("alert:%v properties got:%+v", i, a.props)
+		}
+	}
+	if len(fake.alertTypes) != 1 || fake.alertTypes[0].Label != devID {
+		t.Errorf("alert types got:%+v expected a single type with the device ID label", fake.alertTypes)
+	}
+}
+
+func TestServeHTTPSinglePoint(t *testing.T) {
+	h, fake := newTestHandler(t)
+
+	tests := []struct {
+		name   string
+		devEUI string
+		data   string
+		path   string
+	}{
+		{name: "single point", devEUI: "7076050000000201", data: "-1.25,36.85,s", path: "/server/api/connectalert/tracker-7076050000000201"},
+		{name: "track point", devEUI: "7076050000000202", data: "-1.25,36.85", path: "/server/api/connectalert/tracker-7076050000000202-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.alerts = nil
+			post(t, h, uplink(tt.devEUI, "rpi", 1, []byte(tt.data), "null"))
+			if len(fake.alerts) != 1 {
+				t.Fatalf("alerts got:%v expected:1", len(fake.alerts))
+			}
+			path := fake.alerts[0].path
+			// The track points have a fix time suffix so only the single point path is fixed.
+			if strings.HasSuffix(tt.path, "-") && !strings.HasPrefix(path, tt.path) || !strings.HasSuffix(tt.path, "-") && path != tt.path {
+				t.Errorf("path got:%v expected:%v", path, tt.path)
+			}
+		})
+	}
+}
+
+func TestNewHandlerConfigErrors(t *testing.T) {
+	server := func(url string, areas map[string]string) config.SmartServer {
+		return config.SmartServer{Name: "park", URL: url, ConservationAreas: areas}
+	}
+	tests := []struct {
+		name string
+		cfg  config.SmartConnect
+		err  string
+	}{
+		{
+			name: "invalid url",
+			cfg:  config.SmartConnect{Servers: []config.SmartServer{server("smart-connect", map[string]string{"north": testCA})}},
+			err:  "invalid url for server:park",
+		},
+		{
+			name: "unknown server",
+			cfg: config.SmartConnect{
+				Servers: []config.SmartServer{server("https://smart-connect:8443", map[string]string{"north": testCA})},
+				Routes:  []config.SmartRoute{{Server: "reserve", ConservationArea: "north"}},
+			},
+			err: "route:0 unknown server:reserve",
+		},
+		{
+			name: "unknown conservation area",
+			cfg: config.SmartConnect{
+				Servers: []config.SmartServer{server("https://smart-connect:8443", map[string]string{"north": testCA})},
+				Routes:  []config.SmartRoute{{Server: "park", ConservationArea: "south"}},
+			},
+			err: "route:0 unknown conservation area:south for server:park",
+		},
+		{
+			name: "empty conservation area uuid",
+			cfg: config.SmartConnect{
+				Servers: []config.SmartServer{server("https://smart-connect:8443", map[string]string{"default": ""})},
+				Routes:  []config.SmartRoute{{Server: "park", ConservationArea: "default"}},
+			},
+			err: "route:0 empty uuid for conservation area:default of server:park",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHandler(manager, tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error got:%v expected:%v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package smartConnect
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/pkg/errors"
+)
+
+// defaultStyle is used for the devices without a matching style
+// and for the fields which are not set in the config.
+var defaultStyle = config.SmartStyle{
+	Label:       "{id}",
+	Color:       "FF0000",
+	Opacity:     ".80",
+	MarkerIcon:  "car",
+	MarkerColor: "black",
+	Level:       1,
+}
+
+// alertTypeStyle is the alert type request body.
+type alertTypeStyle struct {
+	Label       string `json:"label"`
+	Color       string `json:"color"`
+	Opacity     string `json:"opacity"`
+	MarkerIcon  string `json:"markerIcon"`
+	MarkerColor string `json:"markerColor"`
+	Spin        string `json:"spin"`
+}
+
+type style struct {
+	tags         map[string]string
+	species      map[string]struct{}
+	applications map[string]struct{}
+	cfg          config.SmartStyle
+}
+
+func newStyles(cfgs []config.SmartStyle) ([]*style, error) {
+	var styles []*style
+	for i, cfg := range cfgs {
+		if cfg.Level < 0 || cfg.Level > 5 {
+			return nil, errors.Errorf("style:%v invalid alert level:%v", i, cfg.Level)
+		}
+		if cfg.Opacity != "" {
+			if _, err := strconv.ParseFloat(cfg.Opacity, 64); err != nil {
+				return nil, errors.Errorf("style:%v invalid opacity:%v", i, cfg.Opacity)
+			}
+		}
+		if cfg.Label == "" {
+			cfg.Label = defaultStyle.Label
+		}
+		if cfg.Color == "" {
+			cfg.Color = defaultStyle.Color
+		}
+		if cfg.Opacity == "" {
+			cfg.Opacity = defaultStyle.Opacity
+		}
+		if cfg.MarkerIcon == "" {
+			cfg.MarkerIcon = defaultStyle.MarkerIcon
+		}
+		if cfg.MarkerColor == "" {
+			cfg.MarkerColor = defaultStyle.MarkerColor
+		}
+		if cfg.Level == 0 {
+			cfg.Level = defaultStyle.Level
+		}
+
+		st := &style{
+			tags:         cfg.Tags,
+			species:      make(map[string]struct{}),
+			applications: make(map[string]struct{}),
+			cfg:          cfg,
+		}
+		for _, sp := range cfg.Species {
+			st.species[sp] = struct{}{}
+		}
+		for _, a := range cfg.Applications {
+			st.applications[a] = struct{}{}
+		}
+		styles = append(styles, st)
+	}
+	styles = append(styles, &style{cfg: defaultStyle})
+	return styles, nil
+}
+
+func (s *style) match(data *device.Data) bool {
+	for k, v := range s.tags {
+		if data.Payload.Tags[k] != v {
+			return false
+		}
+	}
+	if len(s.species) > 0 {
+		if _, ok := s.species[data.Payload.Tags["species"]]; !ok {
+			return false
+		}
+	}
+	if len(s.applications) > 0 {
+		_, byName := s.applications[data.Payload.ApplicationName]
+		_, byID := s.applications[data.Payload.ApplicationID]
+		if !byName && !byID {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *style) label(data *device.Data) string {
+	return strings.NewReplacer("{id}", data.ID, "{name}", data.Payload.DeviceName).Replace(s.cfg.Label)
+}
+
+func (s *style) alertType(label string) alertTypeStyle {
+	return alertTypeStyle{
+		Label:       label,
+		Color:       s.cfg.Color,
+		Opacity:     s.cfg.Opacity,
+		MarkerIcon:  s.cfg.MarkerIcon,
+		MarkerColor: s.cfg.MarkerColor,
+		Spin:        strconv.FormatBool(s.cfg.Spin),
+	}
+}
+
+// same checks if an existing alert type has this style.
+func (s *style) same(at *SMARTAlertType) bool {
+	if !strings.EqualFold(string(at.Color), s.cfg.Color) ||
+		string(at.MarkerIcon) != s.cfg.MarkerIcon ||
+		!strings.EqualFold(string(at.MarkerColor), s.cfg.MarkerColor) {
+		return false
+	}
+	spin, _ := strconv.ParseBool(string(at.Spin))
+	if spin != s.cfg.Spin {
+		return false
+	}
+	// The opacity can be returned in a different format like 0.8 for .80.
+	have, err := strconv.ParseFloat(string(at.Opacity), 64)
+	if err != nil {
+		return false
+	}
+	want, _ := strconv.ParseFloat(s.cfg.Opacity, 64)
+	return have == want
+}
+
+// style returns the first style which matches the device.
+func (s *Handler) style(data *device.Data) *style {
+	for _, st := range s.styles {
+		if st.match(data) {
+			return st
+		}
+	}
+	return s.styles[len(s.styles)-1]
+}
+
+// flexString decodes a json string, number or bool as a string
+// so that the alert types are decoded regardless of the field types.
+type flexString string
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (f *flexString) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+		*f = ""
+	case string:
+		*f = flexString(v)
+	default:
+		*f = flexString(fmt.Sprint(v))
+	}
+	return nil
+}
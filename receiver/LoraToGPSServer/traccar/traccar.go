@@ -1,7 +1,6 @@
 package traccar
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,32 +9,40 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"sync"
 
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/config"
 	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/httpclient"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/worker"
 	"github.com/brocaar/lorawan"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
 )
 
 // NewHandler creates a new alert type handler.
-func NewHandler(m *device.Manager) *Handler {
+func NewHandler(m *device.Manager, cfg config.Client) (*Handler, error) {
+	client, err := httpclient.New(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the traccar http client")
+	}
 	a := &Handler{
 		devManager: m,
 		lastAttrs:  make(map[lorawan.EUI64]map[string]string),
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			},
-		},
+		httpClient: client,
 	}
-	return a
+	return a, nil
 }
 
 // Handler is the alert type handler struct.
 type Handler struct {
 	httpClient *http.Client
 	devManager *device.Manager
-	lastAttrs  map[lorawan.EUI64]map[string]string
+	// lastAttrs is shared between the HTTP and MQTT ingestion.
+	lastAttrs map[lorawan.EUI64]map[string]string
+	mtx       sync.Mutex
+	// pool is nil when the points are sent before replying.
+	pool *worker.Pool
 }
 
 func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -56,97 +63,122 @@ func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		httpError(w, "invalid traccarServer url format expected: http://serverNameOrIP", http.StatusBadRequest)
 		return
 	}
+
+	if s.pool != nil && len(points) > 0 {
+		err := s.pool.TrySubmit(points[0].ID, func() {
+			if err := s.Send(server[0], points); err != nil {
+				log.Printf("[error] sending to traccar err:%v", err)
+			}
+		})
+		if err != nil {
+			s.devManager.Forget(points)
+			if !worker.Unavailable(w, err) {
+				httpError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if err := s.Send(server[0], points); err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetPool sends the points in the background by the worker pool
+// and the requests are answered once the points are queued.
+func (s *Handler) SetPool(p *worker.Pool) {
+	s.pool = p
+}
+
+// Send creates a traccar position for each valid point.
+func (s *Handler) Send(server string, points []*device.Data) error {
 	var errs error
 
 	for _, point := range points {
-		log.SetPrefix("devName:" + point.Payload.DeviceName + ", msg:")
-		defer log.SetPrefix("")
-
+		s.mtx.Lock()
 		for n, v := range point.Attr {
+			// The alarms are only for the point which triggered them.
+			if device.IsEventAttr(n) {
+				continue
+			}
 			s.lastAttrs[point.Payload.DevEUI] = make(map[string]string)
 			s.lastAttrs[point.Payload.DevEUI][n] = v
 		}
+		s.mtx.Unlock()
 
 		if !point.Valid {
 			if os.Getenv("DEBUG") == "1" {
-				log.Printf("skipping data with invalid or stale gps coords, body:%+v", point)
+				log.Printf("skipping data with invalid or stale gps coords devName:%v, rejected:%v body:%+v", point.Payload.DeviceName, point.Rejected, point)
 			}
 			continue
 		}
 
-		if hdop := os.Getenv("HDOP"); hdop != "" {
-			hdopF, err := strconv.ParseFloat(hdop, 32)
-			if err != nil {
-				err := errors.Wrapf(err, "parsing env hdop value:%+v", hdop)
-				log.Print(err.Error())
-				errs = multierror.Append(errs, err)
-				continue
-			}
-
-			if point.Hdop > hdopF {
-				if os.Getenv("DEBUG") == "1" {
-					log.Printf("skipping data with high HDOP current:%+v, threshold:%v", point.Hdop, hdopF)
-				}
-				continue
-			}
+		if err := s.send(server, point); err != nil {
+			errs = multierror.Append(errs, errors.Wrapf(err, "devName:%v", point.Payload.DeviceName))
 		}
+	}
 
-		req, err := http.NewRequest("GET", server[0], nil)
-		if err != nil {
-			errs = multierror.Append(errs, errors.Wrap(err, "creating a new request"))
-			continue
-		}
+	return errs
+}
 
-		q := req.URL.Query()
-		q.Add("id", point.Payload.DevEUI.String())
-		q.Add("lat", fmt.Sprintf("%g", point.Lat))
-		q.Add("timestamp", strconv.Itoa(int(point.Time)))
-		q.Add("lon", fmt.Sprintf("%g", point.Lon))
-		q.Add("snr", fmt.Sprintf("%g", point.Snr))
-		q.Add("rssi", strconv.Itoa(point.Rssi))
-		q.Add("speed", fmt.Sprintf("%f", point.Speed))
-
-		// Add last reocorded attributes in case they are missing in the new request
-		// and they will be overrided by the new value if the attr exists.
-		for n, v := range s.lastAttrs[point.Payload.DevEUI] {
-			q.Set(n, fmt.Sprintf("%v", v))
-		}
-		// Override the attr with the new values.
-		for n, v := range point.Attr {
-			q.Set(n, fmt.Sprintf("%v", v))
-		}
+// send creates a single traccar position.
+func (s *Handler) send(server string, point *device.Data) error {
+	req, err := http.NewRequest("GET", server, nil)
+	if err != nil {
+		return errors.Wrap(err, "creating a new request")
+	}
 
-		req.URL.RawQuery = q.Encode()
+	q := req.URL.Query()
+	q.Add("id", point.Payload.DevEUI.String())
+	q.Add("lat", fmt.Sprintf("%g", point.Lat))
+	q.Add("timestamp", strconv.Itoa(int(point.Time)))
+	q.Add("lon", fmt.Sprintf("%g", point.Lon))
+	q.Add("snr", fmt.Sprintf("%g", point.Snr))
+	q.Add("rssi", strconv.Itoa(point.Rssi))
+	q.Add("speed", fmt.Sprintf("%f", point.Speed))
+	if point.Distance > 0 {
+		q.Add("bearing", fmt.Sprintf("%.1f", point.Bearing))
+	}
 
-		res, err := s.httpClient.Do(req)
-		if err != nil {
-			errs = multierror.Append(errs, errors.Wrap(err, "sending the  request"))
-			continue
-		}
-		defer res.Body.Close()
+	// Add last reocorded attributes in case they are missing in the new request
+	// and they will be overrided by the new value if the attr exists.
+	s.mtx.Lock()
+	for n, v := range s.lastAttrs[point.Payload.DevEUI] {
+		q.Set(n, fmt.Sprintf("%v", v))
+	}
+	s.mtx.Unlock()
+	// Override the attr with the new values.
+	for n, v := range point.Attr {
+		q.Set(n, fmt.Sprintf("%v", v))
+	}
 
-		if res.StatusCode/100 != 2 {
-			httpError(w, "unexpected response status code:"+strconv.Itoa(res.StatusCode)+" request:"+req.URL.Host+"?"+req.URL.RawQuery, http.StatusBadRequest)
-			return
-		}
-		if os.Getenv("DEBUG") == "1" {
-			body, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				log.Printf("reading response body err:%v", err)
-			} else {
-				log.Printf("reply status:%v, body:%v", res.StatusCode, string(body))
-			}
-		}
+	req.URL.RawQuery = q.Encode()
 
-		log.Println("gps point created, request:", req.URL.RawQuery)
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "sending the  request")
 	}
+	defer res.Body.Close()
 
-	if errs != nil {
-		httpError(w, errs.Error(), http.StatusBadRequest)
-		return
+	if res.StatusCode/100 != 2 {
+		return errors.New("unexpected response status code:" + strconv.Itoa(res.StatusCode) + " request:" + req.URL.Host + "?" + req.URL.RawQuery)
+	}
+	if os.Getenv("DEBUG") == "1" {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			log.Printf("reading response body err:%v", err)
+		} else {
+			log.Printf("reply status:%v, body:%v", res.StatusCode, string(body))
+		}
 	}
 
-	w.WriteHeader(http.StatusOK)
+	log.Println("gps point created, devName:", point.Payload.DeviceName, "request:", req.URL.RawQuery)
+	return nil
 }
 
 func httpError(w http.ResponseWriter, err string, code int) {
@@ -0,0 +1,51 @@
+package ttn
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/device"
+	"github.com/arribada/LoraTracker/receiver/LoraToGPSServer/worker"
+)
+
+// NewHandler creates a new handler for The Things Stack uplink message webhooks.
+func NewHandler(m *device.Manager, handle func(points []*device.Data) error) *Handler {
+	return &Handler{
+		devManager: m,
+		handle:     handle,
+	}
+}
+
+// Handler parses The Things Stack webhooks and
+// passes the points to the same sinks as the chirpstack integrations.
+type Handler struct {
+	devManager *device.Manager
+	handle     func(points []*device.Data) error
+}
+
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	points, err := s.devManager.ParseTTN(r)
+	if err != nil {
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.handle(points); err != nil {
+		// The retry of a rejected or failed delivery would be dropped as a duplicate.
+		s.devManager.Forget(points)
+		if worker.Unavailable(w, err) {
+			return
+		}
+		httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func httpError(w http.ResponseWriter, err string, code int) {
+	_, fn, line, _ := runtime.Caller(1)
+	log.Printf("[error] %s:%d %v", fn, line, err)
+	http.Error(w, err, code)
+}
@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ErrClosed is returned for the jobs submitted after the pool is closed.
+var ErrClosed = errors.New("the worker pool is closed")
+
+// QueueFullError is returned when a job is rejected because the queue is full.
+type QueueFullError struct {
+	// RetryAfter is the suggested wait before submitting again.
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return "the worker queue is full, retry after:" + e.RetryAfter.String()
+}
+
+// NewPool starts the workers each with its own bounded queue.
+func NewPool(workers, queueSize int, retryAfter time.Duration) *Pool {
+	return newPool(workers, queueSize, retryAfter, newMetrics())
+}
+
+func newPool(workers, queueSize int, retryAfter time.Duration, m *metrics) *Pool {
+	size := queueSize / workers
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{
+		retryAfter: retryAfter,
+		quit:       make(chan struct{}),
+		metrics:    m,
+	}
+	for i := 0; i < workers; i++ {
+		q := make(chan func(), size)
+		p.queues = append(p.queues, q)
+		p.wg.Add(1)
+		go p.run(q)
+	}
+	return p
+}
+
+// Pool runs the jobs in the background.
+// The jobs with the same key are queued to the same worker
+// so that these run in the order they were submitted.
+type Pool struct {
+	queues     []chan func()
+	retryAfter time.Duration
+	// mtx guards the queues from being closed while submitting.
+	mtx     sync.RWMutex
+	closed  bool
+	quit    chan struct{}
+	wg      sync.WaitGroup
+	metrics *metrics
+}
+
+func (p *Pool) run(q chan func()) {
+	defer p.wg.Done()
+	for job := range q {
+		p.metrics.queued.Dec()
+		p.do(job)
+	}
+}
+
+func (p *Pool) do(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[error] worker job panic:%v", r)
+		}
+	}()
+	job()
+}
+
+func (p *Pool) queue(key string) chan func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
+
+// TrySubmit queues a job without waiting and
+// returns a QueueFullError when the queue is full.
+func (p *Pool) TrySubmit(key string, job func()) error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	// Increased before the send because the worker can take the job
+	// and decrease the queue length before the send returns.
+	p.metrics.queued.Inc()
+	select {
+	case p.queue(key) <- job:
+		return nil
+	default:
+		p.metrics.queued.Dec()
+		p.metrics.rejected.Inc()
+		return &QueueFullError{RetryAfter: p.retryAfter}
+	}
+}
+
+// Submit queues a job and waits while the queue is full.
+func (p *Pool) Submit(key string, job func()) error {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.metrics.queued.Inc()
+	select {
+	case p.queue(key) <- job:
+		return nil
+	case <-p.quit:
+		p.metrics.queued.Dec()
+		return ErrClosed
+	}
+}
+
+// Close stops accepting new jobs and waits for the queued jobs to complete.
+func (p *Pool) Close(ctx context.Context) error {
+	// Unblock the waiting submits before taking the lock.
+	close(p.quit)
+	p.mtx.Lock()
+	p.closed = true
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		var left int
+		for _, q := range p.queues {
+			left += len(q)
+		}
+		return errors.Wrapf(ctx.Err(), "draining the worker queues, jobs left:%v", left)
+	}
+}
+
+// Unavailable replies with status 503 when the job was rejected
+// because the queue is full or the pool is closed and reports if it replied.
+func Unavailable(w http.ResponseWriter, err error) bool {
+	var full *QueueFullError
+	switch {
+	case errors.As(err, &full):
+		// The header is in whole seconds and 0 would mean an immediate retry.
+		seconds := int(math.Ceil(full.RetryAfter.Seconds()))
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	case errors.Is(err, ErrClosed):
+	default:
+		return false
+	}
+	log.Printf("[error] rejecting a request err:%v", err)
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		queued: promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Name: "worker_queue_length",
+				Help: "The number of jobs waiting in the worker queues.",
+			},
+		),
+		rejected: promauto.NewCounter(
+			prometheus.CounterOpts{
+				Name: "worker_queue_rejected_total",
+				Help: "The total number of jobs rejected because the worker queue is full.",
+			},
+		),
+	}
+}
+
+type metrics struct {
+	queued   prometheus.Gauge
+	rejected prometheus.Counter
+}
@@ -0,0 +1,212 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testMetrics are shared by the tests because the metrics can be registered only once.
+var testMetrics = newMetrics()
+
+// blockWorker submits a job which blocks the worker of the key until release is closed
+// and returns once the worker has taken the job from the queue.
+func blockWorker(t *testing.T, p *Pool, key string) (release chan struct{}) {
+	t.Helper()
+	started := make(chan struct{})
+	release = make(chan struct{})
+	if err := p.Submit(key, func() {
+		close(started)
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the blocking job didn't start")
+	}
+	return release
+}
+
+func TestPoolKeyOrder(t *testing.T) {
+	p := newPool(4, 100, time.Second, testMetrics)
+
+	keys := []string{"collar1", "collar2", "collar3", "collar4", "collar5"}
+	var mtx sync.Mutex
+	got := make(map[string][]int)
+	for i := 0; i < 200; i++ {
+		key, n := keys[i%len(keys)], i
+		err := p.Submit(key, func() {
+			// Uneven job durations to mix the workers.
+			if n%7 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			mtx.Lock()
+			got[key] = append(got[key], n)
+			mtx.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		if len(got[key]) != 40 {
+			t.Fatalf("key:%v jobs got:%v expected:40", key, len(got[key]))
+		}
+		for i := 1; i < len(got[key]); i++ {
+			if got[key][i] < got[key][i-1] {
+				t.Fatalf("key:%v jobs order got:%v", key, got[key])
+			}
+		}
+	}
+}
+
+func TestPoolTrySubmitFull(t *testing.T) {
+	p := newPool(1, 1, 1500*time.Millisecond, testMetrics)
+	queued := testutil.ToFloat64(testMetrics.queued)
+	rejected := testutil.ToFloat64(testMetrics.rejected)
+
+	release := blockWorker(t, p, "collar1")
+	ran := make(chan struct{})
+	if err := p.TrySubmit("collar1", func() { close(ran) }); err != nil {
+		t.Fatal(err)
+	}
+
+	err := p.TrySubmit("collar1", func() { t.Error("the rejected job ran") })
+	var full *QueueFullError
+	if !errors.As(err, &full) || full.RetryAfter != 1500*time.Millisecond {
+		t.Fatalf("error got:%v expected a queue full error", err)
+	}
+	if got := testutil.ToFloat64(testMetrics.queued) - queued; got != 1 {
+		t.Errorf("queue length metric got:%v expected:1", got)
+	}
+	if got := testutil.ToFloat64(testMetrics.rejected) - rejected; got != 1 {
+		t.Errorf("rejected metric got:%v expected:1", got)
+	}
+
+	close(release)
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued job didn't run")
+	}
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(testMetrics.queued) - queued; got != 0 {
+		t.Errorf("queue length metric after the jobs got:%v expected:0", got)
+	}
+}
+
+func TestPoolCloseDrains(t *testing.T) {
+	p := newPool(2, 20, time.Second, testMetrics)
+	release := blockWorker(t, p, "collar1")
+
+	var mtx sync.Mutex
+	var ran int
+	for i := 0; i < 10; i++ {
+		err := p.TrySubmit("collar"+strconv.Itoa(i), func() {
+			mtx.Lock()
+			ran++
+			mtx.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- p.Close(context.Background())
+	}()
+	// The new jobs are rejected once the pool is closing.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := p.TrySubmit("collar1", func() {})
+		if errors.Is(err, ErrClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("submit after close error got:%v expected:%v", err, ErrClosed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Submit("collar1", func() {}); !errors.Is(err, ErrClosed) {
+		t.Errorf("submit after close error got:%v expected:%v", err, ErrClosed)
+	}
+
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if ran != 10 {
+		t.Errorf("jobs run before close returned got:%v expected:10", ran)
+	}
+}
+
+func TestPoolCloseTimeout(t *testing.T) {
+	p := newPool(1, 10, time.Second, testMetrics)
+	release := blockWorker(t, p, "collar1")
+	for i := 0; i < 3; i++ {
+		if err := p.TrySubmit("collar1", func() {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := p.Close(ctx)
+	if err == nil || !strings.Contains(err.Error(), "jobs left:3") {
+		t.Errorf("error got:%v expected the jobs left", err)
+	}
+
+	// The workers still complete the jobs after the timeout.
+	close(release)
+	p.wg.Wait()
+}
+
+func TestUnavailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		replied    bool
+		retryAfter string
+	}{
+		{name: "queue full", err: &QueueFullError{RetryAfter: 2 * time.Second}, replied: true, retryAfter: "2"},
+		{name: "queue full rounded up", err: &QueueFullError{RetryAfter: 1500 * time.Millisecond}, replied: true, retryAfter: "2"},
+		{name: "queue full below a second", err: &QueueFullError{RetryAfter: 200 * time.Millisecond}, replied: true, retryAfter: "1"},
+		{name: "queue full without a wait", err: &QueueFullError{}, replied: true, retryAfter: "1"},
+		{name: "closed", err: ErrClosed, replied: true},
+		{name: "other error", err: errors.New("invalid points")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if replied := Unavailable(w, tt.err); replied != tt.replied {
+				t.Fatalf("replied got:%v expected:%v", replied, tt.replied)
+			}
+			if !tt.replied {
+				return
+			}
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("status got:%v expected:%v", w.Code, http.StatusServiceUnavailable)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After got:%q expected:%q", got, tt.retryAfter)
+			}
+		})
+	}
+}
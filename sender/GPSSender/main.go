@@ -123,15 +123,21 @@ func main() {
 		invalidCount = 0
 
 		// The amount of data that can be send is limited by region and dr.
-		// If the received data is empty should increase the dr settings of the lora module.
-		dataLora := fmt.Sprintf("%.6f", dataGPS.Latitude) + "," + fmt.Sprintf("%.6f", dataGPS.Longitude)
-		if os.Getenv("SINGLE_POINTS") == "1" {
-			dataLora += ",s"
+		// If the received data is empty should increase the dr settings of the lora module
+		// or use the binary payload format which is smaller.
+		var dataLora []byte
+		if os.Getenv("PAYLOAD_FORMAT") == "binary" {
+			dataLora = encodeBinary(dataGPS, os.Getenv("SINGLE_POINTS") == "1")
+		} else {
+			dataLora = []byte(fmt.Sprintf("%.6f", dataGPS.Latitude) + "," + fmt.Sprintf("%.6f", dataGPS.Longitude))
+			if os.Getenv("SINGLE_POINTS") == "1" {
+				dataLora = append(dataLora, ",s"...)
+			}
 		}
 		if debug {
-			log.Printf("%v:trying to send gps GGA:%v lora:%v encoded:%v\n", attempt, dataGPS, dataLora, hex.EncodeToString([]byte(dataLora)))
+			log.Printf("%v:trying to send gps GGA:%v lora:%q encoded:%v\n", attempt, dataGPS, dataLora, hex.EncodeToString(dataLora))
 		}
-		resp, err := lora.Send("0,1," + hex.EncodeToString([]byte(dataLora)))
+		resp, err := lora.Send("0,1," + hex.EncodeToString(dataLora))
 		if err != nil {
 			log.Println("failed to send data err:", err)
 			// Attempt to register again.
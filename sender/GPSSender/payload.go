@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/adrianmo/go-nmea"
+)
+
+// The binary payload format which is decoded by device.Rpi in the receiver.
+// Keep in sync with receiver/LoraToGPSServer/device/rpi.go
+//
+//	0 version, 1 flags, 2-5 lat int32 degrees*1e7, 6-9 lon int32 degrees*1e7,
+//	followed by the optional fields set in the flags in this order:
+//	hdop uint8 *10, satellites uint8, altitude int16 meters.
+//
+// All values are little endian.
+const (
+	payloadVersion1 = 0x01
+
+	flagHdop       = 1 << 0
+	flagSatellites = 1 << 1
+	flagAltitude   = 1 << 2
+	flagSingle     = 1 << 7
+)
+
+// encodeBinary packs a GGA fix in 14 bytes instead of
+// the about 21 bytes of the "lat,lon" ascii format.
+func encodeBinary(data nmea.GGA, single bool) []byte {
+	b := make([]byte, 10, 14)
+	b[0] = payloadVersion1
+	binary.LittleEndian.PutUint32(b[2:6], uint32(int32(math.Round(data.Latitude*1e7))))
+	binary.LittleEndian.PutUint32(b[6:10], uint32(int32(math.Round(data.Longitude*1e7))))
+
+	flags := byte(flagHdop | flagSatellites | flagAltitude)
+	if single {
+		flags |= flagSingle
+	}
+	b[1] = flags
+
+	b = append(b, byte(math.Min(math.Round(data.HDOP*10), math.MaxUint8)))
+	b = append(b, byte(math.Min(float64(data.NumSatellites), math.MaxUint8)))
+	alt := math.Max(math.Min(math.Round(data.Altitude), math.MaxInt16), math.MinInt16)
+	b = append(b, 0, 0)
+	binary.LittleEndian.PutUint16(b[len(b)-2:], uint16(int16(alt)))
+
+	return b
+}
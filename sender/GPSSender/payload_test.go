@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/adrianmo/go-nmea"
+)
+
+// The expected payloads are the same as the ones decoded in
+// receiver/LoraToGPSServer/device/rpi_test.go so that together
+// the two tests check the round trip of the format.
+func TestEncodeBinary(t *testing.T) {
+	tests := []struct {
+		name     string
+		fix      nmea.GGA
+		single   bool
+		expected string
+	}{
+		{
+			name:     "track point",
+			fix:      nmea.GGA{Latitude: -1.2512345, Longitude: 36.8545678, HDOP: 1.2, NumSatellites: 7, Altitude: 1650.4},
+			expected: "0107a71341ff8e8ff7150c077206",
+		},
+		{
+			name:     "single point",
+			fix:      nmea.GGA{Latitude: -1.2512345, Longitude: 36.8545678, HDOP: 1.2, NumSatellites: 7, Altitude: 1649.6},
+			single:   true,
+			expected: "0187a71341ff8e8ff7150c077206",
+		},
+		{
+			name:     "values above the field limits",
+			fix:      nmea.GGA{Latitude: -89.9999999, Longitude: -179.9999999, HDOP: 99.9, NumSatellites: 300, Altitude: -420},
+			expected: "010701175bca012eb694ffff5cfe",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := encodeBinary(tt.fix, tt.single)
+			if got := hex.EncodeToString(b); got != tt.expected {
+				t.Errorf("payload got:%v expected:%v", got, tt.expected)
+			}
+			if len(b) != 14 {
+				t.Errorf("payload length got:%v expected:14", len(b))
+			}
+		})
+	}
+}